@@ -0,0 +1,48 @@
+package githubsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// expandApps returns the entries the config entry key, raw in the config,
+// stands for: the entry itself, or one entry per app of a monorepo entry
+// with apps. App entries are keyed <key>:<app> and configured like the
+// entry with the app's fields on top. An app with a workdir restarts only
+// for pushes within it unless it sets restart_paths.
+func expandApps(key string, raw json.RawMessage) (map[string]Repo, error) {
+	repo := Repo{}
+	err := json.Unmarshal(raw, &repo)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", key, err)
+	}
+	if len(repo.Apps) == 0 {
+		return map[string]Repo{key: repo}, nil
+	}
+	apps := map[string]Repo{}
+	for name, appRaw := range repo.Apps {
+		if name == "" || strings.ContainsAny(name, "/:@") {
+			return nil, fmt.Errorf("%s: invalid app name %q", key, name)
+		}
+		own := Repo{}
+		err = json.Unmarshal(appRaw, &own)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%s: %s", key, name, err)
+		}
+		if len(own.Apps) > 0 {
+			return nil, fmt.Errorf("%s:%s: apps can't have apps", key, name)
+		}
+		// Decode the entry again so that apps share no pointers
+		app := Repo{}
+		json.Unmarshal(raw, &app)
+		json.Unmarshal(appRaw, &app)
+		app.Apps = nil
+		if app.Workdir != "" && app.RestartPaths == nil {
+			app.RestartPaths = []string{path.Join(app.Workdir, "**")}
+		}
+		apps[key+":"+name] = app
+	}
+	return apps, nil
+}
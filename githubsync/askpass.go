@@ -0,0 +1,131 @@
+package githubsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// askpassCredential is what git is told when it asks for credentials for
+// Host.
+type askpassCredential struct {
+	Host     string `json:"host"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// gitAuthEnv returns the environment that makes git ask us for
+// credentials through GIT_ASKPASS instead of storing them in the remote URL.
+func (s *Server) gitAuthEnv() []string {
+	if s.tokenSource == nil {
+		return nil
+	}
+	token, err := s.tokenSource()
+	if err != nil {
+		slog.Error("Getting git token failed", "err", err)
+		return nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		slog.Error("Getting git token failed", "err", err)
+		return nil
+	}
+	creds := []askpassCredential{{"github.com", "x-access-token", token}}
+	if u, err := url.Parse(s.cfg.GitHubURL); err == nil && s.cfg.GitHubURL != "" {
+		creds = append(creds, askpassCredential{u.Hostname(), "x-access-token", token})
+	}
+	if s.repos.Load() != nil {
+		for _, repo := range s.config() {
+			u, err := url.Parse(repo.hostURL())
+			if err != nil {
+				continue
+			}
+			switch repo.provider() {
+			case providerGitHub:
+				if u.Hostname() != "github.com" {
+					creds = append(creds, askpassCredential{u.Hostname(), "x-access-token", token})
+				}
+			case providerGitLab:
+				creds = append(creds, askpassCredential{u.Hostname(), "oauth2", s.cfg.GitLabToken})
+			case providerGitea:
+				// Gitea takes any username along with a token
+				creds = append(creds, askpassCredential{u.Hostname(), "github-sync", s.cfg.GiteaToken})
+			case providerBitbucket:
+				creds = append(creds, askpassCredential{u.Hostname(), s.cfg.BitbucketUsername, s.cfg.BitbucketAppPassword})
+			}
+		}
+	}
+	b, err := json.Marshal(creds)
+	if err != nil {
+		panic(err)
+	}
+	return []string{
+		"GIT_ASKPASS=" + self,
+		"GIT_TERMINAL_PROMPT=0",
+		"GITHUB_SYNC_ASKPASS=" + string(b),
+	}
+}
+
+// Askpass answers git's credential prompt and returns true if the process
+// was started by git as GIT_ASKPASS. Git runs the current executable for
+// that, so programs embedding a Server must call Askpass first thing in
+// main and exit if it returns true.
+func Askpass() bool {
+	if os.Getenv("GITHUB_SYNC_ASKPASS") == "" || len(os.Args) != 2 {
+		return false
+	}
+	askpass(os.Args[1])
+	return true
+}
+
+// askpass answers the username and password prompts for the hosts in
+// GITHUB_SYNC_ASKPASS only, so tokens are never sent to other remotes
+// such as mirrors.
+func askpass(prompt string) {
+	creds := []askpassCredential{}
+	if json.Unmarshal([]byte(os.Getenv("GITHUB_SYNC_ASKPASS")), &creds) != nil {
+		os.Exit(1)
+	}
+
+	// Prompts look like "Password for 'https://user@github.com': "
+	start := strings.Index(prompt, "'")
+	end := strings.LastIndex(prompt, "'")
+	if start < 0 || end <= start {
+		os.Exit(1)
+	}
+	u, err := url.Parse(prompt[start+1 : end])
+	if err != nil {
+		os.Exit(1)
+	}
+	for _, c := range creds {
+		if u.Hostname() != c.Host {
+			continue
+		}
+		if strings.HasPrefix(prompt, "Username") {
+			fmt.Println(c.Username)
+			return
+		}
+		fmt.Println(c.Password)
+		return
+	}
+	os.Exit(1)
+}
+
+// stripCredentials returns remoteURL without the password of its user
+// info, e.g. https://github.com/owner/name.git for
+// https://x-access-token:<token>@github.com/owner/name.git, and whether
+// it had one.
+func stripCredentials(remoteURL string) (string, bool) {
+	u, err := url.Parse(remoteURL)
+	if err != nil || u.User == nil {
+		return remoteURL, false
+	}
+	if _, ok := u.User.Password(); !ok {
+		return remoteURL, false
+	}
+	u.User = nil
+	return u.String(), true
+}
@@ -0,0 +1,52 @@
+package githubsync
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestMain lets git run the test binary as GIT_ASKPASS, like main does
+// with the github-sync binary.
+func TestMain(m *testing.M) {
+	if Askpass() {
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestAskpassRotatedToken(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), map[string]Repo{})
+	token := "first"
+	s.tokenSource = func() (string, error) { return token, nil }
+	// ask answers prompt like git's GIT_ASKPASS invocation would
+	ask := func(prompt string) (string, error) {
+		env := s.gitAuthEnv()
+		var askpass string
+		for _, kv := range env {
+			if v, ok := strings.CutPrefix(kv, "GIT_ASKPASS="); ok {
+				askpass = v
+			}
+		}
+		cmd := exec.Command(askpass, prompt)
+		cmd.Env = append(os.Environ(), env...)
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+
+	user, err := ask("Username for 'https://github.com': ")
+	if err != nil || user != "x-access-token" {
+		t.Fatalf("got username %q, %v", user, err)
+	}
+	for _, want := range []string{"first", "second"} {
+		token = want
+		got, err := ask("Password for 'https://x-access-token@github.com': ")
+		if err != nil || got != want {
+			t.Fatalf("got password %q, %v, want %q", got, err, want)
+		}
+	}
+	if got, err := ask("Password for 'https://mirror.example.com': "); err == nil {
+		t.Fatalf("sent %q to another host", got)
+	}
+}
@@ -0,0 +1,101 @@
+package githubsync
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// AuditLog appends one JSON record per deploy to a file. A zero AuditLog
+// with no Path discards records.
+type AuditLog struct {
+	Path string
+	mu   sync.Mutex
+}
+
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	End      time.Time `json:"end"`
+	Repo     string    `json:"repo"`
+	Branch   string    `json:"branch"`
+	Commit   string    `json:"commit"`
+	Pusher   string    `json:"pusher"`
+	Delivery string    `json:"delivery"`
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+	Duration float64   `json:"duration_seconds"`
+}
+
+// Record appends rec to the log. Each record is written with a single
+// O_APPEND write so records never interleave.
+func (a *AuditLog) Record(rec *AuditRecord) {
+	if a.Path == "" {
+		return
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		panic(err)
+	}
+	b = append(b, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(a.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		slog.Error("Writing audit log failed", "err", err)
+		return
+	}
+	defer f.Close()
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		slog.Error("Writing audit log failed", "err", err)
+	}
+}
+
+// Read returns the records of the log, newest first. If repo is set, only
+// its records are returned, and if limit is positive, at most limit
+// records. A missing log has no records.
+func (a *AuditLog) Read(repo string, limit int) ([]*AuditRecord, error) {
+	recs := []*AuditRecord{}
+	if a.Path == "" {
+		return recs, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.Open(a.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return recs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		rec := &AuditRecord{}
+		// Skip lines torn by a crash mid-write
+		if json.Unmarshal(scanner.Bytes(), rec) != nil {
+			continue
+		}
+		if repo == "" || rec.Repo == repo {
+			recs = append(recs, rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	slices.Reverse(recs)
+	if limit > 0 && len(recs) > limit {
+		recs = recs[:limit]
+	}
+	return recs, nil
+}
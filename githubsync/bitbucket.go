@@ -0,0 +1,290 @@
+package githubsync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// bitbucketAPI is the base URL of the Bitbucket Cloud API.
+const bitbucketAPI = "https://api.bitbucket.org/2.0"
+
+// bitbucketProvider is the API of Bitbucket Cloud, authenticated with an
+// app password. Repo IDs are workspace/slug.
+type bitbucketProvider struct {
+	username string
+	password string
+	baseURL  string
+}
+
+// bitbucketHook is a repo webhook as the Bitbucket API represents it.
+type bitbucketHook struct {
+	UUID        string   `json:"uuid,omitempty"`
+	Description string   `json:"description"`
+	URL         string   `json:"url"`
+	Active      bool     `json:"active"`
+	Events      []string `json:"events"`
+	Secret      string   `json:"secret,omitempty"`
+}
+
+// bitbucketHookID returns the id a hook is recorded under. Bitbucket
+// identifies hooks by UUID, so the id is derived from it and DeleteHook
+// looks the hook up by it.
+func bitbucketHookID(uuid string) int64 {
+	sum := sha256.Sum256([]byte(uuid))
+	return int64(binary.BigEndian.Uint64(sum[:8]) >> 1)
+}
+
+// hooksURL returns the API URL of the hooks of repoID.
+func (p *bitbucketProvider) hooksURL(repoID string) string {
+	return fmt.Sprintf("%s/repositories/%s/hooks", p.baseURL, repoID)
+}
+
+func (p *bitbucketProvider) do(method, apiURL string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, apiURL, bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.SetBasicAuth(p.username, p.password)
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// hooks lists the hooks of repoID, following the pagination.
+func (p *bitbucketProvider) hooks(repoID string) ([]bitbucketHook, error) {
+	hooks := []bitbucketHook{}
+	next := p.hooksURL(repoID)
+	for next != "" {
+		res, err := p.do("GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != 200 {
+			err = bitbucketError(res, repoID)
+			res.Body.Close()
+			return nil, err
+		}
+		page := struct {
+			Values []bitbucketHook `json:"values"`
+			Next   string          `json:"next"`
+		}{}
+		err = json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, page.Values...)
+		next = page.Next
+	}
+	return hooks, nil
+}
+
+func (p *bitbucketProvider) RegisterHook(repoID, webhookURL, legacyURL string, events []string, secret string) (int64, error) {
+	// Get list of current hooks
+	hooks, err := p.hooks(repoID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Return early if URL is already registered. Bitbucket doesn't reveal
+	// secrets, so hooks are updated whenever one is configured.
+	for _, hook := range hooks {
+		if sameURL(hook.URL, webhookURL) && hook.Active && includes(hook.Events, "repo:push") && secret == "" {
+			return bitbucketHookID(hook.UUID), nil
+		}
+	}
+	body, err := json.Marshal(bitbucketHook{
+		Description: "github-sync",
+		URL:         webhookURL,
+		Active:      true,
+		Events:      []string{"repo:push"},
+		Secret:      secret,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// Update a hook registered at the legacy URL or for other events instead
+	for _, hook := range hooks {
+		if sameURL(hook.URL, webhookURL) {
+			slog.Info("Updating hook", "repo", repoID)
+			return bitbucketHookID(hook.UUID), p.updateHook(repoID, hook.UUID, body)
+		}
+		if legacyURL != "" && sameURL(hook.URL, legacyURL) {
+			slog.Info("Moving hook", "repo", repoID, "from", legacyURL, "to", webhookURL)
+			return bitbucketHookID(hook.UUID), p.updateHook(repoID, hook.UUID, body)
+		}
+	}
+
+	// Create the hook
+	res, err := p.do("POST", p.hooksURL(repoID), body)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return 0, bitbucketError(res, repoID)
+	}
+	created := &bitbucketHook{}
+	err = json.NewDecoder(res.Body).Decode(created)
+	if err != nil {
+		return 0, err
+	}
+	return bitbucketHookID(created.UUID), nil
+}
+
+func (p *bitbucketProvider) updateHook(repoID, uuid string, body []byte) error {
+	res, err := p.do("PUT", p.hooksURL(repoID)+"/"+uuid, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return bitbucketError(res, repoID)
+	}
+	return nil
+}
+
+func (p *bitbucketProvider) DeleteHook(repoID string, hookID int64) error {
+	hooks, err := p.hooks(repoID)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		if bitbucketHookID(hook.UUID) != hookID {
+			continue
+		}
+		res, err := p.do("DELETE", p.hooksURL(repoID)+"/"+hook.UUID, nil)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		// A 404 means the hook is already gone.
+		if res.StatusCode != 204 && res.StatusCode != 404 {
+			return bitbucketError(res, repoID)
+		}
+	}
+	return nil
+}
+
+// bitbucketRef is the old or new state of a ref in a Bitbucket push.
+type bitbucketRef struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Target struct {
+		Hash    string `json:"hash"`
+		Message string `json:"message"`
+		Author  struct {
+			Raw  string `json:"raw"`
+			User *struct {
+				DisplayName string `json:"display_name"`
+			} `json:"user"`
+		} `json:"author"`
+	} `json:"target"`
+}
+
+// bitbucketPush is the payload of a Bitbucket repo:push event.
+type bitbucketPush struct {
+	Actor struct {
+		DisplayName string `json:"display_name"`
+		Nickname    string `json:"nickname"`
+	} `json:"actor"`
+	Repository *struct {
+		FullName string `json:"full_name"`
+		Parent   any    `json:"parent"`
+	} `json:"repository"`
+	Push struct {
+		Changes []struct {
+			New *bitbucketRef `json:"new"`
+			Old *bitbucketRef `json:"old"`
+		} `json:"changes"`
+	} `json:"push"`
+}
+
+// DecodeWebhook translates a Bitbucket push into the GitHub push it
+// corresponds to. A push can update several refs; the first branch it
+// updates is deployed. The payload doesn't list changed files, so every
+// deploy runs the install. Other events decode to a request without a
+// ref, which no entry tracks.
+func (p *bitbucketProvider) DecodeWebhook(r *http.Request, body []byte) (*WebhookRequest, error) {
+	push := &bitbucketPush{}
+	err := json.Unmarshal(body, push)
+	if err != nil {
+		return nil, err
+	}
+	req := &WebhookRequest{
+		Pusher: GithubPusher{Name: push.Actor.Nickname},
+		Sender: GithubOwner{Login: push.Actor.Nickname},
+	}
+	if push.Repository != nil {
+		id := push.Repository.FullName
+		owner, name, _ := strings.Cut(id, "/")
+		req.Repository = &GithubRepository{
+			Name:     name,
+			FullName: id,
+			Fork:     push.Repository.Parent != nil,
+			Owner:    GithubOwner{Login: owner},
+		}
+	}
+	if r.Header.Get("X-Event-Key") != "repo:push" {
+		return req, nil
+	}
+	for _, c := range push.Push.Changes {
+		if c.New != nil && c.New.Type == "branch" {
+			req.Ref = "refs/heads/" + c.New.Name
+			req.After = c.New.Target.Hash
+			req.HeadCommit = &GithubCommit{
+				ID:      c.New.Target.Hash,
+				Message: c.New.Target.Message,
+				Author:  GithubCommitAuthor{Name: c.New.Target.Author.Raw},
+			}
+			if user := c.New.Target.Author.User; user != nil {
+				req.HeadCommit.Author.Name = user.DisplayName
+			}
+			break
+		}
+		if c.New == nil && c.Old != nil && c.Old.Type == "branch" {
+			req.Ref = "refs/heads/" + c.Old.Name
+			req.Deleted = true
+			break
+		}
+	}
+	return req, nil
+}
+
+// VerifyWebhook checks the X-Hub-Signature header, which Bitbucket sets
+// like GitHub's X-Hub-Signature-256.
+func (p *bitbucketProvider) VerifyWebhook(r *http.Request, body []byte, secret string) error {
+	sig, ok := strings.CutPrefix(r.Header.Get("X-Hub-Signature"), "sha256=")
+	if !ok {
+		return errors.New("missing X-Hub-Signature")
+	}
+	return checkHMAC(secret, body, sig, "X-Hub-Signature")
+}
+
+// bitbucketError builds an error from a failed Bitbucket API response.
+func bitbucketError(res *http.Response, repoID string) error {
+	b, _ := io.ReadAll(res.Body)
+	e := struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	msg := strings.TrimSpace(string(b))
+	if json.Unmarshal(b, &e) == nil && e.Error.Message != "" {
+		msg = e.Error.Message
+	}
+	if res.StatusCode == 401 {
+		msg += " (BITBUCKET_USERNAME or BITBUCKET_APP_PASSWORD is wrong)"
+	}
+	return fmt.Errorf("%s: %d: %s", repoID, res.StatusCode, msg)
+}
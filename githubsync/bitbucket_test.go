@@ -0,0 +1,145 @@
+package githubsync
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// bitbucketPushPayload is a trimmed Bitbucket repo:push event updating
+// main and deleting old. The first branch it updates is deployed.
+const bitbucketPushPayload = `{
+  "actor": {"display_name": "Jane Doe", "nickname": "jdoe"},
+  "repository": {"full_name": "team/app", "name": "app"},
+  "push": {
+    "changes": [
+      {
+        "old": {"type": "branch", "name": "main", "target": {"hash": "1e65c05c1d5171631d92438a13901ca7dae9618c"}},
+        "new": {
+          "type": "branch",
+          "name": "main",
+          "target": {
+            "hash": "709d658dc5b6d6afcd46049c2f332ee3f515a67d",
+            "message": "Add a handler\n",
+            "author": {"raw": "Jane Doe <jane@example.com>", "user": {"display_name": "Jane Doe"}}
+          }
+        }
+      },
+      {
+        "old": {"type": "branch", "name": "old", "target": {"hash": "1e65c05c1d5171631d92438a13901ca7dae9618c"}},
+        "new": null
+      }
+    ]
+  }
+}`
+
+func TestBitbucketDecodeWebhook(t *testing.T) {
+	p := &bitbucketProvider{}
+	decode := func(event, payload string) *WebhookRequest {
+		t.Helper()
+		r := httptest.NewRequest("POST", "/", strings.NewReader(payload))
+		r.Header.Set("X-Event-Key", event)
+		req, err := p.DecodeWebhook(r, []byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+
+	req := decode("repo:push", bitbucketPushPayload)
+	if req.Ref != "refs/heads/main" || req.After != "709d658dc5b6d6afcd46049c2f332ee3f515a67d" || req.Deleted {
+		t.Errorf("got ref %q at %q, deleted %v", req.Ref, req.After, req.Deleted)
+	}
+	if req.Pusher.Name != "jdoe" || req.Sender.Login != "jdoe" {
+		t.Errorf("got pusher %+v, sender %+v", req.Pusher, req.Sender)
+	}
+	wantRepo := &GithubRepository{Name: "app", FullName: "team/app", Owner: GithubOwner{Login: "team"}}
+	if !reflect.DeepEqual(req.Repository, wantRepo) {
+		t.Errorf("got repository %+v, want %+v", req.Repository, wantRepo)
+	}
+	wantCommit := &GithubCommit{
+		ID:      "709d658dc5b6d6afcd46049c2f332ee3f515a67d",
+		Message: "Add a handler\n",
+		Author:  GithubCommitAuthor{Name: "Jane Doe"},
+	}
+	if !reflect.DeepEqual(req.HeadCommit, wantCommit) {
+		t.Errorf("got head commit %+v, want %+v", req.HeadCommit, wantCommit)
+	}
+	if files := changedFiles(req); files != nil {
+		t.Errorf("got changed files %v, want unknown", files)
+	}
+
+	// A push that only deletes a branch
+	deletion := `{
+  "actor": {"nickname": "jdoe"},
+  "repository": {"full_name": "team/app"},
+  "push": {"changes": [
+    {"old": {"type": "tag", "name": "v1"}, "new": null},
+    {"old": {"type": "branch", "name": "old"}, "new": null}
+  ]}
+}`
+	req = decode("repo:push", deletion)
+	if req.Ref != "refs/heads/old" || !req.Deleted {
+		t.Errorf("deletion decoded to ref %q, deleted %v", req.Ref, req.Deleted)
+	}
+
+	// Other events carry no ref to deploy
+	req = decode("repo:commit_status_updated", bitbucketPushPayload)
+	if req.Ref != "" || req.Repository == nil {
+		t.Errorf("commit status decoded to ref %q, repository %+v", req.Ref, req.Repository)
+	}
+}
+
+func TestBitbucketHookIDRoundTrip(t *testing.T) {
+	var mu sync.Mutex
+	hooks := []bitbucketHook{{UUID: "{other}", URL: "https://other.example.com/", Active: true, Events: []string{"repo:push"}}}
+	deleted := []string{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == "GET" && r.URL.Query().Get("page") == "":
+			// The first page links to the second
+			json.NewEncoder(w).Encode(map[string]any{"values": hooks[:1], "next": "http://" + r.Host + r.URL.Path + "?page=2"})
+		case r.Method == "GET":
+			json.NewEncoder(w).Encode(map[string]any{"values": hooks[1:]})
+		case r.Method == "POST":
+			hook := bitbucketHook{}
+			json.NewDecoder(r.Body).Decode(&hook)
+			hook.UUID = "{0f7a3b6e-5e0c-4f5e-9d0a-3f2b1c7d8e9f}"
+			hooks = append(hooks, hook)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(hook)
+		case r.Method == "DELETE":
+			deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/repositories/team/app/hooks/"))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer api.Close()
+
+	p := &bitbucketProvider{baseURL: api.URL}
+	id, err := p.RegisterHook("team/app", "https://sync.example.com/hooks/team/app", "", []string{"push"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != bitbucketHookID("{0f7a3b6e-5e0c-4f5e-9d0a-3f2b1c7d8e9f}") || id <= 0 {
+		t.Fatalf("got hook id %d", id)
+	}
+
+	// The hook is found again on the second page by its id
+	again, err := p.RegisterHook("team/app", "https://sync.example.com/hooks/team/app", "", []string{"push"}, "")
+	if err != nil || again != id {
+		t.Fatalf("registering again got %d, %v, want %d", again, err, id)
+	}
+	err = p.DeleteHook("team/app", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(deleted, []string{"{0f7a3b6e-5e0c-4f5e-9d0a-3f2b1c7d8e9f}"}) {
+		t.Fatalf("deleted %v, want only the registered hook", deleted)
+	}
+}
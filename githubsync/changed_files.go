@@ -0,0 +1,83 @@
+package githubsync
+
+import (
+	"path"
+	"strings"
+)
+
+// changedFiles returns the files added, modified or removed by the commits
+// of a push event, or nil if the payload doesn't list its commits.
+func changedFiles(req *WebhookRequest) []string {
+	if req.Commits == nil {
+		return nil
+	}
+	files := []string{}
+	seen := map[string]bool{}
+	for _, c := range req.Commits {
+		for _, list := range [][]string{c.Added, c.Modified, c.Removed} {
+			for _, f := range list {
+				if !seen[f] {
+					seen[f] = true
+					files = append(files, f)
+				}
+			}
+		}
+	}
+	return files
+}
+
+// relevant reports whether a push changing files needs deploying: whether
+// any of them matches r.Paths, if set, without matching r.PathsIgnore.
+// Pushes whose files are unknown, or that list none, e.g. because the
+// branch was moved back to an earlier commit, always need deploying.
+func (r Repo) relevant(files []string) bool {
+	if len(files) == 0 {
+		return true
+	}
+	for _, f := range files {
+		if (len(r.Paths) == 0 || matchAny(r.Paths, []string{f})) && !matchAny(r.PathsIgnore, []string{f}) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAny reports whether any of files matches any of globs.
+func matchAny(globs, files []string) bool {
+	for _, f := range files {
+		for _, g := range globs {
+			if matchGlob(g, f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchGlob is path.Match with support for "**" matching any number of
+// path segments, e.g. "cmd/**" or "**/*.go".
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		ok, err := path.Match(pattern[0], name[0])
+		if err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
@@ -0,0 +1,197 @@
+package githubsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// GithubWorkflowRun is the workflow run of a workflow_run event.
+type GithubWorkflowRun struct {
+	Name           string            `json:"name"`
+	HeadBranch     string            `json:"head_branch"`
+	HeadSHA        string            `json:"head_sha"`
+	Status         string            `json:"status"`
+	Conclusion     string            `json:"conclusion"`
+	HeadRepository *GithubRepository `json:"head_repository"`
+	HeadCommit     *GithubCommit     `json:"head_commit"`
+	Actor          GithubOwner       `json:"actor"`
+}
+
+// GithubCheckSuite is the check suite of a check_suite event or the check
+// suites API.
+type GithubCheckSuite struct {
+	HeadBranch           string `json:"head_branch"`
+	HeadSHA              string `json:"head_sha"`
+	Status               string `json:"status"`
+	Conclusion           string `json:"conclusion"`
+	LatestCheckRunsCount int    `json:"latest_check_runs_count"`
+	App                  struct {
+		Slug string `json:"slug"`
+	} `json:"app"`
+}
+
+// passed reports whether a completed check suite or workflow run with
+// conclusion didn't fail.
+func passed(conclusion string) bool {
+	return conclusion == "success" || conclusion == "neutral" || conclusion == "skipped"
+}
+
+// ciPassed reports whether the CI of the commit sha of repoID passed: the
+// latest run of each of workflows if set, or else every check suite that
+// has check runs. api is the base URL of the GitHub API.
+func ciPassed(api, ghToken, repoID, sha string, workflows []string) (bool, error) {
+	if len(workflows) > 0 {
+		res, err := githubGet(ghToken, fmt.Sprintf("%s/repos/%s/actions/runs?head_sha=%s&per_page=100", api, repoID, url.QueryEscape(sha)))
+		if err != nil {
+			return false, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			return false, githubError(res, repoID)
+		}
+		runs := struct {
+			WorkflowRuns []GithubWorkflowRun `json:"workflow_runs"`
+		}{}
+		err = json.NewDecoder(res.Body).Decode(&runs)
+		if err != nil {
+			return false, err
+		}
+		// Runs are listed newest first
+		for _, name := range workflows {
+			ok := false
+			for _, run := range runs.WorkflowRuns {
+				if run.Name == name {
+					ok = run.Status == "completed" && passed(run.Conclusion)
+					break
+				}
+			}
+			if !ok {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	res, err := githubGet(ghToken, fmt.Sprintf("%s/repos/%s/commits/%s/check-suites?per_page=100", api, repoID, url.PathEscape(sha)))
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return false, githubError(res, repoID)
+	}
+	suites := struct {
+		CheckSuites []GithubCheckSuite `json:"check_suites"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&suites)
+	if err != nil {
+		return false, err
+	}
+	checked := false
+	for _, suite := range suites.CheckSuites {
+		// Apps that don't check this repo leave empty suites queued forever
+		if suite.LatestCheckRunsCount == 0 {
+			continue
+		}
+		if suite.Status != "completed" || !passed(suite.Conclusion) {
+			return false, nil
+		}
+		checked = true
+	}
+	return checked, nil
+}
+
+// handleCI deploys the commit whose workflow run or check suite completed
+// to the entries with require_ci tracking its branch, once all of its CI
+// passed.
+func (s *Server) handleCI(w http.ResponseWriter, r *http.Request, req *WebhookRequest, repos map[string]Repo) {
+	if req.Action != "completed" {
+		fmt.Fprintln(w, "ignored", r.Header.Get("X-GitHub-Event"), req.Action)
+		return
+	}
+	var branch, sha, conclusion, pusher string
+	switch {
+	case req.WorkflowRun != nil:
+		run := req.WorkflowRun
+		// Runs of pull requests from forks carry the fork's branches
+		if run.HeadRepository == nil || run.HeadRepository.FullName != req.Repository.FullName {
+			fmt.Fprintln(w, "ignored workflow run of another repo")
+			return
+		}
+		branch, sha, conclusion, pusher = run.HeadBranch, run.HeadSHA, run.Conclusion, run.Actor.Login
+	case req.CheckSuite != nil:
+		// Actions suites are handled by their workflow_run events
+		if req.CheckSuite.App.Slug == "github-actions" {
+			fmt.Fprintln(w, "ignored check suite of GitHub Actions")
+			return
+		}
+		branch, sha, conclusion, pusher = req.CheckSuite.HeadBranch, req.CheckSuite.HeadSHA, req.CheckSuite.Conclusion, req.Sender.Login
+	default:
+		http.Error(w, "missing workflow_run or check_suite", http.StatusBadRequest)
+		return
+	}
+	if !isSHA(sha) {
+		http.Error(w, fmt.Sprintf("%q is not a full commit SHA", sha), http.StatusBadRequest)
+		return
+	}
+	if !passed(conclusion) {
+		slog.Info("CI failed, not deploying", "repo", req.Repository.FullName, "branch", branch, "sha", sha, "conclusion", conclusion)
+		fmt.Fprintln(w, "CI", conclusion+", not deploying")
+		return
+	}
+
+	token, err := s.tokenSource()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	jobs := []*Job{}
+	for key, repo := range repos {
+		if repo.ID != req.Repository.FullName || !repo.RequireCI || branch != s.deployedBranch(key, repo, req.Repository) {
+			continue
+		}
+		if !repo.enabled() {
+			slog.Info("Skipping CI run of disabled repo", "repo", key)
+			continue
+		}
+		ok, err := ciPassed(githubAPIURL(repo.Host), token, repo.ID, sha, repo.CIWorkflows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if !ok {
+			slog.Info("Waiting for the rest of CI", "repo", key, "sha", sha)
+			fmt.Fprintln(w, "waiting for the rest of CI of", sha, "for", key)
+			continue
+		}
+		if s.upToDate(r.Context(), key, repo, sha) {
+			slog.Info("Already up to date, skipping deploy", "repo", key, "sha", sha)
+			continue
+		}
+		job := &Job{
+			Key:  key,
+			Repo: repo,
+			Path: s.repoPath(key, repo),
+			Status: &DeployStatus{
+				Repo:       key,
+				DeliveryID: deliveryID(r),
+				HookID:     hookID(r),
+				SHA:        sha,
+				Pusher:     pusher,
+			},
+		}
+		if run := req.WorkflowRun; run != nil && run.HeadCommit != nil {
+			job.Status.Message = run.HeadCommit.Message
+			job.Status.Author = run.HeadCommit.Author.Name
+		}
+		jobs = append(jobs, job)
+	}
+	if len(jobs) == 0 {
+		fmt.Fprintln(w, "nothing to deploy")
+		return
+	}
+	s.enqueue(w, jobs)
+}
@@ -0,0 +1,92 @@
+package githubsync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+)
+
+// SyncCheckouts clones or pulls every enabled repo once, without
+// registering hooks or deploying. It returns an error if any repo failed
+// to sync.
+func (s *Server) SyncCheckouts(ctx context.Context) error {
+	failed := 0
+	results := s.syncCheckouts(ctx, s.config())
+	for _, key := range sortedKeys(results) {
+		if err := results[key]; err != nil {
+			slog.Error("Syncing failed", "repo", key, "err", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d repos failed to sync", failed)
+	}
+	return nil
+}
+
+// DeployOnce deploys the repo with the given key right away instead of
+// queuing the deploy, for one-off deploys outside of a running Server.
+// It fails if a running github-sync instance holds the repo's checkout.
+func (s *Server) DeployOnce(ctx context.Context, key string) error {
+	job, err := s.manualJob(ctx, key)
+	if err != nil {
+		return err
+	}
+	s.jobs.Add(job)
+	return s.runOnce(ctx, job)
+}
+
+// RollbackOnce rolls the release or atomic mode repo with the given key
+// back to the release to, or to the previous release if to is empty, right
+// away instead of queuing the rollback like Rollback does, for one-off
+// rollbacks outside of a running Server. It fails if a running
+// github-sync instance holds the repo's checkout.
+func (s *Server) RollbackOnce(ctx context.Context, key, to string) error {
+	job, err := s.rollbackJob(key, to)
+	if err != nil {
+		return err
+	}
+	job.ctx = ctx
+	return s.runOnce(ctx, job)
+}
+
+// runOnce runs job without going through the dispatcher, which stays held
+// outside of a running Server, and waits for it to finish.
+func (s *Server) runOnce(ctx context.Context, job *Job) error {
+	err := s.lock(job.Key, job.Path)
+	if err != nil {
+		return err
+	}
+	job.done = make(chan error, 1)
+	go s.runJob(job)
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PrintStatus writes a table of every repo's branch, deployed commit,
+// last deploy and service state to w.
+func (s *Server) PrintStatus(ctx context.Context, w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REPO\tBRANCH\tHEAD\tLAST DEPLOY\tSERVICE")
+	repos := s.config()
+	for _, key := range sortedKeys(repos) {
+		repo := repos[key]
+		row := s.dashboardRow(ctx, key, repo)
+		last := "never"
+		if recs := s.history.Get(key); len(recs) > 0 {
+			last = fmt.Sprintf("%s %s", recs[0].Time.Format(time.RFC3339), recs[0].Result)
+		}
+		if !repo.enabled() {
+			last = "disabled"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.12s\t%s\t%s\n", key, row.Branch, row.HEAD, last, row.Service)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,103 @@
+package githubsync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CommandApprovals tracks the checksums of shell commands an operator has
+// approved. While disabled every command is allowed.
+type CommandApprovals struct {
+	mu      sync.Mutex
+	enabled bool
+	sums    map[string]bool
+}
+
+// Enable turns on approval checking with the given approved checksums.
+func (c *CommandApprovals) Enable(sums []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enabled = true
+	c.sums = map[string]bool{}
+	for _, sum := range sums {
+		c.sums[sum] = true
+	}
+}
+
+func (c *CommandApprovals) Approve(cmd string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sums == nil {
+		c.sums = map[string]bool{}
+	}
+	c.sums[commandSum(cmd)] = true
+}
+
+// Check returns an error if approvals are enabled and cmd isn't approved.
+// Empty commands, which never run, are always allowed.
+func (c *CommandApprovals) Check(cmd string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cmd == "" || !c.enabled || c.sums[commandSum(cmd)] {
+		return nil
+	}
+	return fmt.Errorf("command %s is not approved, restart with --approve-commands to approve it:\n%s", commandSum(cmd), cmd)
+}
+
+// List returns the approved checksums.
+func (c *CommandApprovals) List() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sums := []string{}
+	for sum := range c.sums {
+		sums = append(sums, sum)
+	}
+	sort.Strings(sums)
+	return sums
+}
+
+// repoCommand is a shell command from the config of a repo.
+type repoCommand struct {
+	field, cmd string
+}
+
+// deployCommands returns the shell commands deploys of r run. The
+// environment of a generated unit counts as one, since it can change what
+// its start command runs.
+func (r Repo) deployCommands() []repoCommand {
+	cmds := []repoCommand{{"install", r.Install}}
+	if r.HealthCheck != nil {
+		cmds = append(cmds, repoCommand{"health_check.command", r.HealthCheck.Command})
+	}
+	if r.Service != nil {
+		cmds = append(cmds, repoCommand{"service.start", r.Service.Start})
+		env := []string{}
+		for k, v := range r.Service.Env {
+			env = append(env, k+"="+v)
+		}
+		sort.Strings(env)
+		cmds = append(cmds, repoCommand{"service.env", strings.Join(env, "\n")})
+	}
+	return cmds
+}
+
+// checkCommands returns an error if a shell command deploys of repo run
+// isn't approved.
+func (s *Server) checkCommands(repo Repo) error {
+	for _, c := range repo.deployCommands() {
+		err := s.approvals.Check(c.cmd)
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.field, err)
+		}
+	}
+	return nil
+}
+
+func commandSum(cmd string) string {
+	sum := sha256.Sum256([]byte(cmd))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,91 @@
+package githubsync
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCommandApprovals(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), nil)
+	s.approvals.Enable(nil)
+	s.approvals.Approve("make install")
+
+	tests := []struct {
+		name    string
+		install string
+		want    string
+	}{
+		{"no install command", "", "would download"},
+		{"approved command", "make install", "would download"},
+		{"unapproved command", "make evil", "would fail: install: command " + commandSum("make evil") + " is not approved"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := Repo{ID: "owner/app", Mode: "release", Install: tt.install}
+			err := s.approvals.Check(repo.Install)
+			if (err != nil) != (tt.install == "make evil") {
+				t.Errorf("Check(%q) = %v", repo.Install, err)
+			}
+			out := &bytes.Buffer{}
+			s.planDeploy(context.Background(), "owner/app", repo, "", nil, out)
+			if !strings.Contains(out.String(), tt.want) {
+				t.Errorf("plan = %q, want %q in it", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthCheckCommandApproval(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), nil)
+	s.approvals.Enable(nil)
+	repo := Repo{ID: "owner/app", HealthCheck: &HealthCheck{Command: "curl -f localhost"}}
+	err := s.approvals.Check(repo.Install)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.restart(context.Background(), t.TempDir(), repo, "", nil, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "health_check.command: command "+commandSum("curl -f localhost")+" is not approved") {
+		t.Fatalf("restart() = %v, want the unapproved health check to fail it", err)
+	}
+
+	s.approvals.Approve(repo.HealthCheck.Command)
+	if err := s.checkCommands(repo); err != nil {
+		t.Errorf("checkCommands() = %v after approving", err)
+	}
+}
+
+func TestServiceCommandApproval(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestServer(t, dir, nil)
+	s.cfg.UnitDir = dir + "/units"
+	s.approvals.Enable(nil)
+	repo := Repo{ID: "owner/app", Service: &SystemdService{Name: "app", Start: "./app", Env: map[string]string{"B": "2", "A": "1"}}}
+	err := s.checkCommands(repo)
+	if err == nil || !strings.Contains(err.Error(), "service.start: ") {
+		t.Fatalf("checkCommands() = %v, want the start command unapproved", err)
+	}
+	err = s.syncUnit(context.Background(), dir, repo)
+	if err == nil {
+		t.Fatal("syncUnit() generated a unit with an unapproved start command")
+	}
+
+	s.approvals.Approve("./app")
+	err = s.checkCommands(repo)
+	if err == nil || !strings.Contains(err.Error(), "service.env: command "+commandSum("A=1\nB=2")) {
+		t.Fatalf("checkCommands() = %v, want the unit environment unapproved", err)
+	}
+	s.approvals.Approve("A=1\nB=2")
+	if err := s.checkCommands(repo); err != nil {
+		t.Errorf("checkCommands() = %v after approving", err)
+	}
+}
+
+func TestCommandApprovalsDisabled(t *testing.T) {
+	c := &CommandApprovals{}
+	if err := c.Check("make evil"); err != nil {
+		t.Errorf("Check() = %v with approvals disabled", err)
+	}
+}
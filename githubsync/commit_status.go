@@ -0,0 +1,70 @@
+package githubsync
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// commitStatusContext is the context deploy statuses are set with, which
+// GitHub shows them under.
+const commitStatusContext = "deploy/github-sync"
+
+// CommitStatus is a commit status as the GitHub API represents it.
+type CommitStatus struct {
+	State       string `json:"state"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description"`
+	Context     string `json:"context"`
+}
+
+// setCommitStatus reports event of j's deploy as the deploy/github-sync
+// status of the deployed commit, if Config.CommitStatuses is set. Only
+// deploys of GitHub repos with a known commit SHA are reported; rollbacks to
+// releases aren't. The status is set in the background so that GitHub
+// can't hold up deploys.
+func (s *Server) setCommitStatus(j *Job, event string) {
+	if !s.cfg.CommitStatuses || j.Repo.provider() != providerGitHub || !isSHA(j.Status.SHA) || j.Rollback {
+		return
+	}
+	status := &CommitStatus{Context: commitStatusContext}
+	switch event {
+	case EventStarted:
+		status.State, status.Description = "pending", "Deploying"
+	case EventSucceeded:
+		status.State, status.Description = "success", fmt.Sprintf("Deployed in %.1fs", j.Status.Duration.Seconds())
+	case EventFailed, EventRolledBack:
+		status.State, status.Description = "failure", "Deploy failed"
+		if j.Status.Fallback != "" {
+			status.Description = "Deploy failed, deployed " + j.Status.Fallback + " instead"
+		}
+	default:
+		return
+	}
+	if s.cfg.ExternalURL != "" {
+		status.TargetURL = s.cfg.ExternalURL + "/jobs/" + j.ID
+	}
+	repo, sha := j.Repo, j.Status.SHA
+	go func() {
+		token, err := s.tokenSource()
+		if err == nil {
+			err = postCommitStatus(githubAPIURL(repo.Host), token, repo.ID, sha, status)
+		}
+		if err != nil {
+			slog.Error("Setting commit status failed", "repo", repo.ID, "sha", sha, "err", err)
+		}
+	}()
+}
+
+// postCommitStatus sets status on the commit sha of repoID. api is the
+// base URL of the GitHub API.
+func postCommitStatus(api, ghToken, repoID, sha string, status *CommitStatus) error {
+	res, err := githubPost(ghToken, fmt.Sprintf("%s/repos/%s/statuses/%s", api, repoID, sha), status)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return githubError(res, repoID)
+	}
+	return nil
+}
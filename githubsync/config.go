@@ -0,0 +1,290 @@
+package githubsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfig reads the repos from Config.ConfigDir, or Config.ConfigFile
+// if unset, adds the discovered ones and applies Config.RepoFilter.
+func (s *Server) loadConfig() (map[string]Repo, error) {
+	var repos map[string]Repo
+	var err error
+	if s.cfg.ConfigDir != "" {
+		repos, err = readConfigDir(s.cfg.ConfigDir)
+	} else {
+		repos, err = readConfig(s.cfg.ConfigFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = s.addDiscovered(repos)
+	if err != nil {
+		return nil, err
+	}
+
+	// GitHub repos without a host are on Config.GitHubURL
+	for key, repo := range repos {
+		if repo.provider() == providerGitHub && repo.Host == "" && s.cfg.GitHubURL != "" {
+			repo.Host = s.cfg.GitHubURL
+			repos[key] = repo
+		}
+	}
+	err = s.checkPaths(repos)
+	if err != nil {
+		return nil, err
+	}
+	return filterRepos(repos, s.cfg.RepoFilter)
+}
+
+// checkPaths returns an error if two of repos are checked out to the same
+// directory or one within the other, e.g. repos of the same name from two
+// owners.
+func (s *Server) checkPaths(repos map[string]Repo) error {
+	keys := sortedKeys(repos)
+	paths := map[string]string{}
+	for _, key := range keys {
+		paths[key] = s.repoPath(key, repos[key])
+	}
+	for i, a := range keys {
+		for _, b := range keys[i+1:] {
+			if paths[a] == paths[b] {
+				return fmt.Errorf("%s and %s are both checked out to %s, set path on one of them", a, b, paths[a])
+			}
+			inner, outer := a, b
+			if within(paths[outer], paths[inner]) {
+				inner, outer = outer, inner
+			}
+			if within(paths[inner], paths[outer]) {
+				return fmt.Errorf("%s is checked out to %s, within the checkout of %s, set path on one of them", inner, paths[inner], outer)
+			}
+		}
+	}
+	return nil
+}
+
+// within reports whether path is dir or a directory within it.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && filepath.IsLocal(rel)
+}
+
+// filterRepos returns the repos whose key or ID matches one of the globs
+// in filter, or all of them if filter is empty. A glob matching no repo
+// is an error, as it is most likely a typo.
+func filterRepos(repos map[string]Repo, filter []string) (map[string]Repo, error) {
+	if len(filter) == 0 {
+		return repos, nil
+	}
+	matched := map[string]Repo{}
+	for _, pattern := range filter {
+		found := false
+		for key, repo := range repos {
+			keyMatch, err := path.Match(pattern, key)
+			if err != nil {
+				return nil, fmt.Errorf("--repos: %s: %s", pattern, err)
+			}
+			idMatch, _ := path.Match(pattern, repo.ID)
+			if keyMatch || idMatch {
+				matched[key] = repo
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("--repos: %s matches no configured repo", pattern)
+		}
+	}
+	return matched, nil
+}
+
+// readConfigDir merges every JSON, YAML and TOML file in dir into one
+// config. Each file has the same format as repos.json, so a team can drop
+// in a file for their repos. A repo key defined in more than one file is
+// an error.
+func readConfigDir(dir string) (map[string]Repo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && isConfigFile(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	repos := map[string]Repo{}
+	definedIn := map[string]string{}
+	for _, name := range names {
+		file, err := readConfig(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		for key, repo := range file {
+			if other, ok := definedIn[key]; ok {
+				return nil, fmt.Errorf("%s is defined in both %s and %s", key, other, name)
+			}
+			definedIn[key] = name
+			repos[key] = repo
+		}
+	}
+	return repos, nil
+}
+
+// isConfigFile reports whether path is a JSON, YAML or TOML config,
+// judging by its extension.
+func isConfigFile(path string) bool {
+	switch filepath.Ext(path) {
+	case ".json", ".yaml", ".yml", ".toml":
+		return true
+	}
+	return false
+}
+
+// DefaultConfigFile returns the repos config in root: the first of
+// repos.json, repos.yaml, repos.yml and repos.toml that exists, or else
+// repos.json.
+func DefaultConfigFile(root string) string {
+	for _, name := range []string{"repos.json", "repos.yaml", "repos.yml", "repos.toml"} {
+		path := filepath.Join(root, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return filepath.Join(root, "repos.json")
+}
+
+func readConfig(path string) (map[string]Repo, error) {
+	raw, err := readRawConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys are either the repo id or id@branch to deploy several branches
+	// of the same repo. The id defaults to the key without the branch.
+	repos := map[string]Repo{}
+	for key, b := range raw {
+		entries, err := expandApps(key, b)
+		if err != nil {
+			return nil, err
+		}
+		for appKey, repo := range entries {
+			if repo.ID == "" {
+				repo.ID, _, _ = strings.Cut(key, "@")
+			}
+			err = checkProvider(repo)
+			if err != nil {
+				return nil, err
+			}
+			repos[appKey] = repo
+		}
+	}
+	return repos, nil
+}
+
+// readRawConfig returns the entries of the config at path by key. YAML
+// and TOML configs, told apart by their extension, are converted to JSON
+// so that all formats decode the same.
+func readRawConfig(path string) (map[string]json.RawMessage, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]json.RawMessage{}
+	var doc map[string]any
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &doc)
+	case ".toml":
+		err = toml.Unmarshal(b, &doc)
+	default:
+		return raw, json.NewDecoder(bytes.NewReader(b)).Decode(&raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for key, v := range doc {
+		raw[key], err = json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+	}
+	return raw, nil
+}
+
+// AddToConfig adds the entry key to the repos config at path, creating
+// the file if needed. The other entries are kept as they are.
+func AddToConfig(path, key string, entry map[string]any) error {
+	return editConfig(path, func(repos map[string]json.RawMessage) error {
+		if _, ok := repos[key]; ok {
+			return fmt.Errorf("%s is already configured", key)
+		}
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		repos[key] = b
+		return nil
+	})
+}
+
+// RemoveFromConfig removes the entry key from the repos config at path.
+func RemoveFromConfig(path, key string) error {
+	return editConfig(path, func(repos map[string]json.RawMessage) error {
+		if _, ok := repos[key]; !ok {
+			return fmt.Errorf("%s is not configured", key)
+		}
+		delete(repos, key)
+		return nil
+	})
+}
+
+// editConfig applies edit to the entries of the repos config at path and
+// replaces the file with the result, which must still be a valid config.
+func editConfig(path string, edit func(map[string]json.RawMessage) error) error {
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml", ".toml":
+		return fmt.Errorf("%s: only JSON configs can be edited, edit it by hand", path)
+	}
+	repos := map[string]json.RawMessage{}
+	b, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(b, &repos)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err = edit(repos)
+	if err != nil {
+		return err
+	}
+	b, err = json.MarshalIndent(repos, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so the config is never half written
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, append(b, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := readConfig(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,83 @@
+package githubsync
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// configRepo returns the GitHub repo Config.ConfigRepo names, which the
+// config is read from.
+func (s *Server) configRepo() Repo {
+	return Repo{
+		ID:     s.cfg.ConfigRepo,
+		Host:   s.cfg.GitHubURL,
+		Branch: s.cfg.ConfigRepoBranch,
+	}
+}
+
+// pullConfigRepo clones or pulls the config repo and points the Server at
+// the config file or directory within it.
+func (s *Server) pullConfigRepo(ctx context.Context) error {
+	err := s.syncRepo(ctx, s.cfg.ConfigRepoDir, s.configRepo())
+	if err != nil {
+		return fmt.Errorf("syncing config repo %s: %s", s.cfg.ConfigRepo, err)
+	}
+	path := filepath.Join(s.cfg.ConfigRepoDir, s.cfg.ConfigRepoPath)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("config repo %s: %s", s.cfg.ConfigRepo, err)
+	}
+	if fi.IsDir() {
+		s.cfg.ConfigDir = path
+	} else {
+		s.cfg.ConfigDir = ""
+		s.cfg.ConfigFile = path
+	}
+	return nil
+}
+
+// registerConfigHook registers the hook of the config repo, retrying in
+// the background if that fails.
+func (s *Server) registerConfigHook() {
+	repo := s.configRepo()
+	events := []string{"push"}
+	_, err := s.provider(providerGitHub, repo.Host).RegisterHook(repo.ID, repoHookURL(s.cfg.ExternalURL, repo.ID), "", events, s.webhookSecret(repo.ID))
+	if err != nil {
+		slog.Error("Registering hook of config repo failed, retrying in the background", "repo", repo.ID, "err", err)
+		go s.retryHook(repo, events)
+	}
+}
+
+// isConfigRepo reports whether the delivery for repoID from provider is
+// for the config repo.
+func (s *Server) isConfigRepo(provider, repoID string) bool {
+	return s.cfg.ConfigRepo != "" && provider == providerGitHub && repoID == s.cfg.ConfigRepo
+}
+
+// handleConfigPush applies the config pushed to the config repo in the
+// background and reports it with a 202.
+func (s *Server) handleConfigPush(w http.ResponseWriter, r *http.Request, req *WebhookRequest) {
+	branch, err := s.trackedBranch(r.Context(), s.cfg.ConfigRepoDir, s.configRepo())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.Ref != "refs/heads/"+branch {
+		slog.Info("Ignoring push to untracked ref", "repo", s.cfg.ConfigRepo, "ref", req.Ref)
+		fmt.Fprintln(w, "no entry tracks", req.Ref)
+		return
+	}
+	slog.Info("Config repo was pushed, reloading config", "repo", s.cfg.ConfigRepo, "sha", req.After)
+	go func() {
+		err := s.ReloadAndSync(context.Background())
+		if err != nil {
+			slog.Error("Reloading config failed", "err", err)
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "reloading config")
+}
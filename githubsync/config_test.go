@@ -0,0 +1,131 @@
+package githubsync
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const jsonConfig = `{
+  "o/app": {
+    "branch": "main",
+    "enabled": false,
+    "install": "set -e\nmake build\nmake install\n",
+    "install_paths": ["go.mod", "cmd/*"],
+    "service": {"name": "app", "start": "/usr/bin/app -port 8080", "env": {"PORT": "8080", "MODE": "a # b"}},
+    "watchdog": {"interval": "1m"}
+  },
+  "o/lib@dev": {"install": "echo 'dev'"}
+}`
+
+const yamlConfig = `# Deployed on every push to main
+o/app:
+  branch: main
+  enabled: false # for now
+  install: |
+    set -e
+    make build
+    make install
+  install_paths:
+  - go.mod
+  - "cmd/*"
+  service:
+    name: app
+    start: >-
+      /usr/bin/app
+      -port 8080
+    env: {PORT: "8080", MODE: "a # b"}
+  watchdog:
+    interval: 1m
+
+"o/lib@dev":
+  install: echo 'dev'
+`
+
+const tomlConfig = `# Deployed on every push to main
+["o/app"]
+branch = "main"
+enabled = false # for now
+install = """
+set -e
+make build
+make install
+"""
+install_paths = [
+  "go.mod",
+  'cmd/*', # globs work
+]
+service = { name = "app", start = "/usr/bin/app -port 8080" }
+service.env = { PORT = "8080", MODE = "a # b" }
+
+["o/app".watchdog]
+interval = "1m"
+
+["o/lib@dev"]
+install = "echo 'dev'"
+`
+
+func TestConfigFormats(t *testing.T) {
+	dir := t.TempDir()
+	configs := map[string]string{"repos.json": jsonConfig, "repos.yaml": yamlConfig, "repos.toml": tomlConfig}
+	parsed := map[string]map[string]Repo{}
+	for name, config := range configs {
+		err := os.WriteFile(dir+"/"+name, []byte(config), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed[name], err = readConfig(dir + "/" + name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+	}
+	for _, name := range []string{"repos.yaml", "repos.toml"} {
+		if !reflect.DeepEqual(parsed[name], parsed["repos.json"]) {
+			t.Errorf("%s decodes to\n%+v\nwant\n%+v", name, parsed[name], parsed["repos.json"])
+		}
+	}
+
+	// Config dirs mix formats, but keys must stay unique across files
+	confDir := t.TempDir()
+	write := func(name, config string) {
+		err := os.WriteFile(confDir+"/"+name, []byte(config), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.json", `{"o/a": {}}`)
+	write("b.yaml", "o/b:\n  branch: main\n")
+	write("c.toml", "[\"o/c\"]\n")
+	repos, err := readConfigDir(confDir)
+	if err != nil || len(repos) != 3 || repos["o/b"].Branch != "main" {
+		t.Fatalf("got %v, %v, want o/a, o/b and o/c", repos, err)
+	}
+	write("d.yml", "o/a: {}\n")
+	if _, err := readConfigDir(confDir); err == nil || !strings.Contains(err.Error(), "o/a is defined in both a.json and d.yml") {
+		t.Fatalf("got %v for a key defined twice", err)
+	}
+}
+
+func TestReadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name, config, err string
+	}{
+		{"repos.yaml", "- a\n", "cannot unmarshal !!seq"},
+		{"repos.yaml", "a: 1\na: 2\n", `mapping key "a" already defined`},
+		{"repos.yaml", "a:\n\tb: 1\n", "line 2"},
+		{"repos.toml", "a = 1\na = 2\n", "line 2"},
+		{"repos.toml", "o/app = 1\n", "line 1"},
+	}
+	for _, tt := range tests {
+		path := t.TempDir() + "/" + tt.name
+		err := os.WriteFile(path, []byte(tt.config), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = readRawConfig(path)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s %q: got %v, want %q", tt.name, tt.config, err, tt.err)
+		}
+	}
+}
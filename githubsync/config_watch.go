@@ -0,0 +1,61 @@
+package githubsync
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configWatchDelay is how long the config dir has to be quiet before a
+// change is applied, so that editors saving a file in several steps
+// cause one reload.
+const configWatchDelay = 500 * time.Millisecond
+
+// WatchConfigDir reloads the config like on SIGHUP whenever a config file
+// in Config.ConfigDir is added, changed or removed, until ctx is done.
+// Config repos are reloaded through their webhook instead, so it does
+// nothing for them.
+func (s *Server) WatchConfigDir(ctx context.Context) error {
+	if s.cfg.ConfigDir == "" || s.cfg.ConfigRepo != "" {
+		return nil
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	err = w.Add(s.cfg.ConfigDir)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(0)
+	<-timer.C
+	for {
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case e, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if isConfigFile(e.Name) && !e.Has(fsnotify.Chmod) {
+				timer.Reset(configWatchDelay)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Error("Watching config dir failed", "dir", s.cfg.ConfigDir, "err", err)
+		case <-timer.C:
+			slog.Info("Config dir changed, reloading config", "dir", s.cfg.ConfigDir)
+			err := s.ReloadAndSync(ctx)
+			if err != nil {
+				slog.Error("Reloading config failed", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package githubsync
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	up := newUpstream(t, dir, "up")
+	configDir := filepath.Join(dir, "repos.d")
+	err := os.Mkdir(configDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forge := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Write([]byte("[]"))
+		case http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id": 1}`))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer forge.Close()
+	transport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = forge.Client().Transport
+	defer func() { http.DefaultClient.Transport = transport }()
+	s := newTestServer(t, dir, map[string]Repo{})
+	s.cfg.ConfigDir = configDir
+	s.cfg.StateFile = filepath.Join(dir, "state.json")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watching := make(chan error, 1)
+	go func() { watching <- s.WatchConfigDir(ctx) }()
+	time.Sleep(100 * time.Millisecond)
+
+	// Adding a file clones its repos
+	file := filepath.Join(configDir, "app.json")
+	err = os.WriteFile(file, []byte(`{"o/app": {"provider": "gitea", "host": "`+forge.URL+`", "branch": "main", "fetch_url": "`+up+`"}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, "app", ".git"))
+		return err == nil
+	})
+
+	// Removing it drops them
+	err = os.Remove(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { _, ok := s.config()["o/app"]; return !ok })
+
+	cancel()
+	if err := <-watching; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor fails the test if cond doesn't become true within a few seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("timed out")
+}
@@ -0,0 +1,175 @@
+package githubsync
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dashboardRow is what the dashboard shows of one repo.
+type dashboardRow struct {
+	Key        string
+	Branch     string
+	HEAD       string
+	LastDeploy *DeployStatus
+	Service    string
+	Rollback   bool
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"short": func(sha string) string {
+		if len(sha) > 12 {
+			return sha[:12]
+		}
+		return sha
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>github-sync</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: .4em .8em; border-bottom: 1px solid #ddd; text-align: left; }
+code { font-size: .9em; }
+.failed { color: #b00; }
+.ok { color: #080; }
+form { display: inline; }
+</style>
+</head>
+<body>
+<h1>github-sync</h1>
+<table>
+<tr><th>Repo</th><th>Branch</th><th>HEAD</th><th>Last deploy</th><th>Service</th><th></th></tr>
+{{range .}}
+<tr>
+<td>{{.Key}}</td>
+<td>{{.Branch}}</td>
+<td><code>{{short .HEAD}}</code></td>
+{{with .LastDeploy}}
+<td class="{{if .Error}}failed{{else}}ok{{end}}" title="{{.Error}}">
+{{.Time.Format "2006-01-02 15:04:05"}} {{if .Error}}failed{{else if .Duration}}ok{{else}}running{{end}}
+</td>
+{{else}}
+<td>never</td>
+{{end}}
+<td>{{.Service}}</td>
+<td>
+<form method="post" action="/dashboard/deploy/{{.Key}}"><button>Deploy</button></form>
+{{if .Rollback}}<form method="post" action="/dashboard/rollback/{{.Key}}"><button>Roll back</button></form>{{end}}
+</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+// dashboardHandler serves an HTML overview of the repos at /dashboard with
+// buttons that POST to /dashboard/deploy/<key> and
+// /dashboard/rollback/<key>.
+func (s *Server) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		s.dashboardAction(w, r)
+		return
+	}
+	if r.URL.Path != "/dashboard" {
+		http.NotFound(w, r)
+		return
+	}
+
+	repos := s.config()
+	rows := []*dashboardRow{}
+	for _, key := range sortedKeys(repos) {
+		rows = append(rows, s.dashboardRow(r.Context(), key, repos[key]))
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := dashboardTemplate.Execute(w, rows)
+	if err != nil {
+		slog.Error("Rendering dashboard failed", "err", err)
+	}
+}
+
+// dashboardRow collects what the dashboard shows of the repo with the
+// given key. Whatever can't be determined is left as "-".
+func (s *Server) dashboardRow(ctx context.Context, key string, repo Repo) *dashboardRow {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	path := s.repoPath(key, repo)
+	row := &dashboardRow{
+		Key:        key,
+		Branch:     "-",
+		HEAD:       "-",
+		LastDeploy: s.statuses.Last(key),
+		Service:    "-",
+		Rollback:   repo.Mode == "atomic" || repo.Mode == "release",
+	}
+	if repo.Mode == "release" {
+		if release, err := liveRelease(path); err == nil {
+			row.HEAD = release
+		}
+	} else {
+		if branch, err := s.trackedBranch(ctx, repo.checkout(path), repo); err == nil {
+			row.Branch = branch
+		}
+		if sha, err := s.gitOutput(ctx, path, "rev-parse", "HEAD"); err == nil {
+			row.HEAD = sha
+		}
+	}
+	if name := repo.serviceName(); name != "" {
+		// is-active prints the state even when it exits non-zero
+		out, _ := exec.CommandContext(ctx, "systemctl", "is-active", name).Output()
+		if state := strings.TrimSpace(string(out)); state != "" {
+			row.Service = name + ": " + state
+		}
+	}
+	return row
+}
+
+// dashboardAction queues the deploy or rollback a dashboard button asked
+// for and sends the browser back to the dashboard.
+func (s *Server) dashboardAction(w http.ResponseWriter, r *http.Request) {
+	// Forms from other sites would carry the browser's credentials too
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" {
+		http.Error(w, "cross-site request", http.StatusForbidden)
+		return
+	}
+	action, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/dashboard/"), "/")
+	if _, ok := s.config()[key]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch action {
+	case "deploy":
+		job, err := s.manualJob(context.Background(), key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		_, err = s.queueJobs([]*Job{job})
+		if err != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(queueRetryAfter))
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	case "rollback":
+		job, err := s.rollbackJob(key, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		// Roll back after the deploys already queued
+		s.dispatcher.EnqueueNow(job)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
@@ -0,0 +1,52 @@
+package githubsync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDashboardDeployQueueFull(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), map[string]Repo{
+		"o/app": {ID: "o/app", Branch: "main"},
+		"o/lib": {ID: "o/lib", Branch: "main"},
+	})
+	s.dispatcher.Hold()
+	s.dispatcher.MaxDepth = 1
+	for _, tt := range []struct {
+		key  string
+		want int
+	}{{"o/app", http.StatusSeeOther}, {"o/lib", http.StatusServiceUnavailable}} {
+		req := httptest.NewRequest("POST", "/dashboard/deploy/"+tt.key, nil)
+		req.Header.Set("Sec-Fetch-Site", "same-origin")
+		w := httptest.NewRecorder()
+		s.dashboardAction(w, req)
+		if w.Code != tt.want {
+			t.Fatalf("deploying %s: got %d %s, want %d", tt.key, w.Code, w.Body, tt.want)
+		}
+	}
+	if n := s.dispatcher.Stats().Depth; n != 1 {
+		t.Fatalf("%d deploys queued, want 1", n)
+	}
+}
+
+func TestDashboardRollbackIsQueued(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), map[string]Repo{"o/app": {ID: "o/app", Mode: "atomic"}})
+	s.dispatcher.Hold()
+	queued := &Job{Key: "o/app", Status: &DeployStatus{}}
+	s.dispatcher.EnqueueNow(queued)
+
+	req := httptest.NewRequest("POST", "/dashboard/rollback/o/app", nil)
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	w := httptest.NewRecorder()
+	s.dashboardAction(w, req)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	s.dispatcher.mu.Lock()
+	q := s.dispatcher.queues["o/app"]
+	s.dispatcher.mu.Unlock()
+	if len(q) != 2 || q[0] != queued || !q[1].Rollback {
+		t.Fatalf("queue is %+v, want the rollback behind the queued deploy", q)
+	}
+}
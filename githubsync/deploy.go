@@ -0,0 +1,325 @@
+package githubsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DeployError is an error in one step of a deploy.
+type DeployError struct {
+	Step string
+	Err  error
+}
+
+func (e *DeployError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Step, e.Err)
+}
+
+func (e *DeployError) Unwrap() error {
+	return e.Err
+}
+
+// deploy pulls the commit sha, or the tip of the branch if sha is empty,
+// into the repo at path and restarts its service. changed lists the files
+// changed by the push, or is nil if unknown. The output of the
+// commands run is written to out.
+func (s *Server) deploy(ctx context.Context, path string, repo Repo, sha string, changed []string, out io.Writer) error {
+	// Refuse to run commands that haven't been approved
+	err := s.checkCommands(repo)
+	if err != nil {
+		return &DeployError{"approve", err}
+	}
+
+	// Pull
+	prev, err := s.gitOutput(ctx, path, "rev-parse", "HEAD")
+	if err != nil {
+		return &DeployError{"pull", err}
+	}
+	err = s.pull(ctx, path, repo, sha)
+	if err != nil {
+		return &DeployError{"pull", err}
+	}
+
+	// Tell the app which commit it runs
+	sha, err = s.writeDeployedSHA(ctx, path, repo.VersionEnv)
+	if err != nil {
+		return &DeployError{"version", err}
+	}
+
+	// Only update the working tree if nothing relevant to the service changed
+	if len(repo.RestartPaths) > 0 && changed != nil && !matchAny(repo.RestartPaths, changed) {
+		fmt.Fprintln(out, "No changed files match restart_paths, skipping install and restart")
+		err = fixPermissions(ctx, path, repo)
+		if err != nil {
+			return &DeployError{"permissions", err}
+		}
+		return nil
+	}
+
+	err = s.restart(ctx, path, repo, sha, changed, out)
+	if isHealthError(err) && repo.FallbackRef == "" && prev != sha {
+		return s.rollbackRevision(ctx, path, repo, prev, err, out)
+	}
+	return err
+}
+
+// isHealthError reports whether err is a failed health check.
+func isHealthError(err error) bool {
+	var deployErr *DeployError
+	return errors.As(err, &deployErr) && deployErr.Step == "health"
+}
+
+// rollbackRevision resets the checkout at path back to the commit prev
+// after the deploy of the commit after it failed its health check with
+// healthErr, and restarts the service on it.
+func (s *Server) rollbackRevision(ctx context.Context, path string, repo Repo, prev string, healthErr error, out io.Writer) error {
+	fmt.Fprintln(out, "Health check failed, rolling back to", prev)
+	err := s.git(ctx, path, "reset", "--hard", prev, "--")
+	if err == nil {
+		err = s.updateCheckout(ctx, path, repo)
+	}
+	if err == nil {
+		_, err = s.writeDeployedSHA(ctx, path, repo.VersionEnv)
+	}
+	if err == nil {
+		err = s.restart(ctx, path, repo, prev, nil, out)
+	}
+	if err != nil {
+		return fmt.Errorf("%w; rollback to %s failed: %s", healthErr, prev, err)
+	}
+	return fmt.Errorf("%w; %w", healthErr, &rolledBackError{prev})
+}
+
+// upToDate reports whether sha is already live for key: its last deploy
+// succeeded on sha and the checkout is still clean at sha.
+func (s *Server) upToDate(ctx context.Context, key string, repo Repo, sha string) bool {
+	if repo.AlwaysDeploy || sha == "" {
+		return false
+	}
+	last := s.statuses.Last(key)
+	if last == nil || last.Error != "" || last.Fallback != "" || last.SHA != sha {
+		return false
+	}
+	path := s.repoPath(key, repo)
+	head, err := s.gitOutput(ctx, path, "rev-parse", "HEAD")
+	if err != nil || head != sha {
+		return false
+	}
+	changes, err := s.gitOutput(ctx, path, "status", "--porcelain")
+	return err == nil && changes == ""
+}
+
+// deployFallback checks out repo.FallbackRef and restarts the service on it.
+func (s *Server) deployFallback(ctx context.Context, path string, repo Repo, out io.Writer) error {
+	err := s.git(ctx, path, "fetch", "--", repo.remote(), repo.FallbackRef)
+	if err != nil {
+		return &DeployError{"pull", err}
+	}
+	err = s.git(ctx, path, "checkout", "--detach", "FETCH_HEAD", "--")
+	if err == nil {
+		err = s.updateCheckout(ctx, path, repo)
+	}
+	if err != nil {
+		return &DeployError{"pull", err}
+	}
+	sha, err := s.writeDeployedSHA(ctx, path, repo.VersionEnv)
+	if err != nil {
+		return &DeployError{"version", err}
+	}
+	return s.restart(ctx, path, repo, sha, nil, out)
+}
+
+// stop stops the service of repo, writing the output of systemctl to out.
+func (s *Server) stop(ctx context.Context, path string, repo Repo, out io.Writer) error {
+	service := repo.serviceName()
+	fmt.Fprintln(out, "systemctl stop", service)
+	cmd := exec.CommandContext(ctx, "systemctl", "stop", service)
+	cmd.Dir = path
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := cmd.Run()
+	if err != nil {
+		return &DeployError{"stop", err}
+	}
+	return nil
+}
+
+// restart stops the service, runs the install command and starts the
+// service again on the checked out commit sha, writing the output of the
+// commands to out. changed lists the files changed by the push, or is nil
+// if unknown, in which case the install command always runs.
+func (s *Server) restart(ctx context.Context, path string, repo Repo, sha string, changed []string, out io.Writer) error {
+	service := repo.serviceName()
+
+	// Rollbacks and fallbacks restart without going through deploy
+	err := s.checkCommands(repo)
+	if err != nil {
+		return &DeployError{"approve", err}
+	}
+
+	// Stop service. On the first deploy the unit may not exist until
+	// install creates it.
+	if service != "" && !unitExists(service) {
+		fmt.Fprintln(out, "Unit", service, "not loaded, skipping stop")
+	} else if service != "" {
+		err = s.stop(ctx, path, repo, out)
+		if err != nil {
+			return err
+		}
+
+		// Bring the service back up if the deploy is cancelled after this point
+		defer func() {
+			if ctx.Err() == nil {
+				return
+			}
+			fmt.Fprintln(out, "Deploy cancelled, restarting", service)
+			cmd := exec.Command("systemctl", "start", service)
+			cmd.Stdout = out
+			cmd.Stderr = out
+			if err := cmd.Run(); err != nil {
+				fmt.Fprintln(out, "Error restarting", service+":", err)
+			}
+		}()
+	}
+
+	// Install, unless install_paths says the push doesn't need it
+	err = s.install(ctx, path, repo, sha, changed, out)
+	if err != nil {
+		return err
+	}
+
+	// Fix ownership of what pull and install wrote
+	err = fixPermissions(ctx, path, repo)
+	if err != nil {
+		return &DeployError{"permissions", err}
+	}
+
+	// Generate the unit file from the config
+	created, err := s.writeUnit(path, repo)
+	if err != nil {
+		return &DeployError{"unit", err}
+	}
+
+	// Reload systemd, only if the unit file changed on disk
+	if service != "" && needsDaemonReload(service) {
+		fmt.Fprintln(out, "systemctl daemon-reload")
+		cmd := exec.CommandContext(ctx, "systemctl", "daemon-reload")
+		cmd.Dir = path
+		cmd.Stdout = out
+		cmd.Stderr = out
+		err := cmd.Run()
+		if err != nil {
+			return &DeployError{"reload", err}
+		}
+	}
+
+	// Start service, and at boot if its unit was just generated
+	if created {
+		fmt.Fprintln(out, "systemctl enable", service)
+		cmd := exec.CommandContext(ctx, "systemctl", "enable", service)
+		cmd.Stdout = out
+		cmd.Stderr = out
+		err := cmd.Run()
+		if err != nil {
+			return &DeployError{"unit", err}
+		}
+	}
+	if service != "" {
+		fmt.Fprintln(out, "systemctl start", service)
+		cmd := exec.CommandContext(ctx, "systemctl", "start", service)
+		cmd.Dir = path
+		cmd.Stdout = out
+		cmd.Stderr = out
+		err := cmd.Run()
+		if err != nil {
+			return &DeployError{"start", err}
+		}
+	}
+
+	// Make sure the new code actually serves
+	if repo.HealthCheck != nil {
+		err := checkHealth(ctx, path, repo, out)
+		if err != nil {
+			return &DeployError{"health", err}
+		}
+	}
+
+	return nil
+}
+
+// install runs the install command of repo in the checkout at path, which
+// has the commit sha checked out, unless changed, the files changed by the
+// push, doesn't match repo.InstallPaths.
+func (s *Server) install(ctx context.Context, path string, repo Repo, sha string, changed []string, out io.Writer) error {
+	if repo.Install == "" {
+		return nil
+	}
+	if len(repo.InstallPaths) > 0 && changed != nil && !matchAny(repo.InstallPaths, changed) {
+		fmt.Fprintln(out, "No changed files match install_paths, skipping install")
+		return nil
+	}
+	dir := repo.workdir(path)
+	fmt.Fprintf(out, "WARNING: running shell command in %s:\n%s\n", dir, repo.Install)
+	cmd := exec.CommandContext(ctx, "bash", "-c", repo.Install)
+	if repo.InstallAsUser && repo.Service != nil && repo.Service.User != "" {
+		err := chown(ctx, path, repo.Service.User)
+		if err != nil {
+			return &DeployError{"install", err}
+		}
+		cmd = exec.CommandContext(ctx, "sudo", "-u", repo.Service.User, "-H", "bash", "-c", repo.Install)
+	}
+	cmd.Dir = dir
+	if repo.VersionEnv != "" {
+		cmd.Env = append(os.Environ(), repo.VersionEnv+"="+sha)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	start := time.Now()
+	err := cmd.Run()
+	s.metrics.InstallDuration.Observe(labels("repo", repo.ID), time.Since(start))
+	if err != nil {
+		return &DeployError{"install", err}
+	}
+	return nil
+}
+
+// unitExists reports whether systemd knows the unit of service. If that
+// can't be determined the unit is assumed to exist.
+func unitExists(service string) bool {
+	out, err := exec.Command("systemctl", "show", "--property=LoadState", "--value", service).Output()
+	if err != nil {
+		return true
+	}
+	return strings.TrimSpace(string(out)) != "not-found"
+}
+
+// needsDaemonReload reports whether systemd has to reload its units before
+// service can be started, because its unit file changed on disk or was
+// just created.
+func needsDaemonReload(service string) bool {
+	out, err := exec.Command("systemctl", "show", "--property=NeedDaemonReload,LoadState", service).Output()
+	if err != nil {
+		// Reload to be safe
+		return true
+	}
+	props := string(out)
+	return strings.Contains(props, "NeedDaemonReload=yes") || strings.Contains(props, "LoadState=not-found")
+}
+
+// chown recursively gives the checkout at path to user and its primary group.
+func chown(ctx context.Context, path, user string) error {
+	slog.Info("chown -R", "user", user, "path", path)
+	cmd := exec.CommandContext(ctx, "chown", "-R", user+":", path)
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
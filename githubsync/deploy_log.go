@@ -0,0 +1,190 @@
+package githubsync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeployLog is the combined output of the commands of one deploy. Writes
+// fan out to the process log line by line, the deploy's log file if any,
+// and every client streaming it.
+type DeployLog struct {
+	key  string
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	file *os.File
+	done bool
+	// line is the start of a line not yet written to the process log.
+	line []byte
+}
+
+// newDeployLog returns a log that is also written to path, if set. If the
+// file can't be created, the log is still usable without it.
+func newDeployLog(key, path string) (*DeployLog, error) {
+	l := &DeployLog{key: key}
+	l.cond = sync.NewCond(&l.mu)
+	if path == "" {
+		return l, nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return l, err
+	}
+	l.file, err = os.Create(path)
+	return l, err
+}
+
+func (l *DeployLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logLines(p)
+	l.buf.Write(p)
+	if l.file != nil {
+		l.file.Write(p)
+	}
+	l.cond.Broadcast()
+	return len(p), nil
+}
+
+// logLines writes the complete lines of p to the process log, keeping
+// the rest until the next write or Close.
+func (l *DeployLog) logLines(p []byte) {
+	l.line = append(l.line, p...)
+	for {
+		i := bytes.IndexByte(l.line, '\n')
+		if i < 0 {
+			return
+		}
+		slog.Info("Deploy output", "repo", l.key, "line", string(l.line[:i]))
+		l.line = l.line[i+1:]
+	}
+}
+
+// String returns the output written so far.
+func (l *DeployLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+// Close marks the deploy as finished, which ends the streams.
+func (l *DeployLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.line) > 0 {
+		slog.Info("Deploy output", "repo", l.key, "line", string(l.line))
+		l.line = nil
+	}
+	l.done = true
+	l.cond.Broadcast()
+	if l.file != nil {
+		return l.file.Close()
+	}
+	return nil
+}
+
+// Stream copies the log to w as it is written until the deploy finishes
+// or ctx is cancelled. flush is called after every chunk.
+func (l *DeployLog) Stream(ctx context.Context, w io.Writer, flush func()) {
+	stop := context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.cond.Broadcast()
+	})
+	defer stop()
+
+	offset := 0
+	for {
+		l.mu.Lock()
+		for l.buf.Len() == offset && !l.done && ctx.Err() == nil {
+			l.cond.Wait()
+		}
+		chunk := bytes.Clone(l.buf.Bytes()[offset:])
+		done := l.done
+		l.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+		if len(chunk) > 0 {
+			_, err := w.Write(chunk)
+			if err != nil {
+				return
+			}
+			flush()
+			offset += len(chunk)
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// LogStore holds the log of the running or last deploy of each repo.
+type LogStore struct {
+	// Dir, if set, is the directory the log of every deploy is written to.
+	Dir  string
+	mu   sync.Mutex
+	logs map[string]*DeployLog
+}
+
+// Start returns the log of a new deploy of key, replacing the previous
+// one, and the path of its log file if any. The log is usable even if its
+// file couldn't be created, which is reported by the error.
+func (s *LogStore) Start(key string, start time.Time) (*DeployLog, string, error) {
+	path := ""
+	if s.Dir != "" {
+		path = filepath.Join(s.Dir, strings.ReplaceAll(key, "/", "_"), start.Format("20060102T150405")+".log")
+	}
+	l, err := newDeployLog(key, path)
+	if err != nil {
+		path = ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.logs == nil {
+		s.logs = map[string]*DeployLog{}
+	}
+	s.logs[key] = l
+	return l, path, err
+}
+
+// Get returns the log of the running or last deploy of key, or nil.
+func (s *LogStore) Get(key string) *DeployLog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logs[key]
+}
+
+// logsHandler streams the output of the running deploy of the repo at
+// /logs/<key>/stream. If no deploy is running, the log of the last one is
+// returned.
+func (s *Server) logsHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/logs/"), "/stream")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	l := s.logs.Get(key)
+	if l == nil {
+		http.Error(w, fmt.Sprintf("no deploy of %s yet", key), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flush := func() {}
+	if f, ok := w.(http.Flusher); ok {
+		flush = f.Flush
+	}
+	l.Stream(r.Context(), w, flush)
+}
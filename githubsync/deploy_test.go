@@ -0,0 +1,88 @@
+package githubsync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDaemonReloadOnlyIfUnitChanged(t *testing.T) {
+	for _, reload := range []string{"no", "yes"} {
+		calls := fakeSystemctl(t, "loaded", reload)
+		dir := t.TempDir()
+		repo := Repo{ID: "o/app", Service: &SystemdService{Name: "app"}}
+		s := newTestServer(t, dir, map[string]Repo{"app": repo})
+		err := s.restart(context.Background(), dir, repo, "", nil, io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := calls()
+		reloaded := slices.Index(got, "daemon-reload")
+		started := slices.Index(got, "start app")
+		if started < 0 {
+			t.Fatalf("NeedDaemonReload=%s: didn't start the service: %q", reload, got)
+		}
+		if reload == "no" && reloaded >= 0 {
+			t.Fatalf("reloaded an unchanged unit: %q", got)
+		}
+		if reload == "yes" && (reloaded < 0 || reloaded > started) {
+			t.Fatalf("didn't reload the changed unit before starting it: %q", got)
+		}
+	}
+}
+
+func TestRestartNonexistentUnit(t *testing.T) {
+	calls := fakeSystemctl(t, "not-found", "yes")
+	dir := t.TempDir()
+	repo := Repo{ID: "o/app", Install: "touch installed", Service: &SystemdService{Name: "app"}}
+	s := newTestServer(t, dir, map[string]Repo{"app": repo})
+	err := s.restart(context.Background(), dir, repo, "", nil, io.Discard)
+	if err != nil {
+		t.Fatalf("first deploy of a new unit failed: %v", err)
+	}
+	got := calls()
+	if slices.Contains(got, "stop app") {
+		t.Fatalf("stopped a nonexistent unit: %q", got)
+	}
+	if _, err := os.Stat(dir + "/installed"); err != nil {
+		t.Fatal("didn't install:", err)
+	}
+	if !slices.Contains(got, "start app") {
+		t.Fatalf("didn't start the installed unit: %q", got)
+	}
+}
+
+func TestRestartCancelled(t *testing.T) {
+	calls := fakeSystemctl(t, "not-found", "no")
+	dir := t.TempDir()
+	repo := Repo{ID: "o/app", Install: "touch started && exec sleep 10", Service: &SystemdService{Name: "app"}}
+	s := newTestServer(t, dir, map[string]Repo{"app": repo})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Cancel once the install is running
+	go func() {
+		for {
+			if _, err := os.Stat(dir + "/started"); err == nil {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	start := time.Now()
+	err := s.restart(ctx, dir, repo, "", nil, io.Discard)
+	var deployErr *DeployError
+	if !errors.As(err, &deployErr) || deployErr.Step != "install" {
+		t.Fatalf("got %v, want the install to fail", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("the install wasn't killed")
+	}
+	if got := calls(); slices.Contains(got, "start app") {
+		t.Fatalf("ran the next command after cancellation: %q", got)
+	}
+}
@@ -0,0 +1,104 @@
+package githubsync
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// DeployTracker keeps track of running deploys so that shutdown can wait
+// for them and cancel the stragglers.
+type DeployTracker struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	running map[string]int
+	// total is the number of running deploys and idle is closed whenever
+	// it drops to zero. Unlike a WaitGroup, deploys may start while Drain
+	// waits.
+	total     int
+	idle      chan struct{}
+	completed []string
+	cancelled []string
+}
+
+func NewDeployTracker() *DeployTracker {
+	ctx, cancel := context.WithCancel(context.Background())
+	idle := make(chan struct{})
+	close(idle)
+	return &DeployTracker{
+		ctx:     ctx,
+		cancel:  cancel,
+		running: map[string]int{},
+		idle:    idle,
+	}
+}
+
+// Start registers a deploy of repoID. The returned context is cancelled when
+// the shutdown grace period runs out, and done must be called once the
+// deploy has finished.
+func (t *DeployTracker) Start(repoID string) (ctx context.Context, done func()) {
+	t.mu.Lock()
+	t.running[repoID]++
+	if t.total == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.total++
+	t.mu.Unlock()
+	return t.ctx, func() {
+		t.mu.Lock()
+		t.running[repoID]--
+		if t.running[repoID] == 0 {
+			delete(t.running, repoID)
+		}
+		if t.ctx.Err() != nil {
+			t.cancelled = append(t.cancelled, repoID)
+		} else {
+			t.completed = append(t.completed, repoID)
+		}
+		t.total--
+		if t.total == 0 {
+			close(t.idle)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Running reports whether a deploy of repoID is in progress.
+func (t *DeployTracker) Running(repoID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.running[repoID] > 0
+}
+
+// Drain waits up to grace for running deploys to finish, then cancels the
+// remaining ones and waits for them to clean up.
+func (t *DeployTracker) Drain(grace time.Duration) {
+	// Only report on deploys that were running when shutdown began.
+	t.mu.Lock()
+	t.completed = nil
+	t.cancelled = nil
+	t.mu.Unlock()
+
+	timeout := time.After(grace)
+	for {
+		t.mu.Lock()
+		idle, total := t.idle, t.total
+		t.mu.Unlock()
+		if total == 0 {
+			break
+		}
+		select {
+		case <-idle:
+		case <-timeout:
+			slog.Warn("Shutdown grace period expired, cancelling deploys", "running", total)
+			t.cancel()
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slog.Info("Shutdown finished", "completed", t.completed, "cancelled", t.cancelled)
+}
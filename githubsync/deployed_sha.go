@@ -0,0 +1,81 @@
+package githubsync
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	deployedSHAFile = ".deployed-sha"
+	deployedEnvFile = ".deployed.env"
+)
+
+// writeDeployedSHA records the checked out commit so the service can tell
+// which version it runs: always in .deployed-sha, and as envVar=<sha> in
+// .deployed.env (for use as an EnvironmentFile) if envVar is set. Both
+// files are added to .git/info/exclude so they don't dirty the checkout.
+func (s *Server) writeDeployedSHA(ctx context.Context, path, envVar string) (string, error) {
+	sha, err := s.gitOutput(ctx, path, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	err = s.excludeFromGit(ctx, path, deployedSHAFile, deployedEnvFile)
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(filepath.Join(path, deployedSHAFile), []byte(sha+"\n"), 0644)
+	if err != nil {
+		return "", err
+	}
+	if envVar != "" {
+		env := fmt.Sprintf("%s=%s\n", envVar, sha)
+		err = os.WriteFile(filepath.Join(path, deployedEnvFile), []byte(env), 0644)
+		if err != nil {
+			return "", err
+		}
+	}
+	return sha, nil
+}
+
+// excludeFromGit adds patterns to the checkout's .git/info/exclude, which
+// worktrees share with their main checkout.
+func (s *Server) excludeFromGit(ctx context.Context, path string, patterns ...string) error {
+	file, err := s.gitOutput(ctx, path, "rev-parse", "--git-path", "info/exclude")
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(path, file)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	existing := strings.Split(string(b), "\n")
+	add := ""
+	for _, p := range patterns {
+		if !includes(existing, "/"+p) {
+			add += "/" + p + "\n"
+		}
+	}
+	if add == "" {
+		return nil
+	}
+	if len(b) > 0 && !strings.HasSuffix(string(b), "\n") {
+		add = "\n" + add
+	}
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(add)
+	return err
+}
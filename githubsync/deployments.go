@@ -0,0 +1,144 @@
+package githubsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// defaultEnvironment is the GitHub environment deploys are reported to
+// unless the repo names another one.
+const defaultEnvironment = "production"
+
+// environment returns the GitHub environment the repo is deployed to.
+func (r Repo) environment() string {
+	if r.Environment == "" {
+		return defaultEnvironment
+	}
+	return r.Environment
+}
+
+// GithubDeployment is a deployment as the GitHub API represents it.
+type GithubDeployment struct {
+	ID               int64    `json:"id,omitempty"`
+	Ref              string   `json:"ref"`
+	Environment      string   `json:"environment"`
+	Description      string   `json:"description"`
+	AutoMerge        bool     `json:"auto_merge"`
+	RequiredContexts []string `json:"required_contexts"`
+}
+
+// GithubDeploymentStatus is a deployment status as the GitHub API
+// represents it.
+type GithubDeploymentStatus struct {
+	State       string `json:"state"`
+	Environment string `json:"environment"`
+	Description string `json:"description"`
+	LogURL      string `json:"log_url,omitempty"`
+}
+
+// reportDeployment creates a GitHub deployment of j's commit when it
+// starts, if Config.Deployments is set, and marks it in_progress, and
+// sets its final status once it finishes with event. Rollbacks to
+// releases aren't reported. Requests are made in the background so that
+// GitHub can't hold up deploys.
+func (s *Server) reportDeployment(j *Job, branch, event string) {
+	if !s.cfg.Deployments || j.Repo.provider() != providerGitHub || j.Rollback {
+		return
+	}
+	status := &GithubDeploymentStatus{Environment: j.Repo.environment()}
+	switch event {
+	case EventStarted:
+		status.State, status.Description = "in_progress", "Deploying"
+	case EventSucceeded:
+		status.State, status.Description = "success", fmt.Sprintf("Deployed in %.1fs", j.Status.Duration.Seconds())
+	case EventFailed, EventRolledBack:
+		status.State, status.Description = "failure", "Deploy failed"
+		if j.Status.Fallback != "" {
+			status.Description = "Deploy failed, deployed " + j.Status.Fallback + " instead"
+		}
+	default:
+		return
+	}
+	if s.cfg.ExternalURL != "" {
+		status.LogURL = s.cfg.ExternalURL + "/jobs/" + j.ID
+	}
+	api, repoID := githubAPIURL(j.Repo.Host), j.Repo.ID
+
+	// Finished deploys wait for their deployment to be created
+	if event != EventStarted {
+		if j.deployment == nil {
+			return
+		}
+		created := j.deployment
+		go func() {
+			id := <-created
+			if id == 0 {
+				return
+			}
+			token, err := s.tokenSource()
+			if err == nil {
+				err = postDeploymentStatus(api, token, repoID, id, status)
+			}
+			if err != nil {
+				slog.Error("Setting deployment status failed", "repo", repoID, "deployment", id, "err", err)
+			}
+		}()
+		return
+	}
+
+	ref := j.Status.SHA
+	if ref == "" {
+		ref = branch
+	}
+	deployment := &GithubDeployment{
+		Ref:         ref,
+		Environment: status.Environment,
+		Description: "github-sync deploy of " + j.Key,
+		// Deploy what was pushed, whatever its other statuses
+		RequiredContexts: []string{},
+	}
+	created := make(chan int64, 1)
+	j.deployment = created
+	go func() {
+		token, err := s.tokenSource()
+		if err == nil {
+			err = createDeployment(api, token, repoID, deployment)
+		}
+		if err == nil {
+			err = postDeploymentStatus(api, token, repoID, deployment.ID, status)
+		}
+		if err != nil {
+			slog.Error("Creating deployment failed", "repo", repoID, "ref", ref, "err", err)
+		}
+		created <- deployment.ID
+	}()
+}
+
+// createDeployment creates deployment of repoID and sets its ID. api is
+// the base URL of the GitHub API.
+func createDeployment(api, ghToken, repoID string, deployment *GithubDeployment) error {
+	res, err := githubPost(ghToken, fmt.Sprintf("%s/repos/%s/deployments", api, repoID), deployment)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return githubError(res, repoID)
+	}
+	return json.NewDecoder(res.Body).Decode(deployment)
+}
+
+// postDeploymentStatus sets status on the deployment id of repoID. api is
+// the base URL of the GitHub API.
+func postDeploymentStatus(api, ghToken, repoID string, id int64, status *GithubDeploymentStatus) error {
+	res, err := githubPost(ghToken, fmt.Sprintf("%s/repos/%s/deployments/%d/statuses", api, repoID, id), status)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return githubError(res, repoID)
+	}
+	return nil
+}
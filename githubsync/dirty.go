@@ -0,0 +1,49 @@
+package githubsync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// handleDirty applies repo.OnDirty to local changes of the checkout at
+// path before it is updated, writing what it did to out: "fail" returns
+// an error listing them, "stash" stashes them and "discard" throws them
+// away. It returns the action taken, "stashed" or "discarded", or "" if
+// the checkout is clean or no policy is set, which leaves local changes
+// to the merge.
+func (s *Server) handleDirty(ctx context.Context, path string, repo Repo, out io.Writer) (string, error) {
+	if repo.OnDirty == "" {
+		return "", nil
+	}
+	changes, err := s.gitOutput(ctx, path, "status", "--porcelain")
+	if err != nil || changes == "" {
+		return "", err
+	}
+	files := strings.Count(changes, "\n") + 1
+
+	var action string
+	switch repo.OnDirty {
+	case "fail":
+		return "", fmt.Errorf("%s has local changes:\n%s", path, changes)
+	case "stash":
+		action = "stashed"
+		err = s.git(ctx, path, "stash", "push", "--include-untracked", "--message", "github-sync: local changes before deploy")
+	case "discard":
+		action = "discarded"
+		err = s.git(ctx, path, "reset", "--hard", "HEAD")
+		if err == nil {
+			err = s.git(ctx, path, "clean", "-fd")
+		}
+	default:
+		return "", fmt.Errorf("unknown on_dirty policy %q", repo.OnDirty)
+	}
+	if err != nil {
+		return "", err
+	}
+	slog.Warn("Checkout had local changes", "path", path, "action", action, "files", files)
+	fmt.Fprintf(out, "Local changes in %s %s:\n%s\n", path, action, changes)
+	return action, nil
+}
@@ -0,0 +1,157 @@
+package githubsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// errNoOrg is returned by listRepos for owners that aren't orgs.
+var errNoOrg = errors.New("not an org")
+
+// listedRepo is a repo as the GitHub API lists it.
+type listedRepo struct {
+	FullName string   `json:"full_name"`
+	Topics   []string `json:"topics"`
+	Archived bool     `json:"archived"`
+	Fork     bool     `json:"fork"`
+}
+
+// discoverRepos returns the IDs of the repos of owner, an org or a user,
+// that carry topic, skipping archived repos and forks. api is the base URL
+// of the GitHub API.
+func discoverRepos(api, ghToken, owner, topic string) ([]string, error) {
+	repos, err := listRepos(ghToken, fmt.Sprintf("%s/orgs/%s/repos?type=all", api, owner))
+	if errors.Is(err, errNoOrg) {
+		repos, err = listRepos(ghToken, fmt.Sprintf("%s/users/%s/repos?type=owner", api, owner))
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, repo := range repos {
+		if includes(repo.Topics, topic) && !repo.Archived && !repo.Fork {
+			ids = append(ids, repo.FullName)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// listRepos returns every page of the repo list at apiURL.
+func listRepos(ghToken, apiURL string) ([]listedRepo, error) {
+	all := []listedRepo{}
+	for page := 1; ; page++ {
+		res, err := githubGet(ghToken, fmt.Sprintf("%s&per_page=100&page=%d", apiURL, page))
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode == 404 && strings.Contains(apiURL, "/orgs/") {
+			res.Body.Close()
+			return nil, errNoOrg
+		}
+		if res.StatusCode != 200 {
+			err = githubError(res, apiURL)
+			res.Body.Close()
+			return nil, err
+		}
+		repos := []listedRepo{}
+		err = json.NewDecoder(res.Body).Decode(&repos)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, repos...)
+		if len(repos) < 100 {
+			return all, nil
+		}
+	}
+}
+
+// discover lists the repos of Config.DiscoverOwner carrying
+// Config.DiscoverTopic and reports whether they changed since the last
+// call.
+func (s *Server) discover() (bool, error) {
+	token, err := s.tokenSource()
+	if err != nil {
+		return false, err
+	}
+	ids, err := discoverRepos(githubAPIURL(s.cfg.GitHubURL), token, s.cfg.DiscoverOwner, s.cfg.DiscoverTopic)
+	if err != nil {
+		return false, fmt.Errorf("discovering repos of %s: %s", s.cfg.DiscoverOwner, err)
+	}
+	old := s.discovered.Swap(&ids)
+	return old == nil || !slices.Equal(*old, ids), nil
+}
+
+// addDiscovered adds the discovered repos to repos, the config read from
+// disk, unless an entry for them already exists. Each one is configured
+// like the repo in Config.DiscoverDefaults, a JSON file in which {owner}
+// and {name} are replaced by the repo's.
+func (s *Server) addDiscovered(repos map[string]Repo) error {
+	ids := s.discovered.Load()
+	if ids == nil {
+		return nil
+	}
+	defaults := []byte("{}")
+	if s.cfg.DiscoverDefaults != "" {
+		var err error
+		defaults, err = os.ReadFile(s.cfg.DiscoverDefaults)
+		if err != nil {
+			return err
+		}
+	}
+	configured := map[string]bool{}
+	for _, repo := range repos {
+		configured[repo.ID] = true
+	}
+	for _, id := range *ids {
+		if configured[id] {
+			continue
+		}
+		owner, name, _ := strings.Cut(id, "/")
+		r := strings.NewReplacer("{owner}", owner, "{name}", name)
+		repo := Repo{}
+		err := json.Unmarshal([]byte(r.Replace(string(defaults))), &repo)
+		if err != nil {
+			return fmt.Errorf("%s: %s", s.cfg.DiscoverDefaults, err)
+		}
+		repo.ID = id
+		if repo.provider() != providerGitHub || repo.Host != "" {
+			return fmt.Errorf("%s: discovered repos are on GitHub, provider and host can't be set", s.cfg.DiscoverDefaults)
+		}
+		err = checkProvider(repo)
+		if err != nil {
+			return err
+		}
+		repos[id] = repo
+	}
+	return nil
+}
+
+// discoveryLoop rescans Config.DiscoverOwner every interval and applies
+// the config if the discovered repos changed.
+func (s *Server) discoveryLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		changed, err := s.discover()
+		if err != nil {
+			slog.Error("Discovering repos failed", "err", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		slog.Info("Discovered repos changed", "owner", s.cfg.DiscoverOwner, "repos", len(*s.discovered.Load()))
+		err = s.ReloadAndSync(context.Background())
+		if err != nil {
+			slog.Error("Reloading config failed", "err", err)
+		}
+	}
+}
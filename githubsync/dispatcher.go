@@ -0,0 +1,460 @@
+package githubsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Job is a single deploy of a repo. Its Status carries the delivery id
+// and SHA of the push that triggered it.
+type Job struct {
+	// ID identifies the job at /jobs/<id>.
+	ID string
+	// Key is the key of the repo in the config.
+	Key  string
+	Repo Repo
+	Path string
+	// ChangedFiles lists the files changed by the push, or is nil if unknown.
+	ChangedFiles []string
+	// Release is set for deploys of release-mode repos.
+	Release *GithubRelease
+	// Rollback is set for rollbacks of release and atomic mode repos, to
+	// RollbackTo or, if empty, the previous release.
+	Rollback   bool
+	RollbackTo string
+	// Tag is set for deploys of repos that deploy tags.
+	Tag string
+	// Stop is set for stops of the service of repos whose branch was
+	// deleted.
+	Stop   bool
+	Status *DeployStatus
+
+	// ctx, if set, cancels the deploy, and done receives its result.
+	ctx  context.Context
+	done chan error
+	// deployment receives the id of the GitHub deployment of the job once
+	// created, or 0 if that failed.
+	deployment chan int64
+}
+
+// runJob deploys j and records its status.
+func (s *Server) runJob(j *Job) {
+	ctx, done := s.inflight.Start(j.Key)
+	defer done()
+	if j.ctx != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		stop := context.AfterFunc(j.ctx, cancel)
+		defer stop()
+	}
+
+	start := time.Now()
+	s.jobs.Update(j, func(st *DeployStatus) { st.Time = start })
+	log, logFile, err := s.logs.Start(j.Key, start)
+	if err != nil {
+		slog.Error("Creating deploy log failed", "repo", j.Key, "err", err)
+	}
+	defer log.Close()
+	s.jobs.Update(j, func(st *DeployStatus) { st.Log = logFile })
+	s.jobs.Start(j, log)
+	slog.Info("Deploying", "job", j.ID, "status", j.Status.String())
+	s.notify(j, EventStarted, nil)
+	// Wait for maintenance and watchdog restarts of the repo to finish
+	mu := s.repoMutex(j.Key)
+	mu.Lock()
+	defer mu.Unlock()
+	err = ctx.Err()
+	if err == nil {
+		// Make sure no other instance deploys the checkout
+		if lockErr := s.lock(j.Key, j.Path); lockErr != nil {
+			err = &DeployError{"lock", lockErr}
+		}
+	}
+	// Deal with local changes before updating the checkout
+	if err == nil && !j.Rollback && !j.Stop && j.Release == nil && j.Repo.Mode != "release" {
+		dirty, dirtyErr := s.handleDirty(ctx, j.Repo.checkout(j.Path), j.Repo, log)
+		s.jobs.Update(j, func(st *DeployStatus) { st.Dirty = dirty })
+		if dirtyErr != nil {
+			err = &DeployError{"dirty", dirtyErr}
+		}
+	}
+	if err == nil {
+		switch {
+		case j.Stop:
+			err = s.stop(ctx, j.Path, j.Repo, log)
+		case j.Rollback:
+			var sha string
+			sha, err = s.rollback(ctx, j.Path, j.Repo, j.RollbackTo, log)
+			s.jobs.Update(j, func(st *DeployStatus) { st.SHA = sha })
+		case j.Tag != "":
+			var sha string
+			sha, err = s.deployTag(ctx, j.Path, j.Repo, j.Tag, log)
+			if sha != "" {
+				s.jobs.Update(j, func(st *DeployStatus) { st.SHA = sha })
+			}
+		case j.Release != nil:
+			err = s.deployRelease(ctx, j.Path, j.Repo, j.Release, log)
+		case j.Repo.Mode == "atomic":
+			err = s.deployAtomic(ctx, j.Path, j.Repo, j.Status.SHA, log)
+		default:
+			err = s.deploy(ctx, j.Path, j.Repo, j.Status.SHA, j.ChangedFiles, log)
+		}
+	}
+
+	// Fall back to a known-good ref if the new code doesn't install or start
+	var deployErr *DeployError
+	if errors.As(err, &deployErr) && ctx.Err() == nil && j.Repo.FallbackRef != "" && j.Repo.Mode == "" &&
+		fallsBack(deployErr.Step) {
+		slog.Warn("Deploy failed, deploying fallback, the latest code is NOT live", "repo", j.Key, "fallback", j.Repo.FallbackRef, "err", err)
+		fallbackErr := s.deployFallback(ctx, j.Path, j.Repo, log)
+		if fallbackErr != nil {
+			err = fmt.Errorf("%s; fallback %s failed: %s", err, j.Repo.FallbackRef, fallbackErr)
+		} else {
+			s.jobs.Update(j, func(st *DeployStatus) { st.Fallback = j.Repo.FallbackRef })
+		}
+	}
+	if err != nil && j.Repo.OnFailure != "" {
+		s.onFailure(ctx, j, err, log)
+	}
+	s.jobs.Update(j, func(st *DeployStatus) {
+		st.Duration = time.Since(start)
+		if err != nil {
+			st.Error = err.Error()
+		}
+	})
+	s.statuses.Set(j.Status)
+	rec := &AuditRecord{
+		Time:     start,
+		End:      start.Add(j.Status.Duration),
+		Repo:     j.Key,
+		Branch:   j.Repo.Branch,
+		Commit:   j.Status.SHA,
+		Pusher:   j.Status.Pusher,
+		Delivery: j.Status.DeliveryID,
+		Result:   "success",
+		Error:    j.Status.Error,
+		Duration: j.Status.Duration.Seconds(),
+	}
+	if err != nil {
+		rec.Result = "failure"
+	}
+	s.audit.Record(rec)
+	s.historyDB.Record(rec)
+	s.history.Add(rec)
+	s.metrics.Deploys.Inc(labels("repo", j.Repo.ID, "result", rec.Result))
+	s.metrics.DeployDuration.Observe(labels("repo", j.Repo.ID), j.Status.Duration)
+	s.jobs.Finish(j, err)
+	slog.Info("Deployed", "job", j.ID, "status", j.Status.String())
+	s.notify(j, finishedEvent(j, err), err)
+	if err != nil {
+		s.mailFailure(j, err, log.String())
+	}
+	if j.done != nil {
+		j.done <- err
+	}
+}
+
+// fallsBack reports whether a deploy that failed in step falls back to
+// Repo.FallbackRef: only if the new code failed to install, start or pass
+// its health check. Failures before that, e.g. to take the checkout's lock
+// or to pull, leave the checkout as it is.
+func fallsBack(step string) bool {
+	return step == "install" || step == "start" || step == "health"
+}
+
+// Dispatcher runs jobs for the same repo one at a time in arrival order,
+// while jobs for different repos run in parallel up to a global limit.
+type Dispatcher struct {
+	// MaxDepth, if positive, caps the number of jobs queued, running or
+	// debounced across all repos.
+	MaxDepth int
+	// Superseded, if set, is called with d's lock held when a waiting job
+	// is replaced by a newer one, e.g. to count the pushes it folds in.
+	Superseded func(old, job *Job)
+
+	run      func(*Job)
+	rejected int
+	sem      chan struct{}
+	mu       sync.Mutex
+	held     bool
+	queues   map[string][]*Job
+	pending  map[string]*debounced
+	// workers are the keys whose queue a worker is draining. The head of
+	// their queue is running or about to.
+	workers map[string]bool
+}
+
+// ErrQueueFull is returned by Enqueue when the jobs don't fit in the queue.
+var ErrQueueFull = errors.New("deploy queue is full")
+
+// errShuttingDown is the result of deploys dropped from the queue on
+// shutdown.
+var errShuttingDown = errors.New("shutting down, deploy dropped")
+
+// debounced is a job waiting for pushes to its repo to settle.
+type debounced struct {
+	job   *Job
+	first time.Time
+	gen   int
+}
+
+// NewDispatcher returns a Dispatcher that calls run for each job.
+func NewDispatcher(concurrency int, run func(*Job)) *Dispatcher {
+	return &Dispatcher{
+		run:     run,
+		sem:     make(chan struct{}, concurrency),
+		queues:  map[string][]*Job{},
+		pending: map[string]*debounced{},
+		workers: map[string]bool{},
+	}
+}
+
+// Enqueue queues jobs and returns, for each of them, the number of jobs
+// for the same repo ahead of it, including the one currently running.
+// Jobs of repos with a debounce window are held back until no push
+// arrived for the window, replacing any job still waiting. If the jobs
+// don't all fit in MaxDepth, none of them is queued and ErrQueueFull is
+// returned.
+func (d *Dispatcher) Enqueue(jobs ...*Job) ([]int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	added := 0
+	for _, job := range jobs {
+		window, _ := job.Repo.debounce()
+		_, pending := d.pending[job.Key]
+		if window > 0 && !pending || window == 0 && !d.coalesces(job) {
+			added++
+		}
+	}
+	if d.MaxDepth > 0 && d.depth()+added > d.MaxDepth {
+		d.rejected++
+		return nil, ErrQueueFull
+	}
+	positions := []int{}
+	for _, job := range jobs {
+		window, maxWait := job.Repo.debounce()
+		if window > 0 {
+			d.debounce(job, window, maxWait)
+			positions = append(positions, len(d.queues[job.Key]))
+		} else {
+			positions = append(positions, d.enqueue(job))
+		}
+	}
+	return positions, nil
+}
+
+// EnqueueNow queues job without debouncing or checking MaxDepth and
+// returns the number of jobs ahead of it.
+func (d *Dispatcher) EnqueueNow(job *Job) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.enqueue(job)
+}
+
+// depth returns the number of jobs queued, running or debounced. d.mu must
+// be held.
+func (d *Dispatcher) depth() int {
+	n := len(d.pending)
+	for _, q := range d.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// QueueStats is what /queue reports.
+type QueueStats struct {
+	Depth    int `json:"depth"`
+	MaxDepth int `json:"max_depth"`
+	// Rejected is the number of deliveries turned away with a 503 since
+	// startup because the queue was full.
+	Rejected int `json:"rejected"`
+}
+
+// Stats returns the current depth of the queue and the rejection count.
+func (d *Dispatcher) Stats() QueueStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return QueueStats{Depth: d.depth(), MaxDepth: d.MaxDepth, Rejected: d.rejected}
+}
+
+// ServeHTTP reports the Stats as JSON.
+func (d *Dispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d.Stats())
+}
+
+// debounce (re)starts the wait for quiescence of job's repo. The wait
+// resets on every push but never exceeds maxWait since the first one.
+// d.mu must be held.
+func (d *Dispatcher) debounce(job *Job, window, maxWait time.Duration) {
+	p, ok := d.pending[job.Key]
+	if ok {
+		job.ChangedFiles = mergeChangedFiles(p.job.ChangedFiles, job.ChangedFiles)
+		if d.Superseded != nil {
+			d.Superseded(p.job, job)
+		}
+		p.job = job
+		p.gen++
+	} else {
+		p = &debounced{job: job, first: time.Now()}
+		d.pending[job.Key] = p
+	}
+
+	wait := window
+	if maxWait > 0 {
+		wait = max(min(wait, time.Until(p.first.Add(maxWait))), 0)
+	}
+	gen := p.gen
+	time.AfterFunc(wait, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		// A newer push restarted the wait
+		if d.pending[job.Key] != p || p.gen != gen {
+			return
+		}
+		delete(d.pending, job.Key)
+		d.enqueue(p.job)
+	})
+}
+
+// mergeChangedFiles returns the union of a and b. nil means unknown, so
+// the union is unknown if either is.
+func mergeChangedFiles(a, b []string) []string {
+	if a == nil || b == nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	files := []string{}
+	for _, f := range append(a, b...) {
+		if !seen[f] {
+			seen[f] = true
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// enqueue appends job to its repo's queue. d.mu must be held. Since a
+// deploy always deploys the latest commit, a job still waiting behind the
+// running one is replaced by job rather than deploying twice, unless
+// either of them is waited on or a rollback.
+func (d *Dispatcher) enqueue(job *Job) int {
+	q := d.queues[job.Key]
+	if d.coalesces(job) {
+		last := len(q) - 1
+		prev := q[last]
+		job.ChangedFiles = mergeChangedFiles(prev.ChangedFiles, job.ChangedFiles)
+		if d.Superseded != nil {
+			d.Superseded(prev, job)
+		}
+		q[last] = job
+		return last
+	}
+	d.queues[job.Key] = append(q, job)
+	d.startWorker(job.Key)
+	return len(q)
+}
+
+// coalesces reports whether enqueue would replace a waiting job with job.
+// d.mu must be held.
+func (d *Dispatcher) coalesces(job *Job) bool {
+	q := d.queues[job.Key]
+	waiting := len(q)
+	if d.workers[job.Key] {
+		waiting--
+	}
+	if waiting < 1 {
+		return false
+	}
+	prev := q[len(q)-1]
+	return prev.done == nil && job.done == nil && !prev.Rollback && !job.Rollback
+}
+
+// Hold stops new jobs from starting until Release is called. Running jobs
+// carry on.
+func (d *Dispatcher) Hold() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.held = true
+}
+
+// Release starts the jobs queued while the dispatcher was held.
+func (d *Dispatcher) Release() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.held {
+		return
+	}
+	d.held = false
+	for key := range d.queues {
+		d.startWorker(key)
+	}
+}
+
+// Drop removes the jobs waiting in the queues or for their debounce window
+// and returns them. Running jobs are left alone.
+func (d *Dispatcher) Drop() []*Job {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dropped := []*Job{}
+	for key, q := range d.queues {
+		if d.workers[key] {
+			dropped = append(dropped, q[1:]...)
+			d.queues[key] = q[:1]
+		} else {
+			dropped = append(dropped, q...)
+			delete(d.queues, key)
+		}
+	}
+	for key, p := range d.pending {
+		dropped = append(dropped, p.job)
+		delete(d.pending, key)
+	}
+	return dropped
+}
+
+// startWorker starts draining the queue of the repo with the given key
+// unless a worker already is or the dispatcher is held. d.mu must be held.
+func (d *Dispatcher) startWorker(key string) {
+	if d.workers[key] || d.held {
+		return
+	}
+	d.workers[key] = true
+	go d.work(key)
+}
+
+// work drains the queue of the repo with the given key until it is empty
+// or the dispatcher is held. The running job stays at the head of the
+// queue until it finishes.
+func (d *Dispatcher) work(key string) {
+	for {
+		d.sem <- struct{}{}
+		d.mu.Lock()
+		q := d.queues[key]
+		if len(q) == 0 || d.held {
+			if len(q) == 0 {
+				delete(d.queues, key)
+			}
+			delete(d.workers, key)
+			d.mu.Unlock()
+			<-d.sem
+			return
+		}
+		job := q[0]
+		d.mu.Unlock()
+
+		d.run(job)
+
+		d.mu.Lock()
+		d.queues[key] = d.queues[key][1:]
+		d.mu.Unlock()
+		<-d.sem
+	}
+}
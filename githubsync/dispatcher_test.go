@@ -0,0 +1,254 @@
+package githubsync
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFallsBack(t *testing.T) {
+	for step, want := range map[string]bool{
+		"install": true, "start": true, "health": true,
+		"approve": false, "lock": false, "dirty": false, "pull": false, "version": false, "unit": false,
+	} {
+		if got := fallsBack(step); got != want {
+			t.Errorf("fallsBack(%q) = %v", step, got)
+		}
+	}
+}
+
+func TestNoFallbackWhenLocked(t *testing.T) {
+	dir := t.TempDir()
+	up := newUpstream(t, dir, "up")
+	sh(t, up, "git branch good && git commit -q --allow-empty -m two")
+	repo := Repo{ID: "o/app", Branch: "main", FetchURL: up, FallbackRef: "good"}
+	s := newTestServer(t, dir, map[string]Repo{"o/app": repo})
+	s.cfg.LockWait = 100 * time.Millisecond
+	path := s.repoPath("o/app", repo)
+	err := s.syncRepo(context.Background(), path, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another instance holds the checkout
+	f, err := lockCheckout(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = s.Deploy(context.Background(), "o/app")
+	if err == nil || !strings.HasPrefix(err.Error(), "lock:") {
+		t.Fatalf("got %v, want a lock error", err)
+	}
+	if fallback := s.statuses.Last("o/app").Fallback; fallback != "" {
+		t.Fatalf("deployed fallback %s", fallback)
+	}
+	if branch := sh(t, path, "git rev-parse --abbrev-ref HEAD"); branch != "main" {
+		t.Fatalf("checkout moved to %s", branch)
+	}
+}
+
+func TestDrainDropsQueuedDeploys(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), map[string]Repo{})
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	s.dispatcher = NewDispatcher(1, func(j *Job) {
+		_, done := s.inflight.Start(j.Key)
+		defer done()
+		started <- j.ID
+		<-release
+	})
+	running := &Job{ID: "running", Key: "a", Status: &DeployStatus{}}
+	queued := &Job{ID: "queued", Key: "a", Status: &DeployStatus{}, done: make(chan error, 1)}
+	other := &Job{ID: "other", Key: "b", Status: &DeployStatus{}}
+	s.dispatcher.EnqueueNow(running)
+	if id := <-started; id != "running" {
+		t.Fatalf("started %s first", id)
+	}
+	s.dispatcher.EnqueueNow(queued)
+	s.dispatcher.EnqueueNow(other)
+
+	drained := make(chan struct{})
+	go func() {
+		s.Drain(time.Minute)
+		close(drained)
+	}()
+	if err := <-queued.done; err != errShuttingDown {
+		t.Fatalf("queued deploy got %v, want it dropped", err)
+	}
+	close(release)
+	<-drained
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case id := <-started:
+		t.Fatalf("started %s while shutting down", id)
+	default:
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	type push struct {
+		id, key string
+		// after is how long to wait before enqueueing the job
+		after time.Duration
+		// waited jobs have someone waiting on their result
+		waited, rollback bool
+		repo             Repo
+	}
+	debounced := Repo{Debounce: "100ms"}
+	capped := Repo{Debounce: "1s", DebounceMax: "150ms"}
+	tests := []struct {
+		name        string
+		concurrency int
+		maxDepth    int
+		// runFor is how long each job takes
+		runFor   time.Duration
+		pushes   []push
+		want     map[string][]string
+		rejected int
+		// maxRunning is the most jobs that may run at once
+		maxRunning int
+	}{
+		{
+			name:        "fifo per repo",
+			concurrency: 2,
+			pushes: []push{
+				{id: "a1", key: "a", waited: true}, {id: "b1", key: "b", waited: true}, {id: "a2", key: "a", waited: true},
+				{id: "a3", key: "a", rollback: true}, {id: "b2", key: "b", waited: true},
+			},
+			want: map[string][]string{"a": {"a1", "a2", "a3"}, "b": {"b1", "b2"}},
+		},
+		{
+			name:        "coalesce waiting jobs",
+			concurrency: 2,
+			pushes: []push{
+				{id: "a1", key: "a"}, {id: "a2", key: "a"}, {id: "b1", key: "b"}, {id: "a3", key: "a"},
+			},
+			want: map[string][]string{"a": {"a3"}, "b": {"b1"}},
+		},
+		{
+			name:        "no coalescing of waited jobs and rollbacks",
+			concurrency: 1,
+			pushes: []push{
+				{id: "a1", key: "a"}, {id: "a2", key: "a", waited: true}, {id: "a3", key: "a"},
+				{id: "a4", key: "a", rollback: true}, {id: "a5", key: "a"}, {id: "a6", key: "a"},
+			},
+			want: map[string][]string{"a": {"a1", "a2", "a3", "a4", "a6"}},
+		},
+		{
+			name:        "debounce",
+			concurrency: 1,
+			pushes: []push{
+				{id: "a1", key: "a", repo: debounced}, {id: "a2", key: "a", repo: debounced, after: 30 * time.Millisecond},
+				{id: "a3", key: "a", repo: debounced, after: 30 * time.Millisecond}, {id: "b1", key: "b"},
+			},
+			want: map[string][]string{"a": {"a3"}, "b": {"b1"}},
+		},
+		{
+			name:        "debounce max wait",
+			concurrency: 1,
+			pushes: []push{
+				{id: "a1", key: "a", repo: capped}, {id: "a2", key: "a", repo: capped, after: 50 * time.Millisecond},
+				{id: "a3", key: "a", repo: capped, after: 50 * time.Millisecond},
+				{id: "a4", key: "a", repo: capped, after: 150 * time.Millisecond},
+				{id: "a5", key: "a", repo: capped, after: 50 * time.Millisecond},
+			},
+			want: map[string][]string{"a": {"a3", "a5"}},
+		},
+		{
+			name:        "max depth",
+			concurrency: 1,
+			maxDepth:    3,
+			pushes: []push{
+				{id: "a1", key: "a", waited: true}, {id: "a2", key: "a", waited: true}, {id: "b1", key: "b"},
+				{id: "b2", key: "b", waited: true}, {id: "b3", key: "b"}, {id: "c1", key: "c", repo: debounced},
+			},
+			want:     map[string][]string{"a": {"a1", "a2"}, "b": {"b3"}},
+			rejected: 2,
+		},
+		{
+			name:        "max concurrent deploys",
+			concurrency: 2,
+			runFor:      20 * time.Millisecond,
+			pushes: []push{
+				{id: "a1", key: "a", waited: true}, {id: "b1", key: "b"}, {id: "c1", key: "c"}, {id: "d1", key: "d"},
+				{id: "a2", key: "a", waited: true},
+			},
+			want:       map[string][]string{"a": {"a1", "a2"}, "b": {"b1"}, "c": {"c1"}, "d": {"d1"}},
+			maxRunning: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			ran := map[string][]string{}
+			running, maxRunning := 0, 0
+			finished := make(chan struct{}, len(tt.pushes))
+			d := NewDispatcher(tt.concurrency, func(j *Job) {
+				mu.Lock()
+				running++
+				maxRunning = max(maxRunning, running)
+				ran[j.Key] = append(ran[j.Key], j.ID)
+				mu.Unlock()
+				time.Sleep(tt.runFor)
+				mu.Lock()
+				running--
+				mu.Unlock()
+				if j.done != nil {
+					j.done <- nil
+				}
+				finished <- struct{}{}
+			})
+			d.MaxDepth = tt.maxDepth
+
+			// Queue up the pushes before any of them starts
+			d.Hold()
+			rejected := 0
+			for _, p := range tt.pushes {
+				time.Sleep(p.after)
+				j := &Job{ID: p.id, Key: p.key, Repo: p.repo, Rollback: p.rollback, Status: &DeployStatus{}}
+				if p.waited {
+					j.done = make(chan error, 1)
+				}
+				_, err := d.Enqueue(j)
+				if err == ErrQueueFull {
+					rejected++
+				} else if err != nil {
+					t.Fatal(err)
+				}
+			}
+			d.Release()
+
+			want := 0
+			for _, ids := range tt.want {
+				want += len(ids)
+			}
+			for range want {
+				select {
+				case <-finished:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("timed out, ran %v", ran)
+				}
+			}
+			// Nothing else runs
+			time.Sleep(50 * time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(ran, tt.want) {
+				t.Errorf("ran %v, want %v", ran, tt.want)
+			}
+			if rejected != tt.rejected {
+				t.Errorf("rejected %d pushes, want %d", rejected, tt.rejected)
+			}
+			if tt.maxRunning > 0 && maxRunning != tt.maxRunning {
+				t.Errorf("ran up to %d jobs at once, want %d", maxRunning, tt.maxRunning)
+			}
+			if depth := d.Stats().Depth; depth != 0 {
+				t.Errorf("%d jobs left in the queue", depth)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package githubsync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// DryRun prints the commands syncing and deploying every enabled repo
+// would run, without running any that change anything.
+func (s *Server) DryRun(ctx context.Context, out io.Writer) {
+	repos := s.config()
+	for _, key := range sortedKeys(repos) {
+		repo := repos[key]
+		fmt.Fprintf(out, "%s:\n", key)
+		if !repo.enabled() {
+			fmt.Fprintln(out, "  disabled, nothing would run")
+			continue
+		}
+		s.planDeploy(ctx, key, repo, "", nil, out)
+	}
+}
+
+// isDryRun reports whether r asks for the commands its deploys would run
+// instead of running them, with the dry_run query parameter.
+func isDryRun(r *http.Request) bool {
+	return r.URL.Query().Has("dry_run")
+}
+
+// writePlan writes the commands the jobs would run to w instead of
+// queuing them.
+func (s *Server) writePlan(ctx context.Context, w http.ResponseWriter, jobs []*Job) {
+	slices.SortFunc(jobs, func(a, b *Job) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	for _, job := range jobs {
+		fmt.Fprintf(w, "%s:\n", job.Key)
+		if job.Stop {
+			fmt.Fprintf(w, "  would run: systemctl stop %s\n", job.Repo.serviceName())
+			continue
+		}
+		ref := job.Status.SHA
+		if job.Tag != "" {
+			ref = job.Tag
+		}
+		s.planDeploy(ctx, job.Key, job.Repo, ref, job.ChangedFiles, w)
+	}
+}
+
+// planDeploy writes the commands a deploy of the commit sha, or the tip
+// of the branch if sha is empty, would run for the repo with the given
+// key to out. For repos that deploy tags, sha is the tag. changed lists
+// the files changed by the push, or is nil if unknown. Only read-only
+// commands are run to find out.
+func (s *Server) planDeploy(ctx context.Context, key string, repo Repo, sha string, changed []string, out io.Writer) {
+	would := func(format string, args ...any) {
+		fmt.Fprintf(out, "  would run: "+format+"\n", args...)
+	}
+	path := s.repoPath(key, repo)
+	if err := s.checkCommands(repo); err != nil {
+		fmt.Fprintln(out, "  would fail:", err)
+		return
+	}
+	if repo.Mode == "release" {
+		what := "the latest release"
+		if repo.ReleaseAsset != "" {
+			what = fmt.Sprintf("the asset matching %q of the latest release", repo.ReleaseAsset)
+		}
+		fmt.Fprintf(out, "  would download %s of %s into %s and point %s at it\n", what, repo.ID, releasesDir(path), path)
+		s.planRestart(repo, path, nil, out)
+		return
+	}
+
+	if repo.deploysTags() {
+		tag := sha
+		if tag == "" {
+			tag = "<latest tag>"
+		}
+		would("git -C %s fetch --force %s refs/tags/%s:refs/tags/%s", path, repo.remote(), tag, tag)
+		if repo.RequireSigned {
+			would("git -C %s verify-tag --raw refs/tags/%s, or verify-commit if the tag isn't signed", path, tag)
+		}
+		would("git -C %s checkout --detach %s", path, tag)
+		s.planRestart(repo, path, nil, out)
+		return
+	}
+
+	// Pull
+	checkout := repo.checkout(path)
+	target := sha
+	if target == "" {
+		target = "FETCH_HEAD"
+	}
+	if _, err := os.Stat(filepath.Join(checkout, ".git")); err != nil {
+		args := []string{"clone", "--origin", repo.remote()}
+		if repo.Branch != "" {
+			args = append(args, "--branch", repo.Branch, "--single-branch")
+		}
+		if repo.Submodules {
+			args = append(args, "--recurse-submodules")
+		}
+		would("git %s %s %s", strings.Join(args, " "), repo.cloneURL(), checkout)
+	} else {
+		branch, err := s.trackedBranch(ctx, checkout, repo)
+		if err != nil {
+			fmt.Fprintln(out, "  error:", err)
+			return
+		}
+		would("git -C %s fetch %s %s", checkout, repo.remote(), branch)
+		if repo.RequireSigned {
+			would("git -C %s verify-commit --raw %s", checkout, target)
+		}
+		if repo.Sync == "reset" {
+			would("git -C %s reset --hard %s", checkout, target)
+			if repo.Clean {
+				would("git -C %s clean -fd", checkout)
+			}
+		} else {
+			would("git -C %s merge %s", checkout, target)
+		}
+		switch repo.OnDiverge {
+		case "reset":
+			fmt.Fprintf(out, "  would reset %s to %s if the merge fails\n", checkout, target)
+		case "stash":
+			fmt.Fprintf(out, "  would stash local changes in %s and merge again if the merge fails\n", checkout)
+		}
+		if repo.Submodules {
+			would("git -C %s submodule update --init --recursive", checkout)
+		}
+		if usesLFS(checkout, repo) {
+			would("git -C %s lfs pull %s", checkout, repo.remote())
+		}
+	}
+	if repo.Mode == "atomic" {
+		fmt.Fprintf(out, "  would check out %s into a new release in %s and point %s at it\n", target, releasesDir(path), path)
+		s.planRestart(repo, path, nil, out)
+		return
+	}
+
+	// Only update the working tree if nothing relevant to the service changed
+	if len(repo.RestartPaths) > 0 && changed != nil && !matchAny(repo.RestartPaths, changed) {
+		fmt.Fprintln(out, "  no changed files match restart_paths, install and restart would be skipped")
+		return
+	}
+	s.planRestart(repo, path, changed, out)
+}
+
+// planRestart writes the commands restart would run for the repo deployed
+// at path to out.
+func (s *Server) planRestart(repo Repo, path string, changed []string, out io.Writer) {
+	would := func(format string, args ...any) {
+		fmt.Fprintf(out, "  would run: "+format+"\n", args...)
+	}
+	service := repo.serviceName()
+	if service != "" && unitExists(service) {
+		would("systemctl stop %s", service)
+	}
+	switch {
+	case repo.Install == "":
+	case len(repo.InstallPaths) > 0 && changed != nil && !matchAny(repo.InstallPaths, changed):
+		fmt.Fprintln(out, "  no changed files match install_paths, install would be skipped")
+	case repo.InstallAsUser && repo.Service != nil && repo.Service.User != "":
+		would("chown -R %s: %s", repo.Service.User, path)
+		would("sudo -u %s -H bash -c %q (in %s)", repo.Service.User, repo.Install, repo.workdir(path))
+	default:
+		would("bash -c %q (in %s)", repo.Install, repo.workdir(path))
+	}
+	if repo.Permissions != nil {
+		fmt.Fprintf(out, "  would fix the permissions of %s\n", path)
+	}
+	if repo.Service != nil && repo.Service.Start != "" {
+		unit := s.unitFile(repo)
+		if _, err := os.Stat(unit); err != nil {
+			fmt.Fprintln(out, "  would generate", unit)
+			would("systemctl daemon-reload")
+			would("systemctl enable %s", service)
+		} else {
+			fmt.Fprintln(out, "  would regenerate", unit, "if the config changed")
+		}
+	} else if service != "" && needsDaemonReload(service) {
+		would("systemctl daemon-reload")
+	}
+	if service != "" {
+		would("systemctl start %s", service)
+	}
+	if hc := repo.HealthCheck; hc != nil {
+		if hc.URL != "" {
+			fmt.Fprintln(out, "  would check", hc.URL)
+		}
+		if hc.Command != "" {
+			would("bash -c %q (health check)", hc.Command)
+		}
+	}
+}
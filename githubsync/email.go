@@ -0,0 +1,128 @@
+package githubsync
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// consecutiveFailures returns the number of deploys of key that failed in
+// a row, up to the size of its history.
+func (s *Server) consecutiveFailures(key string) int {
+	n := 0
+	for _, rec := range s.history.Get(key) {
+		if rec.Result != "failure" {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// mailFailure emails the failure of j's deploy with err to Config.EmailTo,
+// with output, the output of its commands, attached. Nothing is sent
+// until the repo failed Config.EmailAfterFailures deploys in a row. The
+// email is sent in the background so that SMTP can't hold up deploys.
+func (s *Server) mailFailure(j *Job, err error, output string) {
+	if s.cfg.SMTPAddr == "" || len(s.cfg.EmailTo) == 0 {
+		return
+	}
+	failures := s.consecutiveFailures(j.Key)
+	if failures < max(s.cfg.EmailAfterFailures, 1) {
+		return
+	}
+	subject := fmt.Sprintf("Deploying %s failed", j.Key)
+	if failures > 1 {
+		subject = fmt.Sprintf("Deploying %s failed %d times in a row", j.Key, failures)
+	}
+	body := fmt.Sprintf("%s\n\nError: %s\n", j.Status.String(), err)
+	msg, buildErr := s.buildEmail(subject, body, output)
+	if buildErr != nil {
+		slog.Error("Building failure email failed", "repo", j.Key, "err", buildErr)
+		return
+	}
+	go func() {
+		err := s.sendEmail(msg)
+		if err != nil {
+			slog.Error("Sending failure email failed", "repo", j.Key, "err", err)
+		}
+	}()
+}
+
+// emailFrom returns the sender of emails, Config.SMTPFrom or
+// github-sync@<hostname>.
+func (s *Server) emailFrom() string {
+	if s.cfg.SMTPFrom != "" {
+		return s.cfg.SMTPFrom
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return "github-sync@" + host
+}
+
+// buildEmail returns the message of an email with subject and the text
+// body, with output attached as deploy.log.
+func (s *Server) buildEmail(subject, body, output string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	fmt.Fprintf(buf, "From: %s\r\n", s.emailFrom())
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(s.cfg.EmailTo, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", subject)
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprint(part, strings.ReplaceAll(body, "\n", "\r\n"))
+
+	part, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Disposition":       {`attachment; filename="deploy.log"`},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Wrap the base64 at 76 characters as MIME requires
+	encoded := base64.StdEncoding.EncodeToString([]byte(output))
+	for len(encoded) > 76 {
+		fmt.Fprintf(part, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(part, "%s\r\n", encoded)
+
+	err = mw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sendEmail sends msg to Config.EmailTo through Config.SMTPAddr,
+// authenticating with Config.SMTPUsername and SMTPPassword if set.
+func (s *Server) sendEmail(msg []byte) error {
+	var auth smtp.Auth
+	if s.cfg.SMTPUsername != "" {
+		host, _, err := net.SplitHostPort(s.cfg.SMTPAddr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.cfg.SMTPUsername, s.cfg.SMTPPassword, host)
+	}
+	return smtp.SendMail(s.cfg.SMTPAddr, auth, s.emailFrom(), s.cfg.EmailTo, msg)
+}
@@ -0,0 +1,57 @@
+package githubsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+func (s *Server) git(ctx context.Context, path string, args ...string) error {
+	cmd := s.gitCommand(ctx, args...)
+	cmd.Dir = path
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// gitCommand returns a command running the configured git binary with the
+// configured -c options and our credentials.
+func (s *Server) gitCommand(ctx context.Context, args ...string) *exec.Cmd {
+	full := []string{}
+	for _, opt := range s.cfg.GitOptions {
+		full = append(full, "-c", opt)
+	}
+	cmd := exec.CommandContext(ctx, s.cfg.GitBinary, append(full, args...)...)
+	cmd.Env = append(os.Environ(), s.gitAuthEnv()...)
+	return cmd
+}
+
+func (s *Server) gitOutput(ctx context.Context, path string, args ...string) (string, error) {
+	cmd := s.gitCommand(ctx, args...)
+	cmd.Dir = path
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (s *Server) getBranch(ctx context.Context, path string) (string, error) {
+	cmd := s.gitCommand(ctx, "-C", path, "rev-parse", "--abbrev-ref", "HEAD")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.New(stderr.String())
+	}
+	branch := strings.TrimSpace(stdout.String())
+	return branch, nil
+}
@@ -0,0 +1,40 @@
+package githubsync
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestGitBinary(t *testing.T) {
+	dir := t.TempDir()
+	// The fake git records its arguments, one invocation per line
+	fake := dir + "/fake-git"
+	err := os.WriteFile(fake, []byte("#!/bin/sh\necho \"$@\" >> "+dir+"/argv\necho main\n"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, dir, map[string]Repo{})
+	s.cfg.GitBinary = fake
+	s.cfg.GitOptions = []string{"safe.directory=*", "http.lowSpeedLimit=1000"}
+	branch, err := s.getBranch(context.Background(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if branch != "main" {
+		t.Fatalf("got branch %q from the fake git", branch)
+	}
+	err = s.git(context.Background(), dir, "fetch", "--", "origin", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(dir + "/argv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "-c safe.directory=* -c http.lowSpeedLimit=1000 -C " + dir + " rev-parse --abbrev-ref HEAD\n" +
+		"-c safe.directory=* -c http.lowSpeedLimit=1000 fetch -- origin main\n"
+	if got := string(b); got != want {
+		t.Fatalf("fake git ran with\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,199 @@
+package githubsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// giteaProvider is the API of a Gitea or Forgejo instance, which is
+// modelled on GitHub's.
+type giteaProvider struct {
+	token   string
+	baseURL string
+}
+
+// giteaHook is a repo hook as the Gitea API represents it.
+type giteaHook struct {
+	ID     int64             `json:"id,omitempty"`
+	Type   string            `json:"type"`
+	Active bool              `json:"active"`
+	Events []string          `json:"events"`
+	Config map[string]string `json:"config"`
+}
+
+// hooksURL returns the API URL of the hooks of repoID.
+func (p *giteaProvider) hooksURL(repoID string) string {
+	return fmt.Sprintf("%s/api/v1/repos/%s/hooks", strings.TrimSuffix(p.baseURL, "/"), repoID)
+}
+
+func (p *giteaProvider) do(method, apiURL string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, apiURL, bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", p.token))
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func (p *giteaProvider) RegisterHook(repoID, webhookURL, legacyURL string, events []string, secret string) (int64, error) {
+	// Get list of current hooks
+	res, err := p.do("GET", p.hooksURL(repoID), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return 0, giteaError(res, repoID)
+	}
+	hooks := []giteaHook{}
+	err = json.NewDecoder(res.Body).Decode(&hooks)
+	if err != nil {
+		return 0, err
+	}
+
+	// Return early if URL is already registered. Gitea doesn't reveal
+	// secrets, so hooks are updated whenever one is configured.
+	for _, hook := range hooks {
+		if sameURL(hook.Config["url"], webhookURL) && hook.Active && includesAll(hook.Events, events) && hook.Config["content_type"] == "json" && secret == "" {
+			return hook.ID, nil
+		}
+	}
+	config := map[string]string{
+		"url":          webhookURL,
+		"content_type": "json",
+	}
+	if secret != "" {
+		config["secret"] = secret
+	}
+	body, err := json.Marshal(giteaHook{
+		Type:   "gitea",
+		Active: true,
+		Events: events,
+		Config: config,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// Update a hook registered at the legacy URL or for fewer events instead
+	for _, hook := range hooks {
+		if sameURL(hook.Config["url"], webhookURL) {
+			slog.Info("Updating hook", "repo", repoID)
+			return hook.ID, p.updateHook(repoID, hook.ID, body)
+		}
+		if legacyURL != "" && sameURL(hook.Config["url"], legacyURL) {
+			slog.Info("Moving hook", "repo", repoID, "from", legacyURL, "to", webhookURL)
+			return hook.ID, p.updateHook(repoID, hook.ID, body)
+		}
+	}
+
+	// Create the hook
+	res, err = p.do("POST", p.hooksURL(repoID), body)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return 0, giteaError(res, repoID)
+	}
+	created := &giteaHook{}
+	err = json.NewDecoder(res.Body).Decode(created)
+	if err != nil {
+		return 0, err
+	}
+	return created.ID, nil
+}
+
+func (p *giteaProvider) updateHook(repoID string, hookID int64, body []byte) error {
+	res, err := p.do("PATCH", fmt.Sprintf("%s/%d", p.hooksURL(repoID), hookID), body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return giteaError(res, repoID)
+	}
+	return nil
+}
+
+func (p *giteaProvider) DeleteHook(repoID string, hookID int64) error {
+	res, err := p.do("DELETE", fmt.Sprintf("%s/%d", p.hooksURL(repoID), hookID), nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// A 404 means the hook is already gone.
+	if res.StatusCode != 204 && res.StatusCode != 404 {
+		return giteaError(res, repoID)
+	}
+	return nil
+}
+
+// DecodeWebhook parses a Gitea push, which has the shape of GitHub's
+// except for the pusher. Other events decode to a request without a ref,
+// which no entry tracks.
+func (p *giteaProvider) DecodeWebhook(r *http.Request, body []byte) (*WebhookRequest, error) {
+	req := &WebhookRequest{}
+	err := json.Unmarshal(body, req)
+	if err != nil {
+		return nil, err
+	}
+	pusher := struct {
+		Pusher struct {
+			Login string `json:"login"`
+		} `json:"pusher"`
+	}{}
+	err = json.Unmarshal(body, &pusher)
+	if err != nil {
+		return nil, err
+	}
+	req.Pusher.Name = pusher.Pusher.Login
+	if giteaEvent(r) != "push" {
+		req.Ref = ""
+	}
+	return req, nil
+}
+
+// VerifyWebhook checks the X-Gitea-Signature header, or Forgejo's
+// X-Forgejo-Signature, the hex HMAC-SHA256 of the body keyed with secret.
+func (p *giteaProvider) VerifyWebhook(r *http.Request, body []byte, secret string) error {
+	for _, header := range []string{"X-Forgejo-Signature", "X-Gitea-Signature"} {
+		if sig := r.Header.Get(header); sig != "" {
+			return checkHMAC(secret, body, sig, header)
+		}
+	}
+	return errors.New("missing X-Gitea-Signature")
+}
+
+// giteaEvent returns the event of a Gitea or Forgejo delivery.
+func giteaEvent(r *http.Request) string {
+	if event := r.Header.Get("X-Forgejo-Event"); event != "" {
+		return event
+	}
+	return r.Header.Get("X-Gitea-Event")
+}
+
+// giteaError builds an error from a failed Gitea API response.
+func giteaError(res *http.Response, repoID string) error {
+	b, _ := io.ReadAll(res.Body)
+	e := struct {
+		Message string `json:"message"`
+	}{}
+	msg := strings.TrimSpace(string(b))
+	if json.Unmarshal(b, &e) == nil && e.Message != "" {
+		msg = e.Message
+	}
+	if res.StatusCode == 401 {
+		msg += " (GITEA_TOKEN is invalid or expired)"
+	}
+	return fmt.Errorf("%s: %d: %s", repoID, res.StatusCode, msg)
+}
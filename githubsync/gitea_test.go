@@ -0,0 +1,73 @@
+package githubsync
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// giteaPushPayload is a trimmed Gitea push webhook.
+const giteaPushPayload = `{
+  "ref": "refs/heads/main",
+  "before": "28e1879d029cb852e4844d9c718537df08844e03",
+  "after": "bffeb74224043ba2feb48d137756c8a9331c449a",
+  "commits": [
+    {
+      "id": "bffeb74224043ba2feb48d137756c8a9331c449a",
+      "message": "Update the README",
+      "author": {"name": "Jane Doe", "email": "jane@example.com", "username": "jdoe"},
+      "added": [], "removed": [], "modified": ["README.md"]
+    }
+  ],
+  "head_commit": {
+    "id": "bffeb74224043ba2feb48d137756c8a9331c449a",
+    "message": "Update the README",
+    "author": {"name": "Jane Doe", "email": "jane@example.com", "username": "jdoe"}
+  },
+  "repository": {
+    "name": "app",
+    "full_name": "o/app",
+    "fork": false,
+    "default_branch": "main",
+    "owner": {"login": "o", "username": "o"}
+  },
+  "pusher": {"login": "jdoe", "full_name": "Jane Doe", "email": "jane@example.com"},
+  "sender": {"login": "jdoe"}
+}`
+
+func TestGiteaDecodeWebhook(t *testing.T) {
+	p := &giteaProvider{}
+	for _, header := range []string{"X-Gitea-Event", "X-Forgejo-Event"} {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(giteaPushPayload))
+		r.Header.Set(header, "push")
+		req, err := p.DecodeWebhook(r, []byte(giteaPushPayload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.Ref != "refs/heads/main" || req.After != "bffeb74224043ba2feb48d137756c8a9331c449a" {
+			t.Errorf("%s: got ref %q at %q", header, req.Ref, req.After)
+		}
+		if req.Pusher.Name != "jdoe" || req.Sender.Login != "jdoe" {
+			t.Errorf("%s: got pusher %+v, sender %+v", header, req.Pusher, req.Sender)
+		}
+		wantRepo := &GithubRepository{Name: "app", FullName: "o/app", Owner: GithubOwner{Login: "o"}, DefaultBranch: "main"}
+		if !reflect.DeepEqual(req.Repository, wantRepo) {
+			t.Errorf("%s: got repository %+v, want %+v", header, req.Repository, wantRepo)
+		}
+		if req.HeadCommit == nil || req.HeadCommit.Author.Username != "jdoe" {
+			t.Errorf("%s: got head commit %+v", header, req.HeadCommit)
+		}
+		if files := changedFiles(req); !reflect.DeepEqual(files, []string{"README.md"}) {
+			t.Errorf("%s: got changed files %v", header, files)
+		}
+	}
+
+	// Other events carry no ref to deploy
+	r := httptest.NewRequest("POST", "/", strings.NewReader(giteaPushPayload))
+	r.Header.Set("X-Gitea-Event", "create")
+	req, err := p.DecodeWebhook(r, []byte(giteaPushPayload))
+	if err != nil || req.Ref != "" {
+		t.Errorf("create event decoded to ref %q, %v", req.Ref, err)
+	}
+}
@@ -0,0 +1,168 @@
+package githubsync
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// GitHubApp mints and caches the installation tokens of a GitHub App,
+// which are used in place of a personal token.
+type GitHubApp struct {
+	// ID is the app's id and Key its private key.
+	ID  int64
+	Key *rsa.PrivateKey
+	// InstallationID is the installation tokens are minted for. If zero,
+	// the app must have exactly one installation, which is used.
+	InstallationID int64
+	// API is the base URL of the GitHub API.
+	API string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// appTokenMargin is how long before it expires an installation token is
+// replaced, so that no git command or API call runs with a stale one.
+const appTokenMargin = 5 * time.Minute
+
+// readAppKey reads the PEM private key GitHub generated for an app.
+func readAppKey(path string) (*rsa.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA key", path)
+	}
+	return rsaKey, nil
+}
+
+// jwt returns a JSON web token authenticating as the app itself, valid
+// for nine minutes. It is backdated a minute to allow for clock drift.
+func (a *GitHubApp) jwt() (string, error) {
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		panic(err)
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.FormatInt(a.ID, 10),
+	})
+	if err != nil {
+		panic(err)
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.Key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// Token returns an installation token, minting a new one if the cached
+// one is about to expire.
+func (a *GitHubApp) Token() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Until(a.expires) > appTokenMargin {
+		return a.token, nil
+	}
+	jwt, err := a.jwt()
+	if err != nil {
+		return "", err
+	}
+	if a.InstallationID == 0 {
+		a.InstallationID, err = a.installation(jwt)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/app/installations/%d/access_tokens", a.API, a.InstallationID), nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", "Bearer "+jwt)
+	req.Header.Add("Accept", "application/vnd.github+json")
+	res, err := githubClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return "", githubError(res, "GitHub App")
+	}
+	token := struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&token)
+	if err != nil {
+		return "", err
+	}
+	a.token = token.Token
+	a.expires = token.ExpiresAt
+	return a.token, nil
+}
+
+// installation returns the id of the app's only installation.
+func (a *GitHubApp) installation(jwt string) (int64, error) {
+	req, err := http.NewRequest("GET", a.API+"/app/installations", nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", "Bearer "+jwt)
+	req.Header.Add("Accept", "application/vnd.github+json")
+	res, err := githubClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return 0, githubError(res, "GitHub App")
+	}
+	installations := []struct {
+		ID int64 `json:"id"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&installations)
+	if err != nil {
+		return 0, err
+	}
+	if len(installations) == 0 {
+		return 0, errors.New("GitHub App isn't installed on any account")
+	}
+	if len(installations) > 1 {
+		return 0, fmt.Errorf("GitHub App is installed on %d accounts, set GITHUB_APP_INSTALLATION_ID to pick one", len(installations))
+	}
+	return installations[0].ID, nil
+}
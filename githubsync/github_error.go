@@ -0,0 +1,58 @@
+package githubsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// GithubError is an error response from the GitHub API.
+type GithubError struct {
+	RepoID           string
+	StatusCode       int
+	Message          string `json:"message"`
+	DocumentationURL string `json:"documentation_url"`
+}
+
+func (e *GithubError) Error() string {
+	s := fmt.Sprintf("%s: %d: %s", e.RepoID, e.StatusCode, e.Message)
+	if hint := e.hint(); hint != "" {
+		s += " (" + hint + ")"
+	}
+	if e.DocumentationURL != "" {
+		s += ", see " + e.DocumentationURL
+	}
+	return s
+}
+
+// hint maps common failures to something actionable.
+func (e *GithubError) hint() string {
+	msg := strings.ToLower(e.Message)
+	switch {
+	case e.StatusCode == 401:
+		return "GITHUB_TOKEN is invalid or expired"
+	case e.StatusCode == 403 && strings.Contains(msg, "rate limit"):
+		return "GitHub API rate limit exceeded"
+	case e.StatusCode == 403 || e.StatusCode == 404 && strings.Contains(msg, "not found"):
+		// GitHub answers 404 rather than 403 for repos the token can't see.
+		return "token missing admin:repo_hook scope or repo doesn't exist"
+	case e.StatusCode == 422:
+		return "GitHub rejected the hook config"
+	}
+	return ""
+}
+
+// githubError builds an error from a failed GitHub API response.
+func githubError(res *http.Response, repoID string) error {
+	b, _ := io.ReadAll(res.Body)
+	e := &GithubError{
+		RepoID:     repoID,
+		StatusCode: res.StatusCode,
+	}
+	if json.Unmarshal(b, e) != nil || e.Message == "" {
+		e.Message = strings.TrimSpace(string(b))
+	}
+	return e
+}
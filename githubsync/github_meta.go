@@ -0,0 +1,130 @@
+package githubsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hookRangesRefreshInterval is how often the GitHub hook CIDRs are refetched.
+const hookRangesRefreshInterval = time.Hour
+
+// HookRanges caches the CIDRs GitHub sends webhooks from.
+type HookRanges struct {
+	mu     sync.RWMutex
+	nets   []*net.IPNet
+	loaded bool
+}
+
+// Refresh fetches the current hook ranges from the GitHub meta API.
+// On failure the previously cached ranges are kept.
+func (h *HookRanges) Refresh(ghToken string) error {
+	req, err := http.NewRequest("GET", "https://api.github.com/meta", nil)
+	if err != nil {
+		panic(err)
+	}
+	// The meta API is public, a token only raises the rate limit
+	if ghToken != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("token %s", ghToken))
+	}
+	res, err := githubClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("github meta: %d", res.StatusCode)
+	}
+	meta := struct {
+		Hooks []string `json:"hooks"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&meta)
+	if err != nil {
+		return err
+	}
+	nets := []*net.IPNet{}
+	for _, cidr := range meta.Hooks {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("github meta: %s", err)
+		}
+		nets = append(nets, n)
+	}
+
+	h.mu.Lock()
+	h.nets = nets
+	h.loaded = true
+	h.mu.Unlock()
+	return nil
+}
+
+// RefreshLoop refreshes the ranges forever, logging failures.
+func (h *HookRanges) RefreshLoop(ghToken string) {
+	for {
+		time.Sleep(hookRangesRefreshInterval)
+		err := h.Refresh(ghToken)
+		if err != nil {
+			slog.Error("Refreshing GitHub hook ranges failed", "err", err)
+		}
+	}
+}
+
+// Allows reports whether ip is within the cached ranges. If the ranges
+// have never been loaded every IP is allowed so that an unreachable meta
+// endpoint doesn't take the webhook down.
+func (h *HookRanges) Allows(ip net.IP) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if !h.loaded {
+		return true
+	}
+	for _, n := range h.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware rejects requests that don't originate from GitHub with 403.
+// trustedProxies is the number of reverse proxies in front of us whose
+// X-Forwarded-For entries can be trusted.
+func (h *HookRanges) Middleware(trustedProxies int, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r, trustedProxies)
+		if ip == nil || !h.Allows(ip) {
+			slog.Warn("Rejected webhook", "ip", ip.String())
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// remoteIP returns the client IP of r. With trustedProxies == 0 the
+// connection's address is used. Otherwise the address is taken from
+// X-Forwarded-For, skipping the entries appended by our own proxies.
+func remoteIP(r *http.Request, trustedProxies int) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if trustedProxies > 0 {
+		hops := []string{}
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+		// The last proxy appends the address it saw, so the client is
+		// trustedProxies entries from the right.
+		if len(hops) < trustedProxies {
+			return nil
+		}
+		host = strings.TrimSpace(hops[len(hops)-trustedProxies])
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,74 @@
+package githubsync
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		trusted    int
+		want       string
+	}{
+		{"direct", "192.30.252.1:1234", nil, 0, "192.30.252.1"},
+		{"direct without port", "192.30.252.1", nil, 0, "192.30.252.1"},
+		{"direct ignores spoofed header", "203.0.113.9:1234", []string{"192.30.252.1"}, 0, "203.0.113.9"},
+		{"one proxy", "10.0.0.1:1234", []string{"192.30.252.1"}, 1, "192.30.252.1"},
+		{"one proxy with spoofed entry", "10.0.0.1:1234", []string{"192.30.252.1, 203.0.113.9"}, 1, "203.0.113.9"},
+		{"one proxy with spoofed header line", "10.0.0.1:1234", []string{"192.30.252.1", "203.0.113.9"}, 1, "203.0.113.9"},
+		{"two proxies", "10.0.0.1:1234", []string{"192.30.252.1, 10.0.0.2"}, 2, "192.30.252.1"},
+		{"two proxies with spoofed entry", "10.0.0.1:1234", []string{"192.30.252.1, 203.0.113.9, 10.0.0.2"}, 2, "203.0.113.9"},
+		{"fewer hops than proxies", "10.0.0.1:1234", []string{"192.30.252.1"}, 2, ""},
+		{"missing header behind proxy", "10.0.0.1:1234", nil, 1, ""},
+		{"garbage entry", "10.0.0.1:1234", []string{"not-an-ip"}, 1, ""},
+		{"IPv6", "[2001:db8::1]:1234", nil, 0, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			got := remoteIP(r, tt.trusted)
+			if tt.want == "" && got != nil || tt.want != "" && !got.Equal(net.ParseIP(tt.want)) {
+				t.Errorf("remoteIP() = %v, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHookRangesMiddleware(t *testing.T) {
+	_, n, _ := net.ParseCIDR("192.30.252.0/22")
+	h := &HookRanges{nets: []*net.IPNet{n}, loaded: true}
+	handler := h.Middleware(1, func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name string
+		xff  string
+		want int
+	}{
+		{"from GitHub", "192.30.252.1", http.StatusOK},
+		{"spoofed GitHub entry", "192.30.252.1, 203.0.113.9", http.StatusForbidden},
+		{"not from GitHub", "203.0.113.9", http.StatusForbidden},
+		{"no header", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", nil)
+			r.RemoteAddr = "10.0.0.1:1234"
+			if tt.xff != "" {
+				r.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package githubsync
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// gitlabURL is the base URL of gitlab.com, which hosts GitLab repos
+// without a host.
+const gitlabURL = "https://gitlab.com"
+
+// gitlabProvider is the API of a GitLab instance. Repo IDs are project
+// paths like group/subgroup/project.
+type gitlabProvider struct {
+	token   string
+	baseURL string
+}
+
+// gitlabHook is a project hook as the GitLab API represents it.
+type gitlabHook struct {
+	ID             int64  `json:"id,omitempty"`
+	URL            string `json:"url"`
+	PushEvents     bool   `json:"push_events"`
+	ReleasesEvents bool   `json:"releases_events"`
+	Token          string `json:"token,omitempty"`
+	SSLVerify      bool   `json:"enable_ssl_verification"`
+}
+
+// hooksURL returns the API URL of the hooks of the project repoID.
+func (p *gitlabProvider) hooksURL(repoID string) string {
+	return fmt.Sprintf("%s/api/v4/projects/%s/hooks", strings.TrimSuffix(p.baseURL, "/"), url.PathEscape(repoID))
+}
+
+func (p *gitlabProvider) do(method, apiURL string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, apiURL, bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("PRIVATE-TOKEN", p.token)
+	if body != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	return http.DefaultClient.Do(req)
+}
+
+func (p *gitlabProvider) RegisterHook(repoID, webhookURL, legacyURL string, events []string, secret string) (int64, error) {
+	// Get list of current hooks
+	res, err := p.do("GET", p.hooksURL(repoID), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return 0, gitlabError(res, repoID)
+	}
+	hooks := []gitlabHook{}
+	err = json.NewDecoder(res.Body).Decode(&hooks)
+	if err != nil {
+		return 0, err
+	}
+
+	// Return early if URL is already registered. GitLab doesn't reveal
+	// tokens either, so hooks are updated whenever one is configured.
+	want := gitlabHook{
+		URL:            webhookURL,
+		PushEvents:     includes(events, "push"),
+		ReleasesEvents: includes(events, "release"),
+		Token:          secret,
+		SSLVerify:      true,
+	}
+	for _, hook := range hooks {
+		if sameURL(hook.URL, webhookURL) && hook.PushEvents == want.PushEvents && hook.ReleasesEvents == want.ReleasesEvents && secret == "" {
+			return hook.ID, nil
+		}
+	}
+	body, err := json.Marshal(want)
+	if err != nil {
+		panic(err)
+	}
+
+	// Update a hook registered at the legacy URL or for other events instead
+	for _, hook := range hooks {
+		if sameURL(hook.URL, webhookURL) {
+			slog.Info("Updating hook", "repo", repoID)
+			return hook.ID, p.updateHook(repoID, hook.ID, body)
+		}
+		if legacyURL != "" && sameURL(hook.URL, legacyURL) {
+			slog.Info("Moving hook", "repo", repoID, "from", legacyURL, "to", webhookURL)
+			return hook.ID, p.updateHook(repoID, hook.ID, body)
+		}
+	}
+
+	// Create the hook
+	res, err = p.do("POST", p.hooksURL(repoID), body)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return 0, gitlabError(res, repoID)
+	}
+	created := &gitlabHook{}
+	err = json.NewDecoder(res.Body).Decode(created)
+	if err != nil {
+		return 0, err
+	}
+	return created.ID, nil
+}
+
+func (p *gitlabProvider) updateHook(repoID string, hookID int64, body []byte) error {
+	res, err := p.do("PUT", fmt.Sprintf("%s/%d", p.hooksURL(repoID), hookID), body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return gitlabError(res, repoID)
+	}
+	return nil
+}
+
+func (p *gitlabProvider) DeleteHook(repoID string, hookID int64) error {
+	res, err := p.do("DELETE", fmt.Sprintf("%s/%d", p.hooksURL(repoID), hookID), nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// A 404 means the hook is already gone.
+	if res.StatusCode != 204 && res.StatusCode != 404 {
+		return gitlabError(res, repoID)
+	}
+	return nil
+}
+
+// gitlabPush is the payload of a GitLab push hook.
+type gitlabPush struct {
+	Ref          string `json:"ref"`
+	After        string `json:"after"`
+	UserName     string `json:"user_name"`
+	UserUsername string `json:"user_username"`
+	UserEmail    string `json:"user_email"`
+	Project      *struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		DefaultBranch     string `json:"default_branch"`
+	} `json:"project"`
+	Commits []GithubCommit `json:"commits"`
+}
+
+// DecodeWebhook translates a GitLab push hook into the GitHub push it
+// corresponds to. Other events decode to a request without a ref, which
+// no entry tracks.
+func (p *gitlabProvider) DecodeWebhook(r *http.Request, body []byte) (*WebhookRequest, error) {
+	push := &gitlabPush{}
+	err := json.Unmarshal(body, push)
+	if err != nil {
+		return nil, err
+	}
+	req := &WebhookRequest{
+		Ref:     push.Ref,
+		After:   push.After,
+		Pusher:  GithubPusher{Name: push.UserUsername, Email: push.UserEmail},
+		Commits: push.Commits,
+		Sender:  GithubOwner{Login: push.UserUsername},
+	}
+	if r.Header.Get("X-Gitlab-Event") != "Push Hook" {
+		req.Ref = ""
+	}
+	if push.Project != nil {
+		id := push.Project.PathWithNamespace
+		i := strings.LastIndex(id, "/")
+		req.Repository = &GithubRepository{
+			Name:          id[i+1:],
+			FullName:      id,
+			Owner:         GithubOwner{Login: id[:max(i, 0)]},
+			DefaultBranch: push.Project.DefaultBranch,
+		}
+	}
+	for i, c := range push.Commits {
+		if c.ID == push.After {
+			req.HeadCommit = &push.Commits[i]
+		}
+	}
+	return req, nil
+}
+
+// VerifyWebhook checks the X-Gitlab-Token header, which GitLab sets to the
+// hook's secret token as is.
+func (p *gitlabProvider) VerifyWebhook(r *http.Request, body []byte, secret string) error {
+	token := r.Header.Get("X-Gitlab-Token")
+	if token == "" {
+		return errors.New("missing X-Gitlab-Token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return errors.New("X-Gitlab-Token doesn't match the webhook secret")
+	}
+	return nil
+}
+
+// gitlabError builds an error from a failed GitLab API response, which
+// carries its reason in either a message or an error field.
+func gitlabError(res *http.Response, repoID string) error {
+	b, _ := io.ReadAll(res.Body)
+	e := struct {
+		Message any    `json:"message"`
+		Error   string `json:"error"`
+	}{}
+	msg := strings.TrimSpace(string(b))
+	if json.Unmarshal(b, &e) == nil {
+		if e.Error != "" {
+			msg = e.Error
+		} else if e.Message != nil {
+			msg = fmt.Sprint(e.Message)
+		}
+	}
+	if res.StatusCode == 401 {
+		msg += " (GITLAB_TOKEN is invalid or expired)"
+	}
+	return fmt.Errorf("%s: %d: %s", repoID, res.StatusCode, msg)
+}
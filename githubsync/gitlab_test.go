@@ -0,0 +1,67 @@
+package githubsync
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// gitlabPushPayload is a trimmed GitLab push hook.
+const gitlabPushPayload = `{
+  "object_kind": "push",
+  "ref": "refs/heads/main",
+  "before": "95790bf891e76fee5e1747ab589903a6a1f80f22",
+  "after": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+  "user_name": "Jane Doe",
+  "user_username": "jdoe",
+  "user_email": "jane@example.com",
+  "project": {"path_with_namespace": "group/sub/app", "default_branch": "main"},
+  "commits": [
+    {
+      "id": "b6568db1bc1dcd7f8b4d5a946b0b91f9dacd7327",
+      "message": "Fix the build",
+      "author": {"name": "Jane Doe", "email": "jane@example.com"},
+      "added": [], "modified": ["go.mod"], "removed": []
+    },
+    {
+      "id": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+      "message": "Add a handler",
+      "author": {"name": "Jane Doe", "email": "jane@example.com"},
+      "added": ["handler.go"], "modified": [], "removed": ["old.go"]
+    }
+  ]
+}`
+
+func TestGitLabDecodeWebhook(t *testing.T) {
+	p := &gitlabProvider{}
+	r := httptest.NewRequest("POST", "/", strings.NewReader(gitlabPushPayload))
+	r.Header.Set("X-Gitlab-Event", "Push Hook")
+	req, err := p.DecodeWebhook(r, []byte(gitlabPushPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Ref != "refs/heads/main" || req.After != "da1560886d4f094c3e6c9ef40349f7d38b5d27d7" {
+		t.Errorf("got ref %q at %q", req.Ref, req.After)
+	}
+	if req.Pusher != (GithubPusher{Name: "jdoe", Email: "jane@example.com"}) || req.Sender.Login != "jdoe" {
+		t.Errorf("got pusher %+v, sender %+v", req.Pusher, req.Sender)
+	}
+	wantRepo := &GithubRepository{Name: "app", FullName: "group/sub/app", Owner: GithubOwner{Login: "group/sub"}, DefaultBranch: "main"}
+	if !reflect.DeepEqual(req.Repository, wantRepo) {
+		t.Errorf("got repository %+v, want %+v", req.Repository, wantRepo)
+	}
+	if req.HeadCommit == nil || req.HeadCommit.Message != "Add a handler" {
+		t.Errorf("got head commit %+v", req.HeadCommit)
+	}
+	if files := changedFiles(req); !reflect.DeepEqual(files, []string{"go.mod", "handler.go", "old.go"}) {
+		t.Errorf("got changed files %v", files)
+	}
+
+	// Other events carry no ref to deploy
+	r.Header.Set("X-Gitlab-Event", "Tag Push Hook")
+	req, err = p.DecodeWebhook(r, []byte(gitlabPushPayload))
+	if err != nil || req.Ref != "" {
+		t.Errorf("tag push decoded to ref %q, %v", req.Ref, err)
+	}
+}
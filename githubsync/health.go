@@ -0,0 +1,15 @@
+package githubsync
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// healthzHandler reports 503 until the startup sync has finished.
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.ready.Load() {
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,87 @@
+package githubsync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+const defaultHealthTimeout = 30 * time.Second
+
+// HealthCheck is checked after every deploy starts the service. The deploy
+// fails, and is rolled back, unless the check passes within Timeout.
+type HealthCheck struct {
+	// URL, if set, must answer a GET with a 2xx status.
+	URL string `json:"url"`
+	// Command, if set, is a shell command run in the workdir that must exit
+	// with status 0.
+	Command string `json:"command"`
+	// Timeout is how long the check is retried for, e.g. "1m". Defaults to
+	// 30s.
+	Timeout string `json:"timeout"`
+}
+
+// checkHealth retries the health check of repo every second until it
+// passes or its timeout runs out, returning the last failure.
+func checkHealth(ctx context.Context, path string, repo Repo, out io.Writer) error {
+	hc := repo.HealthCheck
+	timeout := defaultHealthTimeout
+	if hc.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(hc.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid health_check timeout: %s", err)
+		}
+	}
+	fmt.Fprintln(out, "Checking health of", repo.ID, "for up to", timeout)
+	deadline := time.Now().Add(timeout)
+	for {
+		err := healthCheckOnce(ctx, path, repo, out)
+		if err == nil {
+			fmt.Fprintln(out, repo.ID, "is healthy")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func healthCheckOnce(ctx context.Context, path string, repo Repo, out io.Writer) error {
+	hc := repo.HealthCheck
+	if hc.URL != "" {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, "GET", hc.URL, nil)
+		if err != nil {
+			return err
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("%s returned %d", hc.URL, res.StatusCode)
+		}
+	}
+	if hc.Command != "" {
+		cmd := exec.CommandContext(ctx, "bash", "-c", hc.Command)
+		cmd.Dir = repo.workdir(path)
+		cmd.Stdout = out
+		cmd.Stderr = out
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("%s: %s", hc.Command, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package githubsync
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// newTestServer returns a Server checking repos out in root, without
+// loading a config or talking to a forge.
+func newTestServer(t *testing.T, root string, repos map[string]Repo) *Server {
+	t.Helper()
+	s := &Server{
+		cfg:       Config{GitBinary: "git", Root: root, MaxBodyBytes: 1 << 20, SyncWorkers: 4},
+		statuses:  &StatusStore{},
+		history:   &History{},
+		logs:      &LogStore{Dir: root + "/logs"},
+		jobs:      &JobStore{},
+		metrics:   &Metrics{},
+		inflight:  NewDeployTracker(),
+		audit:     &AuditLog{},
+		approvals: &CommandApprovals{},
+		state:     &State{Repos: map[string]*RepoState{}},
+	}
+	s.repos.Store(&repos)
+	s.dispatcher = NewDispatcher(2, s.runJob)
+	return s
+}
+
+// sh runs script with bash in dir and returns its trimmed output.
+func sh(t *testing.T, dir, script string) string {
+	t.Helper()
+	cmd := exec.Command("bash", "-c", script)
+	cmd.Dir = dir
+	cmd.Env = append(cmd.Environ(),
+		"GIT_AUTHOR_NAME=a", "GIT_AUTHOR_EMAIL=a@example.com",
+		"GIT_COMMITTER_NAME=a", "GIT_COMMITTER_EMAIL=a@example.com")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %s\n%s", script, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newUpstream creates a repo with one empty commit on main in dir/name
+// and returns its path.
+func newUpstream(t *testing.T, dir, name string) string {
+	t.Helper()
+	sh(t, dir, "git init -q -b main "+name+" && git -C "+name+" commit -q --allow-empty -m one")
+	return dir + "/" + name
+}
+
+// fakeSystemctl puts a systemctl on PATH that reports units as loadState,
+// "loaded" or "not-found", and as needing a daemon-reload if reload is
+// "yes". It returns a func listing the invocations so far.
+func fakeSystemctl(t *testing.T, loadState, reload string) func() []string {
+	t.Helper()
+	dir := t.TempDir()
+	script := `#!/bin/sh
+echo "$@" >> ` + dir + `/calls
+case "$1" in
+show)
+	if [ "$2" = --property=LoadState ]; then
+		echo ` + loadState + `
+	else
+		echo NeedDaemonReload=` + reload + `
+		echo LoadState=` + loadState + `
+	fi
+	;;
+stop)
+	if [ ` + loadState + ` = not-found ]; then
+		echo "Failed to stop $2.service: Unit $2.service not loaded." >&2
+		exit 5
+	fi
+	;;
+esac
+`
+	err := os.WriteFile(dir+"/systemctl", []byte(script), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+	return func() []string {
+		b, err := os.ReadFile(dir + "/calls")
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSpace(string(b)), "\n")
+	}
+}
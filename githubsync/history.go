@@ -0,0 +1,166 @@
+package githubsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultHistorySize = 10
+	maxHistorySize     = 100
+	// maxHistoryRecords bounds the memory the history takes across repos.
+	maxHistoryRecords = 1000
+)
+
+// History keeps the records of the last deploys of each repo. At most
+// 1000 records are kept across repos, dropping the oldest deploys first.
+type History struct {
+	// Size is the number of records kept per repo. Defaults to 10 and is
+	// capped at 100.
+	Size  int
+	mu    sync.Mutex
+	rings map[string]*ring
+	total int
+}
+
+// ring is a fixed-size buffer of the latest records of one repo.
+type ring struct {
+	recs  []*AuditRecord
+	start int
+	n     int
+}
+
+// at returns the i-th oldest record in r.
+func (r *ring) at(i int) *AuditRecord {
+	return r.recs[(r.start+i)%len(r.recs)]
+}
+
+// dropOldest removes the oldest record from r.
+func (r *ring) dropOldest() {
+	r.recs[r.start] = nil
+	r.start = (r.start + 1) % len(r.recs)
+	r.n--
+}
+
+func (h *History) size() int {
+	if h.Size <= 0 {
+		return defaultHistorySize
+	}
+	return min(h.Size, maxHistorySize)
+}
+
+// Add records a deploy, dropping the oldest record of the repo if its
+// history is full, or the oldest record of any repo if the history as a
+// whole is.
+func (h *History) Add(rec *AuditRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rings == nil {
+		h.rings = map[string]*ring{}
+	}
+	r, ok := h.rings[rec.Repo]
+	if !ok {
+		r = &ring{recs: make([]*AuditRecord, h.size())}
+		h.rings[rec.Repo] = r
+	}
+	if r.n == len(r.recs) {
+		r.dropOldest()
+		h.total--
+	}
+	r.recs[(r.start+r.n)%len(r.recs)] = rec
+	r.n++
+	h.total++
+	for h.total > maxHistoryRecords {
+		h.dropOldest()
+	}
+}
+
+// dropOldest removes the oldest record across repos.
+func (h *History) dropOldest() {
+	var oldestKey string
+	var oldest *ring
+	for key, r := range h.rings {
+		if oldest == nil || r.at(0).Time.Before(oldest.at(0).Time) {
+			oldestKey, oldest = key, r
+		}
+	}
+	oldest.dropOldest()
+	h.total--
+	if oldest.n == 0 {
+		delete(h.rings, oldestKey)
+	}
+}
+
+// Get returns the records of key, newest first.
+func (h *History) Get(key string) []*AuditRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	recs := []*AuditRecord{}
+	r, ok := h.rings[key]
+	if !ok {
+		return recs
+	}
+	for i := r.n - 1; i >= 0; i-- {
+		recs = append(recs, r.at(i))
+	}
+	return recs
+}
+
+// historyHandler serves the recent deploys of the repo at /status/<key>
+// as a JSON array, newest first.
+func (s *Server) historyHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/status/")
+	if _, ok := s.config()[key]; !ok {
+		http.Error(w, fmt.Sprintf("repo %s not configured", key), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.history.Get(key))
+}
+
+// Load fills the history from recs, which are newest first, so that it
+// survives restarts.
+func (h *History) Load(recs []*AuditRecord) {
+	for i := len(recs) - 1; i >= 0; i-- {
+		h.Add(recs[i])
+	}
+}
+
+// deployRecords returns the deploys recorded in the history database or,
+// without one, the audit log, like AuditLog.Read.
+func (s *Server) deployRecords(repo string, limit int) ([]*AuditRecord, error) {
+	if s.historyDB != nil {
+		return s.historyDB.Read(repo, limit)
+	}
+	return s.audit.Read(repo, limit)
+}
+
+// auditHandler serves every deploy recorded in the history database or
+// the audit log at /history as a JSON array, newest first. The repo and
+// limit query parameters narrow it down.
+func (s *Server) auditHandler(w http.ResponseWriter, r *http.Request) {
+	if s.historyDB == nil && s.audit.Path == "" {
+		http.Error(w, "no history database or audit log configured", http.StatusNotFound)
+		return
+	}
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	recs, err := s.deployRecords(r.URL.Query().Get("repo"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recs)
+}
@@ -0,0 +1,108 @@
+package githubsync
+
+import (
+	"database/sql"
+	"log/slog"
+	"time"
+
+	// Pure Go, so the binary builds without cgo
+	_ "modernc.org/sqlite"
+)
+
+// HistoryDB records every deploy in a SQLite database. A nil HistoryDB
+// discards records.
+type HistoryDB struct {
+	db *sql.DB
+}
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS deploys (
+	id INTEGER PRIMARY KEY,
+	time TEXT NOT NULL,
+	end_time TEXT NOT NULL,
+	repo TEXT NOT NULL,
+	branch TEXT NOT NULL,
+	commit_sha TEXT NOT NULL,
+	pusher TEXT NOT NULL,
+	delivery TEXT NOT NULL,
+	result TEXT NOT NULL,
+	error TEXT NOT NULL,
+	duration REAL NOT NULL
+);
+CREATE INDEX IF NOT EXISTS deploys_repo ON deploys (repo, id);
+`
+
+// OpenHistoryDB opens the database at path, creating it if needed.
+func OpenHistoryDB(path string) (*HistoryDB, error) {
+	// Concurrent deploys wait for each other's writes instead of failing
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(historySchema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &HistoryDB{db}, nil
+}
+
+// Close closes the database.
+func (h *HistoryDB) Close() error {
+	if h == nil {
+		return nil
+	}
+	return h.db.Close()
+}
+
+// Record adds rec to the database.
+func (h *HistoryDB) Record(rec *AuditRecord) {
+	if h == nil {
+		return
+	}
+	_, err := h.db.Exec(`INSERT INTO deploys
+		(time, end_time, repo, branch, commit_sha, pusher, delivery, result, error, duration)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rec.Time.UTC().Format(time.RFC3339Nano), rec.End.UTC().Format(time.RFC3339Nano),
+		rec.Repo, rec.Branch, rec.Commit, rec.Pusher, rec.Delivery, rec.Result, rec.Error, rec.Duration)
+	if err != nil {
+		slog.Error("Writing history database failed", "err", err)
+	}
+}
+
+// Read returns the recorded deploys, newest first. If repo is set, only
+// its deploys are returned, and if limit is positive, at most limit
+// deploys.
+func (h *HistoryDB) Read(repo string, limit int) ([]*AuditRecord, error) {
+	recs := []*AuditRecord{}
+	if h == nil {
+		return recs, nil
+	}
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := h.db.Query(`SELECT time, end_time, repo, branch, commit_sha, pusher, delivery, result, error, duration
+		FROM deploys WHERE ? = '' OR repo = ? ORDER BY id DESC LIMIT ?`, repo, repo, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rec := &AuditRecord{}
+		var start, end string
+		err := rows.Scan(&start, &end, &rec.Repo, &rec.Branch, &rec.Commit, &rec.Pusher, &rec.Delivery, &rec.Result, &rec.Error, &rec.Duration)
+		if err != nil {
+			return nil, err
+		}
+		rec.Time, err = time.Parse(time.RFC3339Nano, start)
+		if err != nil {
+			return nil, err
+		}
+		rec.End, err = time.Parse(time.RFC3339Nano, end)
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, rows.Err()
+}
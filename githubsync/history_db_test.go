@@ -0,0 +1,59 @@
+package githubsync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistoryDB(t *testing.T) {
+	path := t.TempDir() + "/history.db"
+	db, err := OpenHistoryDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC)
+	for i, repo := range []string{"o/a", "o/b", "o/a"} {
+		db.Record(&AuditRecord{
+			Time:     start.Add(time.Duration(i) * time.Minute),
+			End:      start.Add(time.Duration(i)*time.Minute + time.Second),
+			Repo:     repo,
+			Branch:   "main",
+			Commit:   "c" + string(rune('0'+i)),
+			Pusher:   "p",
+			Delivery: "d",
+			Result:   "success",
+			Duration: 1,
+		})
+	}
+	db.Close()
+
+	// Records survive reopening
+	db, err = OpenHistoryDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	recs, err := db.Read("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 3 || recs[0].Commit != "c2" || recs[2].Commit != "c0" {
+		t.Fatalf("got %d records, want 3 newest first", len(recs))
+	}
+	if !recs[2].Time.Equal(start) || !recs[2].End.Equal(start.Add(time.Second)) {
+		t.Fatalf("times changed: %v %v", recs[2].Time, recs[2].End)
+	}
+	recs, err = db.Read("o/a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].Repo != "o/a" || recs[0].Commit != "c2" {
+		t.Fatalf("got %+v, want the last deploy of o/a", recs)
+	}
+
+	var none *HistoryDB
+	none.Record(&AuditRecord{})
+	if recs, err := none.Read("", 0); err != nil || len(recs) != 0 {
+		t.Fatalf("nil HistoryDB returned %v, %v", recs, err)
+	}
+}
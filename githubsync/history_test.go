@@ -0,0 +1,48 @@
+package githubsync
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	h := &History{Size: 3}
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := range 5 {
+		h.Add(&AuditRecord{Repo: "o/a", Commit: fmt.Sprint(i), Time: start.Add(time.Duration(i) * time.Minute)})
+	}
+	recs := h.Get("o/a")
+	if len(recs) != 3 || recs[0].Commit != "4" || recs[2].Commit != "2" {
+		t.Fatalf("got %d records starting at %s, want the last 3 newest first", len(recs), recs[0].Commit)
+	}
+	if got := h.Get("o/b"); len(got) != 0 {
+		t.Errorf("got %d records of a repo without deploys", len(got))
+	}
+}
+
+func TestHistoryTotal(t *testing.T) {
+	h := &History{Size: maxHistorySize}
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	repos := maxHistoryRecords/maxHistorySize + 5
+	for i := range maxHistorySize {
+		for r := range repos {
+			h.Add(&AuditRecord{
+				Repo:   fmt.Sprintf("o/%d", r),
+				Commit: fmt.Sprint(i),
+				Time:   start.Add(time.Duration(i*repos+r) * time.Second),
+			})
+		}
+	}
+	n := 0
+	for r := range repos {
+		recs := h.Get(fmt.Sprintf("o/%d", r))
+		n += len(recs)
+		if len(recs) > 0 && recs[0].Commit != fmt.Sprint(maxHistorySize-1) {
+			t.Errorf("newest record of o/%d is %s", r, recs[0].Commit)
+		}
+	}
+	if n != maxHistoryRecords {
+		t.Errorf("kept %d records, want %d", n, maxHistoryRecords)
+	}
+}
@@ -0,0 +1,241 @@
+package githubsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// registerHook makes sure repoID has an active hook for events delivering JSON
+// to webhookURL, signed with secret if set, and returns its id. A hook
+// still pointing at legacyURL is moved to webhookURL rather than adding a
+// second hook. api is the base URL of the GitHub API.
+func registerHook(api, ghToken, repoID, webhookURL, legacyURL string, events []string, secret string) (int64, error) {
+	// Get list of current hooks
+	apiURL := fmt.Sprintf("%s/repos/%s/hooks", api, repoID)
+	req, err := http.NewRequest("GET", apiURL, nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", ghToken))
+	res, err := githubClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return 0, githubError(res, repoID)
+	}
+	hooks := []Hook{}
+	err = json.NewDecoder(res.Body).Decode(&hooks)
+	if err != nil {
+		return 0, fmt.Errorf("decoding hooks of %s: %w", repoID, err)
+	}
+
+	// Return early if URL is already registered. GitHub doesn't reveal
+	// secrets, so hooks are updated whenever one is configured.
+	for _, hook := range hooks {
+		if sameURL(hook.Config.URL, webhookURL) && hook.Active && includesAll(hook.Events, events) && hook.Config.ContentType == "json" && secret == "" {
+			return hook.ID, nil
+		}
+	}
+
+	// Create the hook
+	body, err := json.Marshal(Hook{
+		Name:   "web",
+		Active: true,
+		Events: events,
+		Config: &HookConfig{
+			URL:         webhookURL,
+			ContentType: "json",
+			Secret:      secret,
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// Update a hook registered at the legacy URL or for fewer events instead
+	for _, hook := range hooks {
+		if sameURL(hook.Config.URL, webhookURL) {
+			slog.Info("Updating hook", "repo", repoID)
+			return hook.ID, updateHook(api, ghToken, repoID, hook.ID, body)
+		}
+		if legacyURL != "" && sameURL(hook.Config.URL, legacyURL) {
+			slog.Info("Moving hook", "repo", repoID, "from", legacyURL, "to", webhookURL)
+			return hook.ID, updateHook(api, ghToken, repoID, hook.ID, body)
+		}
+	}
+
+	req, err = http.NewRequest("POST", apiURL, bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", ghToken))
+	res, err = githubClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return 0, githubError(res, repoID)
+	}
+	created := &Hook{}
+	err = json.NewDecoder(res.Body).Decode(created)
+	if err != nil {
+		return 0, err
+	}
+
+	return created.ID, nil
+}
+
+// retryHook keeps trying to register the hook of repo with backoff until
+// it succeeds, then records it in the state and the status of every
+// branch of the repo. It gives up once repo is removed from the config.
+func (s *Server) retryHook(repo Repo, events []string) {
+	repoID := repo.ID
+	backoff := time.Minute
+	for {
+		time.Sleep(backoff)
+		if !s.hookWanted(repo) {
+			slog.Info("Not retrying hook of removed repo", "repo", repoID)
+			return
+		}
+		hookID, err := s.provider(repo.provider(), repo.Host).RegisterHook(repoID, repoHookURL(s.cfg.ExternalURL, repoID), s.cfg.ExternalURL, events, s.webhookSecret(repoID))
+		if err != nil {
+			backoff = min(2*backoff, 30*time.Minute)
+			slog.Error("Registering hook failed", "repo", repoID, "retry_in", backoff.String(), "err", err)
+			continue
+		}
+		slog.Info("Registered hook", "repo", repoID)
+
+		s.stateMu.Lock()
+		defer s.stateMu.Unlock()
+		for key, rs := range s.state.Repos {
+			if rs.RepoID == repoID {
+				rs.HookID = hookID
+				s.statuses.SetHook(key, true)
+			}
+		}
+		err = s.state.Save(s.cfg.StateFile)
+		if err != nil {
+			slog.Error("Saving state failed", "err", err)
+		}
+		return
+	}
+}
+
+// hookWanted reports whether repo is still the config repo or has an
+// entry in the config.
+func (s *Server) hookWanted(repo Repo) bool {
+	if s.cfg.ConfigRepo != "" && s.cfg.ConfigRepo == repo.ID {
+		return true
+	}
+	for _, r := range s.config() {
+		if r.ID == repo.ID && r.provider() == repo.provider() && r.Host == repo.Host {
+			return true
+		}
+	}
+	return false
+}
+
+func updateHook(api, ghToken, repoID string, hookID int64, body []byte) error {
+	apiURL := fmt.Sprintf("%s/repos/%s/hooks/%d", api, repoID, hookID)
+	req, err := http.NewRequest("PATCH", apiURL, bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", ghToken))
+	res, err := githubClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return githubError(res, repoID)
+	}
+	return nil
+}
+
+// repoHookURL returns the per-repo webhook URL of repoID under webhookURL.
+func repoHookURL(webhookURL, repoID string) string {
+	return strings.TrimSuffix(webhookURL, "/") + "/hooks/" + repoID
+}
+
+// normalizeURL lowercases the scheme and host of rawURL and drops its
+// default port and trailing slashes, so that URLs GitHub treats the same
+// compare equal. URLs that don't parse are returned as is.
+func normalizeURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if u.Scheme == "https" {
+		u.Host = strings.TrimSuffix(u.Host, ":443")
+	} else if u.Scheme == "http" {
+		u.Host = strings.TrimSuffix(u.Host, ":80")
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return u.String()
+}
+
+// sameURL reports whether a and b are the same URL once normalized.
+func sameURL(a, b string) bool {
+	return normalizeURL(a) == normalizeURL(b)
+}
+
+// checkExternalURL makes sure rawURL is an absolute https URL GitHub can
+// deliver hooks to and returns it normalized.
+func checkExternalURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("EXTERNAL_URL: %s", err)
+	}
+	if !strings.EqualFold(u.Scheme, "https") || u.Host == "" {
+		return "", fmt.Errorf("EXTERNAL_URL %q must be an absolute https URL", rawURL)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("EXTERNAL_URL %q must not have a query or fragment", rawURL)
+	}
+	return normalizeURL(rawURL), nil
+}
+
+func includesAll(list, items []string) bool {
+	for _, s := range items {
+		if !includes(list, s) {
+			return false
+		}
+	}
+	return true
+}
+
+func includes(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+type Hook struct {
+	ID     int64       `json:"id,omitempty"`
+	Name   string      `json:"name"`
+	Active bool        `json:"active"`
+	Events []string    `json:"events"`
+	Config *HookConfig `json:"config"`
+}
+
+type HookConfig struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+	Secret      string `json:"secret,omitempty"`
+}
@@ -0,0 +1,89 @@
+package githubsync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		url, want string
+	}{
+		{"https://example.com/hooks", "https://example.com/hooks"},
+		{"https://example.com/hooks/", "https://example.com/hooks"},
+		{"https://example.com/hooks///", "https://example.com/hooks"},
+		{"https://example.com/", "https://example.com"},
+		{"https://example.com", "https://example.com"},
+		{"HTTPS://Example.COM/Hooks", "https://example.com/Hooks"},
+		{"https://example.com:443/hooks", "https://example.com/hooks"},
+		{"http://example.com:80/hooks", "http://example.com/hooks"},
+		{"https://example.com:80/hooks", "https://example.com:80/hooks"},
+		{"https://example.com:8443/hooks", "https://example.com:8443/hooks"},
+		{"http://example.com/hooks", "http://example.com/hooks"},
+		{"https://example.com/hooks?a=1", "https://example.com/hooks?a=1"},
+		{"://bad", "://bad"},
+	}
+	for _, tt := range tests {
+		if got := normalizeURL(tt.url); got != tt.want {
+			t.Errorf("normalizeURL(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+	if sameURL("https://example.com/hooks", "http://example.com/hooks") {
+		t.Error("http and https URLs compare equal")
+	}
+}
+
+func TestCheckExternalURL(t *testing.T) {
+	tests := []struct {
+		url, want string
+		ok        bool
+	}{
+		{"https://example.com/", "https://example.com", true},
+		{"HTTPS://Example.com:443/sync/", "https://example.com/sync", true},
+		{"http://example.com", "", false},
+		{"example.com", "", false},
+		{"/hooks", "", false},
+		{"https://", "", false},
+		{"https://example.com/?token=1", "", false},
+		{"https://example.com/#top", "", false},
+		{"https://exa mple.com", "", false},
+	}
+	for _, tt := range tests {
+		got, err := checkExternalURL(tt.url)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("checkExternalURL(%q) = %q, %v", tt.url, got, err)
+		}
+	}
+}
+
+func TestRegisterHookBadResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>oops</html>"))
+	}))
+	defer srv.Close()
+	_, err := registerHook(srv.URL, "token", "o/app", "https://example.com/hooks/o/app", "", []string{"push"}, "")
+	if err == nil || !strings.Contains(err.Error(), "decoding hooks of o/app") {
+		t.Fatalf("registerHook() = %v, want a decoding error", err)
+	}
+}
+
+func TestHookWanted(t *testing.T) {
+	repo := Repo{ID: "o/app"}
+	s := newTestServer(t, t.TempDir(), map[string]Repo{"o/app@main": repo})
+	if !s.hookWanted(repo) {
+		t.Error("hook of configured repo not wanted")
+	}
+	if s.hookWanted(Repo{ID: "o/app", Provider: providerGitLab}) {
+		t.Error("hook of same ID on another provider wanted")
+	}
+	s.repos.Store(&map[string]Repo{})
+	if s.hookWanted(repo) {
+		t.Error("hook of removed repo wanted")
+	}
+	s.cfg.ConfigRepo = "o/app"
+	if !s.hookWanted(repo) {
+		t.Error("hook of config repo not wanted")
+	}
+}
@@ -0,0 +1,161 @@
+package githubsync
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// maxJobs is the number of jobs JobStore remembers.
+const maxJobs = 1000
+
+// Job states reported at /jobs/<id>.
+const (
+	jobQueued     = "queued"
+	jobRunning    = "running"
+	jobSucceeded  = "succeeded"
+	jobFailed     = "failed"
+	jobSuperseded = "superseded"
+)
+
+// JobInfo is what /jobs/<id> reports about a job.
+type JobInfo struct {
+	ID    string `json:"id"`
+	Repo  string `json:"repo"`
+	State string `json:"state"`
+	// SupersededBy is the job a waiting job was replaced with.
+	SupersededBy string        `json:"superseded_by,omitempty"`
+	Status       *DeployStatus `json:"status"`
+	// Output is the output of the deploy so far.
+	Output string `json:"output"`
+}
+
+// jobEntry is a job known to a JobStore.
+type jobEntry struct {
+	job          *Job
+	state        string
+	supersededBy string
+	log          *DeployLog
+}
+
+// JobStore keeps the state of the last jobs queued, by id.
+type JobStore struct {
+	mu    sync.Mutex
+	jobs  map[string]*jobEntry
+	order []string
+}
+
+// Add assigns job an id and records it as queued, forgetting the oldest
+// job if the store is full.
+func (s *JobStore) Add(job *Job) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	job.ID = hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.jobs == nil {
+		s.jobs = map[string]*jobEntry{}
+	}
+	s.jobs[job.ID] = &jobEntry{job: job, state: jobQueued}
+	s.order = append(s.order, job.ID)
+	if len(s.order) > maxJobs {
+		delete(s.jobs, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// Remove forgets job, e.g. because it couldn't be queued.
+func (s *JobStore) Remove(job *Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, job.ID)
+	for i, id := range s.order {
+		if id == job.ID {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Start records that job is running and writes its output to log.
+func (s *JobStore) Start(job *Job, log *DeployLog) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.jobs[job.ID]; ok {
+		e.state = jobRunning
+		e.log = log
+	}
+}
+
+// Finish records the result of job.
+func (s *JobStore) Finish(job *Job, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.jobs[job.ID]; ok {
+		e.state = jobSucceeded
+		if err != nil {
+			e.state = jobFailed
+		}
+	}
+}
+
+// Update applies update to the status of job while holding the store's
+// lock, so that /jobs/<id> never sees a status half written. Once job is
+// queued, its status must only be changed through Update.
+func (s *JobStore) Update(job *Job, update func(*DeployStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(job.Status)
+}
+
+// Supersede records that the waiting job old was replaced by job, which
+// deploys the pushes of both.
+func (s *JobStore) Supersede(old, job *Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.Status.Coalesced = old.Status.Coalesced + 1
+	if e, ok := s.jobs[old.ID]; ok {
+		e.state = jobSuperseded
+		e.supersededBy = job.ID
+	}
+}
+
+// Get returns the state of the job with the given id, or nil. Its status
+// is a copy.
+func (s *JobStore) Get(id string) *JobInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.jobs[id]
+	if !ok {
+		return nil
+	}
+	status := *e.job.Status
+	info := &JobInfo{
+		ID:           id,
+		Repo:         e.job.Key,
+		State:        e.state,
+		SupersededBy: e.supersededBy,
+		Status:       &status,
+	}
+	if e.log != nil {
+		info.Output = e.log.String()
+	}
+	return info
+}
+
+// ServeHTTP reports the job at /jobs/<id> as JSON.
+func (s *JobStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	info := s.Get(id)
+	if info == nil {
+		http.Error(w, fmt.Sprintf("job %s not found", id), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,105 @@
+package githubsync
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestJobStatusWhileRunning reads /jobs/<id> while the job runs, for the
+// race detector to check that status updates are synchronized.
+func TestJobStatusWhileRunning(t *testing.T) {
+	dir := t.TempDir()
+	up := newUpstream(t, dir, "up")
+	repo := Repo{ID: "o/app", Branch: "main", FetchURL: up, Install: "true"}
+	s := newTestServer(t, dir, map[string]Repo{"o/app": repo})
+	err := s.syncRepo(context.Background(), s.repoPath("o/app", repo), repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh(t, up, "git commit -q --allow-empty -m two")
+
+	job, err := s.manualJob(context.Background(), "o/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.done = make(chan error, 1)
+	s.jobs.Add(job)
+	s.dispatcher.EnqueueNow(job)
+	for {
+		w := httptest.NewRecorder()
+		s.jobs.ServeHTTP(w, httptest.NewRequest("GET", "/jobs/"+job.ID, nil))
+		if w.Code != 200 {
+			t.Fatalf("got %d %s", w.Code, w.Body)
+		}
+		select {
+		case err := <-job.done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info := s.jobs.Get(job.ID); info.State != jobSucceeded || info.Status.Duration == 0 {
+				t.Fatalf("got %+v", info)
+			}
+			return
+		default:
+		}
+	}
+}
+
+// TestJobCoalescedWhileQueued reads /jobs/<id> while pushes are folded
+// into the queued job, for the race detector to check that counting them
+// goes through the store.
+func TestJobCoalescedWhileQueued(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), map[string]Repo{})
+	s.dispatcher.Superseded = s.jobs.Supersede
+	s.dispatcher.Hold()
+	repos := map[string]Repo{"debounced": {Debounce: "1h"}, "queued": {}}
+	for key, repo := range repos {
+		jobs := []*Job{}
+		for range 3 {
+			job := &Job{Key: key, Repo: repo, Status: &DeployStatus{}}
+			s.jobs.Add(job)
+			jobs = append(jobs, job)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for _, job := range jobs {
+				w := httptest.NewRecorder()
+				s.jobs.ServeHTTP(w, httptest.NewRequest("GET", "/jobs/"+job.ID, nil))
+			}
+		}()
+		_, err := s.dispatcher.Enqueue(jobs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		if info := s.jobs.Get(jobs[2].ID); info.Status.Coalesced != 2 {
+			t.Errorf("%s: last job folds in %d pushes, want 2", key, info.Status.Coalesced)
+		}
+		if info := s.jobs.Get(jobs[0].ID); info.State != jobSuperseded || info.SupersededBy != jobs[1].ID {
+			t.Errorf("%s: first job is %s, superseded by %s", key, info.State, info.SupersededBy)
+		}
+	}
+}
+
+func TestDeployOnceRecordsJob(t *testing.T) {
+	dir := t.TempDir()
+	up := newUpstream(t, dir, "up")
+	repo := Repo{ID: "o/app", Branch: "main", FetchURL: up}
+	s := newTestServer(t, dir, map[string]Repo{"o/app": repo})
+	err := s.syncRepo(context.Background(), s.repoPath("o/app", repo), repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.DeployOnce(context.Background(), "o/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.jobs.order) != 1 {
+		t.Fatalf("recorded %d jobs, want 1", len(s.jobs.order))
+	}
+	if info := s.jobs.Get(s.jobs.order[0]); info == nil || info.Repo != "o/app" || info.State != jobSucceeded {
+		t.Fatalf("got %+v", info)
+	}
+}
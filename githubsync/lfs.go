@@ -0,0 +1,32 @@
+package githubsync
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+)
+
+// usesLFS reports whether the repo checked out at path stores files in Git
+// LFS: whether repo.LFS is set or its root .gitattributes has LFS filters.
+func usesLFS(path string, repo Repo) bool {
+	if repo.LFS {
+		return true
+	}
+	attrs, err := os.ReadFile(filepath.Join(path, ".gitattributes"))
+	return err == nil && bytes.Contains(attrs, []byte("filter=lfs"))
+}
+
+// pullLFS replaces the LFS pointer files of the commit checked out at path
+// with their content if the repo uses LFS, installing the LFS hooks and
+// filters into the checkout first so that later checkouts smudge them too.
+func (s *Server) pullLFS(ctx context.Context, path string, repo Repo) error {
+	if !usesLFS(path, repo) {
+		return nil
+	}
+	err := s.git(ctx, path, "lfs", "install", "--local")
+	if err != nil {
+		return err
+	}
+	return s.git(ctx, path, "lfs", "pull", repo.remote())
+}
@@ -0,0 +1,101 @@
+package githubsync
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// lockPath returns the lock file of the checkout at path.
+func lockPath(path string) string {
+	return path + ".lock"
+}
+
+// lockCheckout takes an exclusive flock on the lock file of the checkout
+// at path, so that two instances never deploy the same checkout. If
+// another process holds the lock, it is retried for up to wait before
+// giving up.
+func lockCheckout(path string, wait time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(lockPath(path), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(wait)
+	for attempt := 0; ; attempt++ {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("%s is locked by another github-sync instance, stop it first", path)
+		}
+		if attempt == 0 {
+			slog.Info("Waiting for lock held by another github-sync instance", "lock", lockPath(path))
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// lock takes the lock of path, the checkout of the repo with the given
+// key, unless this Server already holds it. Locks are held until Drain.
+func (s *Server) lock(key, path string) error {
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+	if _, ok := s.locks[key]; ok {
+		return nil
+	}
+	f, err := lockCheckout(path, s.cfg.LockWait)
+	if err != nil {
+		return err
+	}
+	if s.locks == nil {
+		s.locks = map[string]*os.File{}
+	}
+	s.locks[key] = f
+	return nil
+}
+
+// repoMutex returns the mutex serializing deploys, git maintenance and
+// watchdog restarts of the repo with the given key within this process.
+func (s *Server) repoMutex(key string) *sync.Mutex {
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+	if s.repoMus == nil {
+		s.repoMus = map[string]*sync.Mutex{}
+	}
+	mu, ok := s.repoMus[key]
+	if !ok {
+		mu = &sync.Mutex{}
+		s.repoMus[key] = mu
+	}
+	return mu
+}
+
+// unlock releases the checkout lock of the repo with the given key.
+func (s *Server) unlock(key string) {
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+	if f, ok := s.locks[key]; ok {
+		f.Close()
+		delete(s.locks, key)
+	}
+}
+
+// unlockAll releases the checkout locks.
+func (s *Server) unlockAll() {
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+	for key, f := range s.locks {
+		f.Close()
+		delete(s.locks, key)
+	}
+}
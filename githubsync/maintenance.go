@@ -0,0 +1,54 @@
+package githubsync
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"time"
+)
+
+// maintenanceLoop periodically runs `git gc --auto` on every repo that
+// isn't currently being deployed.
+func (s *Server) maintenanceLoop(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		for id, repo := range s.config() {
+			if repo.Mode == "release" || !repo.enabled() {
+				continue
+			}
+			mu := s.repoMutex(id)
+			if !mu.TryLock() {
+				slog.Debug("Skipping git maintenance while deploying", "repo", id)
+				continue
+			}
+			path := repo.checkout(s.repoPath(id, repo))
+			before := dirSize(filepath.Join(path, ".git"))
+			err := s.git(context.Background(), path, "gc", "--auto", "--quiet")
+			mu.Unlock()
+			if err != nil {
+				slog.Error("Git maintenance failed", "repo", id, "err", err)
+				continue
+			}
+			after := dirSize(filepath.Join(path, ".git"))
+			slog.Debug("Git maintenance finished", "repo", id, "bytes_before", before, "bytes_after", after)
+		}
+	}
+}
+
+// dirSize returns the total size of the files under path.
+func dirSize(path string) int64 {
+	var size int64
+	filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			if fi, err := d.Info(); err == nil {
+				size += fi.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,65 @@
+package githubsync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// deployHandler queues a deploy of the repo at /deploy/<key>, so that CI
+// pipelines and operators can deploy without a push. It deploys the full
+// commit SHA in the sha query parameter, or else the branch's tip, and
+// records the requester named by the by query parameter in its status.
+// dry_run lists the commands the deploy would run instead of queuing it.
+func (s *Server) deployHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/deploy/")
+	if _, ok := s.config()[key]; !ok {
+		http.Error(w, fmt.Sprintf("repo %s not configured", key), http.StatusNotFound)
+		return
+	}
+	// The deploy outlives the request
+	job, err := s.manualJob(context.Background(), key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if sha := r.URL.Query().Get("sha"); sha != "" {
+		if job.Repo.Mode == "release" || job.Repo.deploysTags() {
+			http.Error(w, "sha can't be set for repos deployed from releases or tags", http.StatusBadRequest)
+			return
+		}
+		if !isSHA(sha) {
+			http.Error(w, fmt.Sprintf("%q is not a full commit SHA", sha), http.StatusBadRequest)
+			return
+		}
+		job.Status.SHA = sha
+	}
+	job.Status.Pusher = r.URL.Query().Get("by")
+	if job.Status.Pusher == "" {
+		job.Status.Pusher = "api"
+	}
+	if isDryRun(r) {
+		s.writePlan(r.Context(), w, []*Job{job})
+		return
+	}
+	s.enqueue(w, []*Job{job})
+}
+
+// isSHA reports whether s is a full hex commit SHA, which is all that may
+// be passed on to git from a request.
+func isSHA(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,193 @@
+package githubsync
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the histograms.
+var durationBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// Metrics are the counters and histograms served at /metrics in the
+// Prometheus text format. Series are keyed by their rendered labels.
+type Metrics struct {
+	Deploys         CounterVec
+	DeployDuration  HistogramVec
+	PullDuration    HistogramVec
+	InstallDuration HistogramVec
+	Deliveries      CounterVec
+	Rejected        CounterVec
+}
+
+// githubAPICalls counts the requests made to GitHub. It lives outside
+// Metrics since the GitHub API helpers don't belong to a Server.
+var githubAPICalls CounterVec
+
+// githubClient is the client every request to GitHub is made with.
+var githubClient = &http.Client{Transport: countingTransport{http.DefaultTransport}}
+
+// countingTransport counts requests in githubAPICalls by method and status.
+type countingTransport struct {
+	next http.RoundTripper
+}
+
+func (t countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(res.StatusCode)
+	}
+	githubAPICalls.Inc(labels("method", req.Method, "code", code))
+	return res, err
+}
+
+// labels renders label pairs, e.g. labels("repo", "a/b") is repo="a/b".
+func labels(kv ...string) string {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := []string{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, kv[i], escape.Replace(kv[i+1])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// CounterVec is a counter per set of labels.
+type CounterVec struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// Inc adds one to the counter of the labels.
+func (c *CounterVec) Inc(labels string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = map[string]float64{}
+	}
+	c.values[labels]++
+}
+
+func (c *CounterVec) write(w io.Writer, name, help string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, l := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s} %g\n", name, l, c.values[l])
+	}
+}
+
+// HistogramVec is a histogram of durations per set of labels.
+type HistogramVec struct {
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Observe records a duration in the histogram of the labels.
+func (h *HistogramVec) Observe(labels string, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.series == nil {
+		h.series = map[string]*histogram{}
+	}
+	s, ok := h.series[labels]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(durationBuckets))}
+		h.series[labels] = s
+	}
+	v := d.Seconds()
+	for i, le := range durationBuckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *HistogramVec) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, l := range sortedKeys(h.series) {
+		s := h.series[l]
+		for i, le := range durationBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, l, le, s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, l, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, l, s.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, l, s.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricsHandler serves the metrics at /metrics.
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := s.metrics
+	m.Deploys.write(w, "github_sync_deploys_total", "Deploys by repo and result.")
+	m.DeployDuration.write(w, "github_sync_deploy_duration_seconds", "Duration of deploys by repo.")
+	m.PullDuration.write(w, "github_sync_git_pull_duration_seconds", "Duration of git pulls by repo.")
+	m.InstallDuration.write(w, "github_sync_install_duration_seconds", "Duration of install commands by repo.")
+	m.Deliveries.write(w, "github_sync_webhook_deliveries_total", "Webhook deliveries received by event and response code.")
+	m.Rejected.write(w, "github_sync_webhook_rejected_total", "Webhook deliveries rejected by response code.")
+	githubAPICalls.write(w, "github_sync_github_api_calls_total", "Requests to GitHub by method and response code.")
+	stats := s.dispatcher.Stats()
+	fmt.Fprintf(w, "# HELP github_sync_queue_depth Deploys queued, running or debounced.\n# TYPE github_sync_queue_depth gauge\ngithub_sync_queue_depth %d\n", stats.Depth)
+	fmt.Fprintf(w, "# HELP github_sync_queue_rejected_total Deliveries rejected because the deploy queue was full.\n# TYPE github_sync_queue_rejected_total counter\ngithub_sync_queue_rejected_total %d\n", stats.Rejected)
+}
+
+// statusRecorder captures the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// countDeliveries counts the webhook deliveries handled by next.
+func (s *Server) countDeliveries(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		code := strconv.Itoa(rec.code)
+		s.metrics.Deliveries.Inc(labels("event", r.Header.Get("X-GitHub-Event"), "code", code))
+		if rec.code >= 400 {
+			s.metrics.Rejected.Inc(labels("code", code))
+		}
+	}
+}
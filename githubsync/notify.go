@@ -0,0 +1,132 @@
+package githubsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// The lifecycle events of a deploy that are notified.
+const (
+	EventQueued     = "queued"
+	EventStarted    = "started"
+	EventSucceeded  = "succeeded"
+	EventFailed     = "failed"
+	EventRolledBack = "rolled_back"
+)
+
+// notifyClient posts notifications. The timeout keeps a slow receiver from
+// piling up goroutines.
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// rolledBackError is joined to the error of a deploy that failed, e.g. its
+// health check, and was rolled back to the commit or release to.
+type rolledBackError struct {
+	to string
+}
+
+func (e *rolledBackError) Error() string {
+	return "rolled back to " + e.to
+}
+
+// finishedEvent returns the event j's deploy finished with, given the
+// error it failed with.
+func finishedEvent(j *Job, err error) string {
+	var rolledBack *rolledBackError
+	switch {
+	case j.Status.Fallback != "", errors.As(err, &rolledBack):
+		return EventRolledBack
+	case err != nil:
+		return EventFailed
+	case j.Rollback:
+		return EventRolledBack
+	default:
+		return EventSucceeded
+	}
+}
+
+// DeployEvent is the JSON body posted to the notification webhooks.
+type DeployEvent struct {
+	Event   string    `json:"event"`
+	Job     string    `json:"job"`
+	Repo    string    `json:"repo"`
+	Branch  string    `json:"branch"`
+	SHA     string    `json:"sha"`
+	Pusher  string    `json:"pusher"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+	// Duration is how long the deploy took in seconds, once finished.
+	Duration float64 `json:"duration,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	// Fallback is the fallback ref that was deployed instead, if any.
+	Fallback string `json:"fallback,omitempty"`
+	// Dirty is what was done with local changes found in the checkout,
+	// stashed or discarded, if any.
+	Dirty string `json:"dirty,omitempty"`
+}
+
+// notify reports event of j's deploy to Slack, the notification webhooks,
+// as a commit status and as a GitHub deployment. err is the error the
+// deploy failed with. Notifications are posted in the background so that
+// they can't hold up deploys.
+func (s *Server) notify(j *Job, event string, err error) {
+	branch := s.repoBranch(j.Key, j.Repo)
+	s.notifySlack(j, branch, event, err)
+	s.setCommitStatus(j, event)
+	s.reportDeployment(j, branch, event)
+
+	hooks := slices.Concat(s.cfg.NotifyWebhooks, j.Repo.NotifyWebhooks)
+	if len(hooks) == 0 {
+		return
+	}
+	ev := &DeployEvent{
+		Event:    event,
+		Job:      j.ID,
+		Repo:     j.Key,
+		Branch:   branch,
+		SHA:      j.Status.SHA,
+		Pusher:   j.Status.Pusher,
+		Message:  j.Status.Message,
+		Time:     time.Now(),
+		Duration: j.Status.Duration.Seconds(),
+		Fallback: j.Status.Fallback,
+		Dirty:    j.Status.Dirty,
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	for _, hook := range hooks {
+		go func() {
+			err := postJSON(hook, ev)
+			if err != nil {
+				slog.Error("Posting notification failed", "repo", j.Key, "event", event, "err", err)
+			}
+		}()
+	}
+}
+
+// postJSON posts v as JSON to webhookURL, which has to answer with a 2xx.
+func postJSON(webhookURL string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	res, err := notifyClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if urlErr, ok := err.(*url.Error); ok {
+		// Don't log the webhook URL, which may hold a secret
+		return urlErr.Err
+	} else if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook: %s", res.Status)
+	}
+	return nil
+}
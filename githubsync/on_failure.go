@@ -0,0 +1,66 @@
+package githubsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// onFailureTimeout bounds how long the on_failure command may hold up
+// the deploy queue of its repo.
+const onFailureTimeout = 5 * time.Minute
+
+// onFailure runs the on_failure command of j's repo after its deploy
+// failed with err. It runs even if the deploy was cancelled, and its own
+// failure is only logged.
+func (s *Server) onFailure(ctx context.Context, j *Job, err error, out io.Writer) {
+	if checkErr := s.approvals.Check(j.Repo.OnFailure); checkErr != nil {
+		fmt.Fprintln(out, "Not running on_failure:", checkErr)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), onFailureTimeout)
+	defer cancel()
+
+	step := ""
+	var deployErr *DeployError
+	if errors.As(err, &deployErr) {
+		step = deployErr.Step
+	}
+	branch := s.repoBranch(j.Key, j.Repo)
+
+	fmt.Fprintf(out, "WARNING: running on_failure shell command in %s:\n%s\n", j.Path, j.Repo.OnFailure)
+	cmd := exec.CommandContext(ctx, "bash", "-c", j.Repo.OnFailure)
+	cmd.Dir = j.Path
+	cmd.Env = append(os.Environ(),
+		"GITHUB_SYNC_REPO="+j.Key,
+		"GITHUB_SYNC_BRANCH="+branch,
+		"GITHUB_SYNC_SHA="+j.Status.SHA,
+		"GITHUB_SYNC_STEP="+step,
+		"GITHUB_SYNC_ERROR="+err.Error(),
+	)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	runErr := cmd.Run()
+	if runErr != nil {
+		fmt.Fprintf(out, "Error running on_failure of %s: %s\n", j.Key, runErr)
+	}
+}
+
+// repoBranch returns the branch the entry key deploys: repo.Branch or, for
+// entries tracking the default branch, the branch recorded by the last
+// sync.
+func (s *Server) repoBranch(key string, repo Repo) string {
+	if repo.Branch != "" {
+		return repo.Branch
+	}
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if rs, ok := s.state.Repos[key]; ok {
+		return rs.Branch
+	}
+	return ""
+}
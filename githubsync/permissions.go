@@ -0,0 +1,64 @@
+package githubsync
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+)
+
+// Permissions configures the ownership and mode fixup of a checkout after
+// it was pulled and installed, so a service running as another user can
+// write to it.
+type Permissions struct {
+	// Chown is the user:group the checkout is chowned to. Defaults to
+	// Service.User and its primary group.
+	Chown string `json:"chown"`
+	// Chmod, if set, is a chmod mode applied to the whole checkout, e.g.
+	// "u+rwX,g+rX".
+	Chmod string `json:"chmod"`
+}
+
+// fixPermissions applies repo.Permissions to the checkout at path,
+// logging how many files each command changed.
+func fixPermissions(ctx context.Context, path string, repo Repo) error {
+	if repo.Permissions == nil {
+		return nil
+	}
+	// Follow the symlink of release-mode repos
+	target := path + "/."
+
+	owner := repo.Permissions.Chown
+	if owner == "" && repo.Service != nil && repo.Service.User != "" {
+		owner = repo.Service.User + ":"
+	}
+	if owner != "" {
+		err := runChanges(ctx, "chown", "-R", "-c", owner, target)
+		if err != nil {
+			return err
+		}
+	}
+	if repo.Permissions.Chmod != "" {
+		err := runChanges(ctx, "chmod", "-R", "-c", repo.Permissions.Chmod, target)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runChanges runs a chown or chmod with -c, which reports every file it
+// changed, and logs the number of changes.
+func runChanges(ctx context.Context, name string, args ...string) error {
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	changes := strings.Count(string(out), "\n")
+	slog.Info("Fixed permissions", "cmd", name+" "+strings.Join(args, " "), "changed", changes)
+	if changes > 0 {
+		slog.Debug("Permission changes", "cmd", name, "output", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
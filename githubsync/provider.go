@@ -0,0 +1,216 @@
+package githubsync
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Providers repos can be hosted on, the values of Repo.Provider.
+const (
+	providerGitHub    = "github"
+	providerGitLab    = "gitlab"
+	providerGitea     = "gitea"
+	providerBitbucket = "bitbucket"
+)
+
+// A Provider is the API of the forge hosting a repo, which hooks are
+// registered with and which delivers its pushes.
+type Provider interface {
+	// RegisterHook makes sure repoID has an active hook for events
+	// delivering JSON to webhookURL, authenticated with secret if set, and
+	// returns its id. A hook still pointing at legacyURL is moved to
+	// webhookURL rather than adding a second hook.
+	RegisterHook(repoID, webhookURL, legacyURL string, events []string, secret string) (int64, error)
+	// DeleteHook deletes hook hookID of repoID. A hook that is already
+	// gone is not an error.
+	DeleteHook(repoID string, hookID int64) error
+	// DecodeWebhook parses the delivery r, whose body is body.
+	DecodeWebhook(r *http.Request, body []byte) (*WebhookRequest, error)
+	// VerifyWebhook checks that the delivery r was authenticated with
+	// secret.
+	VerifyWebhook(r *http.Request, body []byte, secret string) error
+}
+
+// provider returns the Provider named name, talking to the instance at
+// host, a base URL like https://gitlab.example.com, or to the public one
+// if host is empty.
+func (s *Server) provider(name, host string) Provider {
+	switch name {
+	case providerGitLab:
+		if host == "" {
+			host = gitlabURL
+		}
+		return &gitlabProvider{token: s.cfg.GitLabToken, baseURL: host}
+	case providerGitea:
+		return &giteaProvider{token: s.cfg.GiteaToken, baseURL: host}
+	case providerBitbucket:
+		return &bitbucketProvider{username: s.cfg.BitbucketUsername, password: s.cfg.BitbucketAppPassword, baseURL: bitbucketAPI}
+	default:
+		return &githubProvider{token: s.tokenSource, apiURL: githubAPIURL(host)}
+	}
+}
+
+// githubAPIURL returns the base URL of the API of the GitHub instance at
+// host: api.github.com for github.com or an empty host, and /api/v3 of
+// GitHub Enterprise Server instances.
+func githubAPIURL(host string) string {
+	if host == "" || sameURL(host, "https://github.com") {
+		return "https://api.github.com"
+	}
+	return strings.TrimSuffix(host, "/") + "/api/v3"
+}
+
+// deliveryProvider returns the name of the provider that sent r. Gitea
+// also sends GitHub's headers, so it has to be checked for first.
+func deliveryProvider(r *http.Request) string {
+	if r.Header.Get("X-Gitlab-Event") != "" {
+		return providerGitLab
+	}
+	if giteaEvent(r) != "" {
+		return providerGitea
+	}
+	if r.Header.Get("X-Event-Key") != "" {
+		return providerBitbucket
+	}
+	return providerGitHub
+}
+
+// deliveryID returns the id the provider gave the delivery r, if any.
+func deliveryID(r *http.Request) string {
+	if id := r.Header.Get("X-GitHub-Delivery"); id != "" {
+		return id
+	}
+	if id := r.Header.Get("X-Gitea-Delivery"); id != "" {
+		return id
+	}
+	if id := r.Header.Get("X-Request-UUID"); id != "" {
+		return id
+	}
+	return r.Header.Get("X-Gitlab-Event-UUID")
+}
+
+// checkProvider makes sure repo is hosted on a known provider, at a valid
+// host, and uses no features its provider lacks.
+func checkProvider(repo Repo) error {
+	switch repo.provider() {
+	case providerGitHub:
+	case providerBitbucket:
+		if repo.Host != "" {
+			return fmt.Errorf("%s: host is not supported for Bitbucket repos", repo.ID)
+		}
+	case providerGitLab, providerGitea:
+		if repo.provider() == providerGitea && repo.Host == "" {
+			return fmt.Errorf("%s: Gitea repos need a host", repo.ID)
+		}
+	default:
+		return fmt.Errorf("%s: unknown provider %q", repo.ID, repo.Provider)
+	}
+	if repo.provider() != providerGitHub && repo.DeployKey {
+		return fmt.Errorf("%s: deploy_key is only supported for GitHub repos", repo.ID)
+	}
+	if repo.DeployKey && !repo.SSH {
+		return fmt.Errorf("%s: deploy_key requires ssh", repo.ID)
+	}
+	if repo.SSH && repo.Mode == "release" {
+		return fmt.Errorf("%s: ssh is not supported with mode release", repo.ID)
+	}
+	if repo.provider() != providerGitHub && repo.Mode == "release" {
+		return fmt.Errorf("%s: mode release is only supported for GitHub repos", repo.ID)
+	}
+	if repo.ReleaseAsset != "" && repo.Mode != "release" {
+		return fmt.Errorf("%s: release_asset requires mode release", repo.ID)
+	}
+	if repo.ReleaseAsset != "" && repo.Install != "" {
+		return fmt.Errorf("%s: release_asset deploys prebuilt builds, install can't be set", repo.ID)
+	}
+	if _, err := path.Match(repo.ReleaseAsset, ""); err != nil {
+		return fmt.Errorf("%s: release_asset: %s", repo.ID, err)
+	}
+	if repo.provider() != providerGitHub && repo.RequireCI {
+		return fmt.Errorf("%s: require_ci is only supported for GitHub repos", repo.ID)
+	}
+	if repo.RequireCI && repo.Mode == "release" {
+		return fmt.Errorf("%s: require_ci can't be used with mode release", repo.ID)
+	}
+	switch repo.DeployOn {
+	case "", "push", "tag":
+	case "release":
+		if repo.provider() != providerGitHub {
+			return fmt.Errorf("%s: deploy_on release is only supported for GitHub repos", repo.ID)
+		}
+	default:
+		return fmt.Errorf("%s: unknown deploy_on %q", repo.ID, repo.DeployOn)
+	}
+	if repo.deploysTags() && (repo.Mode != "" || repo.RequireCI) {
+		return fmt.Errorf("%s: deploy_on %s can't be used with mode or require_ci", repo.ID, repo.DeployOn)
+	}
+	if repo.TagPattern != "" && !repo.deploysTags() {
+		return fmt.Errorf("%s: tag_pattern requires deploy_on tag or release", repo.ID)
+	}
+	if _, err := path.Match(repo.TagPattern, ""); err != nil {
+		return fmt.Errorf("%s: tag_pattern: %s", repo.ID, err)
+	}
+	if len(repo.CIWorkflows) > 0 && !repo.RequireCI {
+		return fmt.Errorf("%s: ci_workflows requires require_ci", repo.ID)
+	}
+	if len(repo.AllowedKeys) > 0 && !repo.RequireSigned {
+		return fmt.Errorf("%s: allowed_keys requires require_signed", repo.ID)
+	}
+	switch repo.OnDirty {
+	case "", "fail", "stash", "discard":
+	default:
+		return fmt.Errorf("%s: unknown on_dirty %q", repo.ID, repo.OnDirty)
+	}
+	switch repo.Sync {
+	case "", "merge":
+		if repo.Clean {
+			return fmt.Errorf("%s: clean requires sync reset", repo.ID)
+		}
+	case "reset":
+		if repo.OnDiverge != "" {
+			return fmt.Errorf("%s: on_diverge can't be used with sync reset", repo.ID)
+		}
+	default:
+		return fmt.Errorf("%s: unknown sync %q", repo.ID, repo.Sync)
+	}
+	if repo.Host != "" {
+		u, err := url.Parse(repo.Host)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("%s: host %q must be an https URL", repo.ID, repo.Host)
+		}
+	}
+	return nil
+}
+
+// githubProvider is the API of github.com or a GitHub Enterprise Server.
+type githubProvider struct {
+	token  func() (string, error)
+	apiURL string
+}
+
+func (p *githubProvider) RegisterHook(repoID, webhookURL, legacyURL string, events []string, secret string) (int64, error) {
+	token, err := p.token()
+	if err != nil {
+		return 0, err
+	}
+	return registerHook(p.apiURL, token, repoID, webhookURL, legacyURL, events, secret)
+}
+
+func (p *githubProvider) DeleteHook(repoID string, hookID int64) error {
+	token, err := p.token()
+	if err != nil {
+		return err
+	}
+	return deleteHook(p.apiURL, token, repoID, hookID)
+}
+
+func (p *githubProvider) DecodeWebhook(r *http.Request, body []byte) (*WebhookRequest, error) {
+	return decodeWebhook(r)
+}
+
+func (p *githubProvider) VerifyWebhook(r *http.Request, body []byte, secret string) error {
+	return checkSignature(secret, body, r.Header.Get("X-Hub-Signature-256"))
+}
@@ -0,0 +1,136 @@
+package githubsync
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// requireAdmin rejects requests that don't carry Config.AdminToken as a
+// bearer token or, for browsers, as the basic auth password.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, token, ok = r.BasicAuth()
+		}
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="github-sync"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// hookID returns the id of the hook that delivered r, or 0 if unknown.
+func hookID(r *http.Request) int64 {
+	id, _ := strconv.ParseInt(r.Header.Get("X-GitHub-Hook-ID"), 10, 64)
+	return id
+}
+
+// redeliverHandler asks GitHub to redeliver the webhook that triggered the
+// last deploy of the repo at /redeliver/<key>, if that deploy failed.
+func (s *Server) redeliverHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/redeliver/")
+	repo, ok := s.config()[key]
+	if !ok {
+		http.Error(w, fmt.Sprintf("repo %s not configured", key), http.StatusNotFound)
+		return
+	}
+	if repo.provider() != providerGitHub {
+		http.Error(w, "redelivery is only supported for GitHub repos", http.StatusBadRequest)
+		return
+	}
+	last := s.statuses.Last(key)
+	if last == nil {
+		http.Error(w, fmt.Sprintf("no deploy of %s yet", key), http.StatusNotFound)
+		return
+	}
+	if last.Error == "" {
+		http.Error(w, fmt.Sprintf("last deploy of %s succeeded", key), http.StatusConflict)
+		return
+	}
+	// Fall back to the hook registered at startup
+	hook := last.HookID
+	s.stateMu.Lock()
+	if rs, ok := s.state.Repos[key]; ok && hook == 0 {
+		hook = rs.HookID
+	}
+	s.stateMu.Unlock()
+	if last.DeliveryID == "" || hook == 0 {
+		http.Error(w, fmt.Sprintf("last deploy of %s wasn't triggered by a webhook", key), http.StatusConflict)
+		return
+	}
+
+	token, err := s.tokenSource()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = redeliver(githubAPIURL(repo.Host), token, repo.ID, hook, last.DeliveryID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	slog.Info("Requested redelivery", "repo", key, "delivery", last.DeliveryID)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "redelivery of", last.DeliveryID, "requested")
+}
+
+// redeliver asks GitHub to deliver the delivery with the given GUID, the
+// X-GitHub-Delivery header, to hook hookID of repoID again. The deliveries
+// API identifies deliveries by a numeric id, so the GUID is looked up in
+// the hook's recent deliveries first.
+func redeliver(api, ghToken, repoID string, hookID int64, guid string) error {
+	apiURL := fmt.Sprintf("%s/repos/%s/hooks/%d/deliveries", api, repoID, hookID)
+	res, err := githubGet(ghToken, apiURL+"?per_page=100")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return githubError(res, repoID)
+	}
+	deliveries := []struct {
+		ID   int64  `json:"id"`
+		GUID string `json:"guid"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&deliveries)
+	if err != nil {
+		return err
+	}
+	var id int64
+	for _, d := range deliveries {
+		if d.GUID == guid {
+			id = d.ID
+			break
+		}
+	}
+	if id == 0 {
+		return fmt.Errorf("delivery %s not among the 100 most recent deliveries of hook %d", guid, hookID)
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/%d/attempts", apiURL, id), nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", ghToken))
+	res, err = githubClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 202 {
+		return githubError(res, repoID)
+	}
+	return nil
+}
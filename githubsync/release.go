@@ -0,0 +1,354 @@
+package githubsync
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GithubRelease is the release of a release event or the releases API.
+type GithubRelease struct {
+	TagName    string        `json:"tag_name"`
+	TarballURL string        `json:"tarball_url"`
+	Assets     []GithubAsset `json:"assets"`
+}
+
+// latestRelease returns the latest published release of repoID.
+func latestRelease(api, ghToken, repoID string) (*GithubRelease, error) {
+	return getRelease(api, ghToken, repoID, fmt.Sprintf("%s/repos/%s/releases/latest", api, repoID))
+}
+
+// releaseByTag returns the release of repoID with the given tag. Deploys
+// of release events download what this returns rather than the URLs of
+// the payload, which anyone can post if no webhook secret is set.
+func releaseByTag(api, ghToken, repoID, tag string) (*GithubRelease, error) {
+	return getRelease(api, ghToken, repoID, fmt.Sprintf("%s/repos/%s/releases/tags/%s", api, repoID, url.PathEscape(tag)))
+}
+
+func getRelease(api, ghToken, repoID, apiURL string) (*GithubRelease, error) {
+	res, err := githubGet(ghToken, apiURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, githubError(res, repoID)
+	}
+	release := &GithubRelease{}
+	err = json.NewDecoder(res.Body).Decode(release)
+	if err != nil {
+		return nil, err
+	}
+	return release, nil
+}
+
+// syncRelease makes sure path holds a release of repo, installing the
+// latest one if there is none yet.
+func (s *Server) syncRelease(ctx context.Context, path string, repo Repo) error {
+	_, err := os.Lstat(path)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	token, err := s.tokenSource()
+	if err != nil {
+		return err
+	}
+	release, err := latestRelease(githubAPIURL(repo.Host), token, repo.ID)
+	if err != nil {
+		return err
+	}
+	return s.installRelease(ctx, path, repo, release)
+}
+
+// deployRelease installs release of repo at path and restarts its service.
+func (s *Server) deployRelease(ctx context.Context, path string, repo Repo, release *GithubRelease, out io.Writer) error {
+	err := s.checkCommands(repo)
+	if err != nil {
+		return &DeployError{"approve", err}
+	}
+	token, err := s.tokenSource()
+	if err != nil {
+		return &DeployError{"download", err}
+	}
+	release, err = releaseByTag(githubAPIURL(repo.Host), token, repo.ID, release.TagName)
+	if err != nil {
+		return &DeployError{"download", err}
+	}
+	err = s.installRelease(ctx, path, repo, release)
+	if err != nil {
+		return &DeployError{"download", err}
+	}
+	err = s.restart(ctx, path, repo, release.TagName, nil, out)
+	if isHealthError(err) {
+		return s.rollbackRelease(ctx, path, repo, err, out)
+	}
+	if err != nil {
+		return err
+	}
+	err = s.pruneReleases(ctx, path, repo)
+	if err != nil {
+		fmt.Fprintln(out, "Error pruning old releases:", err)
+	}
+	return nil
+}
+
+// installRelease downloads the tarball of release, extracts it into its
+// own directory next to path and atomically points the path symlink at it.
+// release must come from the API of repo's host.
+func (s *Server) installRelease(ctx context.Context, path string, repo Repo, release *GithubRelease) error {
+	if !isPathComponent(release.TagName) {
+		return fmt.Errorf("invalid release tag %q", release.TagName)
+	}
+	fi, err := os.Lstat(path)
+	if err == nil && fi.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("%s exists and isn't a release symlink", path)
+	}
+
+	err = os.MkdirAll(releasesDir(path), 0755)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(releasesDir(path), release.TagName)
+	if _, err := os.Stat(dir); err != nil {
+		slog.Info("Downloading release", "repo", repo.ID, "tag", release.TagName)
+		tmp := dir + ".tmp"
+		os.RemoveAll(tmp)
+		api := githubAPIURL(repo.Host)
+		if repo.ReleaseAsset != "" {
+			err = s.downloadAsset(ctx, api, release, repo.ReleaseAsset, tmp)
+		} else {
+			err = s.downloadTarball(ctx, api, release.TarballURL, tmp)
+		}
+		if err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+		err = os.Rename(tmp, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return activateRelease(path, dir)
+}
+
+// isPathComponent reports whether name can name a file in a release
+// directory: a single local path component.
+func isPathComponent(name string) bool {
+	return filepath.IsLocal(name) && !strings.ContainsAny(name, `/\`)
+}
+
+// checkAPIURL returns an error unless rawURL is on the host of the GitHub
+// API at api, the only host the token is sent to.
+func checkAPIURL(api, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	a, err := url.Parse(api)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != a.Scheme || u.Host != a.Host {
+		return fmt.Errorf("refusing to send the token to %s://%s, which isn't the GitHub API", u.Scheme, u.Host)
+	}
+	return nil
+}
+
+// downloadTarball downloads a GitHub tarball and extracts it into dir,
+// stripping the top level directory GitHub wraps the files in. The size of
+// the download is checked against Content-Length and its SHA-256 logged.
+// tarballURL must be on the host of the GitHub API at api.
+func (s *Server) downloadTarball(ctx context.Context, api, tarballURL, dir string) error {
+	err := checkAPIURL(api, tarballURL)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", tarballURL, nil)
+	if err != nil {
+		return err
+	}
+	token, err := s.tokenSource()
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", token))
+	res, err := githubClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return githubError(res, tarballURL)
+	}
+
+	hash := sha256.New()
+	counter := &countingReader{r: io.TeeReader(res.Body, hash)}
+	err = extractTarGz(counter, dir, true)
+	if err != nil {
+		return err
+	}
+	// Drain any trailing padding so the checksum covers the whole file
+	io.Copy(io.Discard, counter)
+	if res.ContentLength >= 0 && counter.n != res.ContentLength {
+		return fmt.Errorf("download truncated: got %d of %d bytes", counter.n, res.ContentLength)
+	}
+	slog.Info("Downloaded tarball", "url", tarballURL, "bytes", counter.n, "sha256", hex.EncodeToString(hash.Sum(nil)))
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// extractTarGz extracts a gzipped tarball into dir, dropping the first
+// path component of every entry if strip is set.
+func extractTarGz(r io.Reader, dir string, strip bool) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := hdr.Name
+		if strip {
+			_, name, _ = strings.Cut(hdr.Name, "/")
+		}
+		if name == "" || name == "." || name == "./" {
+			continue
+		}
+		target, err := extractTarget(dir, name)
+		if err != nil {
+			return fmt.Errorf("tarball entry %q: %s", hdr.Name, err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = writeTarFile(target, tr, hdr.FileInfo().Mode())
+		case tar.TypeSymlink:
+			// Links may only point within the release
+			link := filepath.FromSlash(hdr.Linkname)
+			if filepath.IsAbs(link) || !filepath.IsLocal(filepath.Join(filepath.Dir(name), link)) {
+				return fmt.Errorf("tarball entry %q links outside the release directory", hdr.Name)
+			}
+			err = os.MkdirAll(filepath.Dir(target), 0755)
+			if err == nil {
+				err = os.Symlink(hdr.Linkname, target)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// extractTarget returns the path within dir to extract the archive entry
+// name to. It is an error if name escapes dir, or if it or any of its
+// parents is a symlink extracted earlier, since writing through it could
+// end up outside dir.
+func extractTarget(dir, name string) (string, error) {
+	if !filepath.IsLocal(name) {
+		return "", errors.New("escapes the release directory")
+	}
+	target := dir
+	for _, part := range strings.Split(filepath.Clean(name), string(filepath.Separator)) {
+		target = filepath.Join(target, part)
+		fi, err := os.Lstat(target)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", errors.New("is written through a symlink")
+		}
+	}
+	return filepath.Join(dir, name), nil
+}
+
+func writeTarFile(path string, r io.Reader, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// handleRelease queues deploys of the release-mode entries of the repo of
+// a published release event.
+func (s *Server) handleRelease(w http.ResponseWriter, r *http.Request, req *WebhookRequest, repos map[string]Repo) {
+	if req.Action != "published" || req.Release == nil {
+		fmt.Fprintln(w, "ignored release", req.Action)
+		return
+	}
+	jobs := []*Job{}
+	for key, repo := range repos {
+		deploysTag := repo.DeployOn == "release" && repo.matchesTag(req.Release.TagName)
+		if repo.ID != req.Repository.FullName || repo.Mode != "release" && !deploysTag {
+			continue
+		}
+		if !repo.enabled() {
+			slog.Info("Skipping release of disabled repo", "repo", key)
+			continue
+		}
+		job := &Job{
+			Key:     key,
+			Repo:    repo,
+			Path:    s.repoPath(key, repo),
+			Release: req.Release,
+			Status: &DeployStatus{
+				Repo:       key,
+				DeliveryID: r.Header.Get("X-GitHub-Delivery"),
+				HookID:     hookID(r),
+				SHA:        req.Release.TagName,
+				Pusher:     req.Sender.Login,
+			},
+		}
+		if deploysTag {
+			job.Release, job.Tag = nil, req.Release.TagName
+		}
+		jobs = append(jobs, job)
+	}
+	s.enqueue(w, jobs)
+}
@@ -0,0 +1,253 @@
+package githubsync
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// releaseHistoryFile lists the releases in the order they went live.
+	releaseHistoryFile  = ".history"
+	defaultKeepReleases = 5
+)
+
+// releasesDir returns the directory the releases of the repo at path are
+// kept in, for release and atomic mode repos.
+func releasesDir(path string) string {
+	return path + ".releases"
+}
+
+// keepReleases returns the number of releases kept for rollbacks.
+func (r Repo) keepReleases() int {
+	if r.KeepReleases <= 0 {
+		return defaultKeepReleases
+	}
+	return r.KeepReleases
+}
+
+// checkout returns the git checkout of the repo deployed at path. Atomic
+// mode repos keep it next to path, which links to the live release.
+func (r Repo) checkout(path string) string {
+	if r.Mode == "atomic" {
+		return path + ".repo"
+	}
+	return path
+}
+
+// activateRelease atomically points the path symlink at the release dir
+// and records it in the release history.
+func activateRelease(path, dir string) error {
+	link := path + ".tmp"
+	os.Remove(link)
+	err := os.Symlink(dir, link)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(link, path)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(releasesDir(path), releaseHistoryFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, filepath.Base(dir))
+	return err
+}
+
+// releaseHistory returns the releases of the repo at path that are still
+// on disk, oldest first, each listed at the last time it went live.
+func releaseHistory(path string) ([]string, error) {
+	f, err := os.Open(filepath.Join(releasesDir(path), releaseHistoryFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	names := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name := scanner.Text()
+		if name == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(releasesDir(path), name)); err != nil {
+			continue
+		}
+		names = slices.DeleteFunc(names, func(n string) bool { return n == name })
+		names = append(names, name)
+	}
+	return names, scanner.Err()
+}
+
+// liveRelease returns the release the path symlink points at.
+func liveRelease(path string) (string, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(target), nil
+}
+
+// pruneReleases removes all but the last repo.keepReleases() releases to
+// go live, never removing the live one.
+func (s *Server) pruneReleases(ctx context.Context, path string, repo Repo) error {
+	history, err := releaseHistory(path)
+	if err != nil {
+		return err
+	}
+	live, err := liveRelease(path)
+	if err != nil {
+		return err
+	}
+	keep := map[string]bool{live: true}
+	for _, name := range history[max(len(history)-repo.keepReleases(), 0):] {
+		keep[name] = true
+	}
+	entries, err := os.ReadDir(releasesDir(path))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || keep[e.Name()] || strings.HasSuffix(e.Name(), ".tmp") {
+			continue
+		}
+		dir := filepath.Join(releasesDir(path), e.Name())
+		slog.Info("Removing old release", "dir", dir)
+		if repo.Mode == "atomic" {
+			err = s.git(ctx, repo.checkout(path), "worktree", "remove", "--force", dir)
+		} else {
+			err = os.RemoveAll(dir)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Forget the removed releases
+	kept := []string{}
+	for _, name := range history {
+		if keep[name] {
+			kept = append(kept, name)
+		}
+	}
+	if !slices.Contains(kept, live) {
+		kept = append(kept, live)
+	}
+	return os.WriteFile(filepath.Join(releasesDir(path), releaseHistoryFile), []byte(strings.Join(kept, "\n")+"\n"), 0644)
+}
+
+// syncAtomic makes sure the checkout of the atomic mode repo at path is up
+// to date, and creates the first release from it if there is none yet.
+func (s *Server) syncAtomic(ctx context.Context, path string, repo Repo) error {
+	fi, err := os.Lstat(path)
+	if err == nil && fi.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("%s exists and isn't a release symlink", path)
+	}
+	err = s.checkRemoteBranch(ctx, repo)
+	if err != nil {
+		return err
+	}
+	err = s.syncRepo(ctx, repo.checkout(path), repo)
+	if err != nil || fi != nil {
+		return err
+	}
+	dir, _, err := s.newAtomicRelease(ctx, path, repo)
+	if err != nil {
+		return err
+	}
+	return activateRelease(path, dir)
+}
+
+// newAtomicRelease checks out the HEAD of the checkout of repo into a new
+// release directory and returns it and the commit.
+func (s *Server) newAtomicRelease(ctx context.Context, path string, repo Repo) (string, string, error) {
+	checkout := repo.checkout(path)
+	sha, err := s.gitOutput(ctx, checkout, "rev-parse", "HEAD")
+	if err != nil {
+		return "", "", err
+	}
+	err = os.MkdirAll(releasesDir(path), 0755)
+	if err != nil {
+		return "", "", err
+	}
+	dir := filepath.Join(releasesDir(path), time.Now().Format("20060102T150405")+"-"+sha[:min(len(sha), 12)])
+	err = s.git(ctx, checkout, "worktree", "add", "--detach", dir, sha)
+	if err == nil {
+		err = s.updateCheckout(ctx, dir, repo)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	_, err = s.writeDeployedSHA(ctx, dir, repo.VersionEnv)
+	if err != nil {
+		return "", "", err
+	}
+	return dir, sha, nil
+}
+
+// deployAtomic pulls the commit sha, or the tip of the branch if sha is
+// empty, into the checkout of repo, checks it out into a new release
+// directory and runs the install command in it. Only then is the path
+// symlink pointed at it and the service restarted. If that fails, path is
+// pointed back at the previous release, which is restarted.
+func (s *Server) deployAtomic(ctx context.Context, path string, repo Repo, sha string, out io.Writer) error {
+	err := s.checkCommands(repo)
+	if err != nil {
+		return &DeployError{"approve", err}
+	}
+	err = s.pull(ctx, repo.checkout(path), repo, sha)
+	if err != nil {
+		return &DeployError{"pull", err}
+	}
+	dir, sha, err := s.newAtomicRelease(ctx, path, repo)
+	if err != nil {
+		return &DeployError{"checkout", err}
+	}
+
+	// Install while the live release keeps serving
+	err = s.install(ctx, dir, repo, sha, nil, out)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "Activating release", dir)
+	err = activateRelease(path, dir)
+	if err != nil {
+		return &DeployError{"activate", err}
+	}
+	installed := repo
+	installed.Install = ""
+	err = s.restart(ctx, path, installed, sha, nil, out)
+	if err != nil {
+		return s.rollbackRelease(ctx, path, repo, err, out)
+	}
+	err = s.pruneReleases(ctx, path, repo)
+	if err != nil {
+		fmt.Fprintln(out, "Error pruning old releases:", err)
+	}
+	return nil
+}
+
+// rollbackRelease points path back at the previous release and restarts
+// it after the new one failed to start or pass its health check with
+// deployErr.
+func (s *Server) rollbackRelease(ctx context.Context, path string, repo Repo, deployErr error, out io.Writer) error {
+	fmt.Fprintln(out, "Release failed, rolling back to the previous release:", deployErr)
+	// Finish the rollback even if the deploy was cancelled
+	to, err := s.rollback(context.WithoutCancel(ctx), path, repo, "", out)
+	if err != nil {
+		return fmt.Errorf("%w; rollback failed: %s", deployErr, err)
+	}
+	return fmt.Errorf("%w; %w", deployErr, &rolledBackError{to})
+}
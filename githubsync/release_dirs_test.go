@@ -0,0 +1,89 @@
+package githubsync
+
+import (
+	"context"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// newAtomicRepo returns a Server deploying the upstream repo it creates
+// in atomic mode with its first release live, and the release.
+func newAtomicRepo(t *testing.T, repo Repo) (*Server, string, string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	repo.FetchURL = newUpstream(t, dir, "up")
+	repo.ID, repo.Branch, repo.Mode = "o/app", "main", "atomic"
+	s := newTestServer(t, dir, map[string]Repo{"o/app": repo})
+	path := s.repoPath("o/app", repo)
+	err := s.syncAtomic(context.Background(), path, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := liveRelease(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, repo.FetchURL, path, live
+}
+
+// fakeFailingStart puts a systemctl on PATH that fails to start services
+// whose working directory, path, holds a file named broken.
+func fakeFailingStart(t *testing.T, path string) func() []string {
+	t.Helper()
+	dir := t.TempDir()
+	script := `#!/bin/sh
+echo "$@" >> ` + dir + `/calls
+case "$1" in
+show) echo loaded ;;
+start) [ ! -e ` + path + `/broken ] ;;
+esac
+`
+	err := os.WriteFile(dir+"/systemctl", []byte(script), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+	return func() []string {
+		b, _ := os.ReadFile(dir + "/calls")
+		return strings.Split(strings.TrimSpace(string(b)), "\n")
+	}
+}
+
+func TestDeployAtomicInstallFails(t *testing.T) {
+	repo := Repo{Install: "test ! -e broken", Service: &SystemdService{Name: "app"}}
+	s, up, path, live := newAtomicRepo(t, repo)
+	calls := fakeFailingStart(t, path)
+	sh(t, up, "touch broken && git add broken && git commit -q -m broken")
+	repo = s.config()["o/app"]
+	err := s.deployAtomic(context.Background(), path, repo, "", io.Discard)
+	if err == nil || !strings.HasPrefix(err.Error(), "install:") {
+		t.Fatalf("got %v, want an install error", err)
+	}
+	if got, _ := liveRelease(path); got != live {
+		t.Errorf("live release is %s, want %s", got, live)
+	}
+	if slices.Contains(calls(), "stop app") {
+		t.Error("stopped the service although install failed")
+	}
+}
+
+func TestDeployAtomicStartFails(t *testing.T) {
+	repo := Repo{Service: &SystemdService{Name: "app"}}
+	s, up, path, live := newAtomicRepo(t, repo)
+	calls := fakeFailingStart(t, path)
+	sh(t, up, "touch broken && git add broken && git commit -q -m broken")
+	repo = s.config()["o/app"]
+	err := s.deployAtomic(context.Background(), path, repo, "", io.Discard)
+	if err == nil || !strings.HasPrefix(err.Error(), "start:") || !strings.Contains(err.Error(), "rolled back to "+live) {
+		t.Fatalf("got %v, want a start error and a rollback", err)
+	}
+	if got, _ := liveRelease(path); got != live {
+		t.Errorf("live release is %s, want %s", got, live)
+	}
+	if c := calls(); c[len(c)-1] != "start app" {
+		t.Errorf("last ran systemctl %s, want the previous release started", c[len(c)-1])
+	}
+}
@@ -0,0 +1,118 @@
+package githubsync
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarGz returns a gzipped tarball of hdrs, with content as the body of
+// every regular file.
+func tarGz(t *testing.T, hdrs []tar.Header, content string) *bytes.Buffer {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range hdrs {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(content))
+			hdr.Mode = 0644
+		}
+		err := tw.WriteHeader(&hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(content))
+		}
+	}
+	tw.Close()
+	gz.Close()
+	return buf
+}
+
+func TestExtractTarGzRejectsEscapes(t *testing.T) {
+	tests := []struct {
+		name string
+		hdrs []tar.Header
+	}{
+		{"dotdot entry", []tar.Header{{Name: "../x", Typeflag: tar.TypeReg}}},
+		{"absolute link", []tar.Header{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"}}},
+		{"dotdot link", []tar.Header{{Name: "a/link", Typeflag: tar.TypeSymlink, Linkname: "../../x"}}},
+		{"write through link", []tar.Header{
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "link/file", Typeflag: tar.TypeReg},
+		}},
+		{"overwrite link", []tar.Header{
+			{Name: "sub", Typeflag: tar.TypeDir},
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "sub"},
+			{Name: "link", Typeflag: tar.TypeReg},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "release")
+			err := extractTarGz(tarGz(t, tt.hdrs, "x"), dir, false)
+			if err == nil {
+				t.Fatal("extracted an escaping tarball")
+			}
+			if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "x")); err == nil {
+				t.Fatal("wrote outside the release directory")
+			}
+		})
+	}
+}
+
+func TestExtractTarGzLocalLinks(t *testing.T) {
+	dir := t.TempDir()
+	hdrs := []tar.Header{
+		{Name: "repo-v1/", Typeflag: tar.TypeDir},
+		{Name: "repo-v1/bin/app", Typeflag: tar.TypeReg},
+		{Name: "repo-v1/app", Typeflag: tar.TypeSymlink, Linkname: "bin/app"},
+		{Name: "repo-v1/bin/self", Typeflag: tar.TypeSymlink, Linkname: "../app"},
+	}
+	err := extractTarGz(tarGz(t, hdrs, "binary"), dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "bin/self"))
+	if err != nil || string(b) != "binary" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+}
+
+func TestInstallReleaseRejectsBadTags(t *testing.T) {
+	s := &Server{}
+	path := filepath.Join(t.TempDir(), "app")
+	for _, tag := range []string{"", "..", "../../x", "v1/../../x", "/abs"} {
+		err := s.installRelease(context.Background(), path, Repo{Mode: "release"}, &GithubRelease{TagName: tag})
+		if err == nil {
+			t.Errorf("installed release %q", tag)
+		}
+	}
+}
+
+func TestCheckAPIURL(t *testing.T) {
+	tests := []struct {
+		api, url string
+		ok       bool
+	}{
+		{"https://api.github.com", "https://api.github.com/repos/o/r/tarball/v1", true},
+		{"https://api.github.com", "https://api.github.com/repos/o/r/releases/assets/1", true},
+		{"https://ghe.example.com/api/v3", "https://ghe.example.com/api/v3/repos/o/r/tarball/v1", true},
+		{"https://api.github.com", "https://evil.example.com/repos/o/r/tarball/v1", false},
+		{"https://api.github.com", "http://api.github.com/repos/o/r/tarball/v1", false},
+		{"https://api.github.com", "https://api.github.com.evil.example.com/x", false},
+		{"https://api.github.com", "https://user@evil.example.com/x", false},
+	}
+	for _, tt := range tests {
+		err := checkAPIURL(tt.api, tt.url)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkAPIURL(%q, %q) = %v", tt.api, tt.url, err)
+		}
+	}
+}
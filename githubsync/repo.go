@@ -0,0 +1,318 @@
+package githubsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Repo is the config of one deployed repo, the value of an entry in
+// repos.json.
+type Repo struct {
+	// ID is the repo's owner/name on GitHub. It defaults to the config key
+	// without any @branch suffix.
+	ID string `json:"id"`
+	// Provider is the forge the repo is hosted on: github (the default),
+	// gitlab, gitea, which also covers Forgejo, or bitbucket for Bitbucket
+	// Cloud. Host is the base URL of a self-hosted instance, e.g.
+	// https://gitlab.example.com or a GitHub Enterprise Server. It defaults
+	// to Config.GitHubURL for GitHub and https://gitlab.com for GitLab, and
+	// is required for Gitea. IDs of GitLab repos are project paths and may
+	// include subgroups.
+	Provider string `json:"provider"`
+	Host     string `json:"host"`
+	// Enabled, if false, stops deploying the repo without removing its
+	// entry: it is neither cloned nor pulled, and pushes are ignored.
+	// Its hook is left in place. Defaults to true.
+	Enabled *bool `json:"enabled"`
+	// Branch is the branch to deploy. If empty, the remote's default
+	// branch is tracked. Only pushes to the tracked branch deploy.
+	Branch string `json:"branch"`
+	// Install is a shell command run in the checkout after every pull,
+	// while the service is stopped.
+	Install string `json:"install"`
+	// InstallPaths are globs (with ** support) of files that require
+	// Install to run, e.g. go.mod and go.sum. If set and a push changes
+	// none of them, the service is restarted without running Install.
+	InstallPaths []string `json:"install_paths"`
+	// AlwaysDeploy deploys redeliveries of the commit that is already live
+	// instead of skipping them, for installs that must run on every push.
+	AlwaysDeploy bool `json:"always_deploy"`
+	// Path is the directory the repo is checked out to, relative to
+	// Config.Root unless absolute, e.g. /srv/app. It defaults to the
+	// repo's name in Config.Root, with the branch of owner/name@branch
+	// entries and the app of monorepo apps appended. No two entries may
+	// share a path.
+	Path string `json:"path"`
+	// Workdir is the directory within the checkout Install runs in, for
+	// repos whose deployable app lives in a subdirectory. Git always runs
+	// at the root of the checkout.
+	Workdir string `json:"workdir"`
+	// Submodules clones the repo's submodules along with it and updates
+	// them to the commits recorded by every commit deployed.
+	Submodules bool `json:"submodules"`
+	// LFS fetches the repo's Git LFS files after every checkout, so that
+	// Install sees their content rather than pointer files. It is implied
+	// if the repo's .gitattributes has LFS filters. git-lfs must be
+	// installed.
+	LFS bool `json:"lfs"`
+	// OnDiverge is the policy applied when a pull fails: fail, reset or stash.
+	OnDiverge string `json:"on_diverge"`
+	// OnDirty is the policy applied to local changes of the checkout, e.g.
+	// build artifacts or a hand-made hotfix, before it is updated: fail
+	// refuses to deploy, stash stashes them and discard throws them away.
+	// If unset, the merge fails only if they conflict. The action taken
+	// is logged and reported in the deploy's status.
+	OnDirty string `json:"on_dirty"`
+	// Sync is how pulls update the checkout: "merge" (the default) merges
+	// upstream, subject to OnDiverge, and "reset" hard resets to it, so
+	// that the checkout converges on upstream whatever was force-pushed or
+	// changed locally. Clean also removes untracked files after a reset,
+	// leaving ignored ones.
+	Sync  string `json:"sync"`
+	Clean bool   `json:"clean"`
+	// InstallAsUser runs Install as Service.User instead of the user
+	// github-sync runs as, and chowns the checkout to that user first.
+	// github-sync must be able to run chown and `sudo -u <user>` without
+	// a password, which in practice means running as root.
+	InstallAsUser bool `json:"install_as_user"`
+	// SSH clones the repo over SSH, e.g. from git@github.com:owner/name.git,
+	// instead of HTTPS. SSHKey is the private key to authenticate with; if
+	// empty, an ed25519 key is generated in Config.SSHKeyDir. DeployKey
+	// registers the public key as a read-only deploy key of the repo, so
+	// that private GitHub repos are cloned without the token.
+	SSH       bool   `json:"ssh"`
+	SSHKey    string `json:"ssh_key"`
+	DeployKey bool   `json:"deploy_key"`
+	// Remote is the name of the git remote to pull from. Defaults to origin.
+	Remote string `json:"remote"`
+	// FetchURL overrides the URL the remote fetches from, e.g. to pull
+	// from a mirror. Webhooks are still registered on GitHub.
+	FetchURL string `json:"fetch_url"`
+	// Paths and PathsIgnore are globs (with ** support) of the files the
+	// repo, or an app of a monorepo, is deployed from. Pushes that only
+	// change files not matching Paths, if set, or matching PathsIgnore,
+	// e.g. "docs/**" and "**/*.md", aren't deployed at all.
+	Paths       []string `json:"paths"`
+	PathsIgnore []string `json:"paths_ignore"`
+	// RestartPaths are globs (with ** support) of files that require the
+	// service to be restarted. If set and a push changes none of them, only
+	// the working tree is updated: both install and the restart are skipped.
+	RestartPaths []string `json:"restart_paths"`
+	// Watchdog, if set, restarts the service when it dies between deploys.
+	Watchdog *Watchdog `json:"watchdog"`
+	// Debounce, if set, waits until no push arrived for this long, e.g.
+	// "30s", and deploys the latest commit once. DebounceMax caps the
+	// total wait.
+	Debounce    string `json:"debounce"`
+	DebounceMax string `json:"debounce_max"`
+	// VersionEnv, if set, is the env var the deployed SHA is written to in
+	// .deployed.env and exported as to the install command. The SHA is
+	// always written to .deployed-sha.
+	VersionEnv string `json:"version_env"`
+	// RequireSigned refuses to deploy commits, or tags of repos deploying
+	// tags, without a valid signature. AllowedSigners is the ssh allowed
+	// signers file to verify SSH signatures against; GPG signatures are
+	// verified against the keyring of the user github-sync runs as.
+	// AllowedKeys, if set, only accepts signatures by these keys: GPG key
+	// fingerprints, or SSH ones like SHA256:<base64>.
+	RequireSigned  bool     `json:"require_signed"`
+	AllowedSigners string   `json:"allowed_signers"`
+	AllowedKeys    []string `json:"allowed_keys"`
+	// StopOnDelete stops the service when the deployed branch is deleted.
+	StopOnDelete bool `json:"stop_on_delete"`
+	// FallbackRef is a known-good branch or tag that is deployed instead
+	// when installing or starting the configured branch fails. Release and
+	// atomic mode repos are rolled back instead.
+	FallbackRef string `json:"fallback_ref"`
+	// OnFailure is a shell command run in the checkout whenever a deploy
+	// fails, e.g. to page someone or capture diagnostics. The failure is
+	// passed in GITHUB_SYNC_REPO, GITHUB_SYNC_BRANCH, GITHUB_SYNC_SHA,
+	// GITHUB_SYNC_STEP and GITHUB_SYNC_ERROR.
+	OnFailure string `json:"on_failure"`
+	// Mode "release" deploys the tarball of each published release into
+	// <path>.releases/<tag> and points the path symlink at it, instead of
+	// pulling with git. Mode "atomic" pulls into a checkout at <path>.repo
+	// and checks out every deploy into its own <path>.releases/<time>-<sha>
+	// before pointing the path symlink at it.
+	Mode string `json:"mode"`
+	// ReleaseAsset, if set, deploys the asset of the release whose name
+	// matches this glob, e.g. "*-linux-amd64.tar.gz", instead of its source
+	// tarball, for mode release repos that deploy prebuilt builds on
+	// machines without toolchains. .tar.gz, .tgz and .zip assets are
+	// extracted, other assets are deployed as an executable file.
+	ReleaseAsset string `json:"release_asset"`
+	// KeepReleases is the number of releases of release and atomic mode
+	// repos kept around for rollbacks. Defaults to 5.
+	KeepReleases int `json:"keep_releases"`
+	// Permissions, if set, fixes the ownership and mode bits of the
+	// checkout after every pull and install, before the service starts.
+	Permissions *Permissions `json:"permissions"`
+	// WebhookSecret, if set, is the secret the repo's hook is registered
+	// with instead of Config.WebhookSecret. Deliveries without a valid
+	// signature are rejected.
+	WebhookSecret string `json:"webhook_secret"`
+	// HealthCheck, if set, is checked after the service starts. If it
+	// fails, the previous commit or release is deployed again, unless
+	// FallbackRef is set.
+	HealthCheck *HealthCheck `json:"health_check"`
+	// SlackWebhookURL, if set, is the Slack incoming webhook deploys of the
+	// repo are posted to instead of Config.SlackWebhookURL, e.g. to notify
+	// the channel of the team owning it. SlackChannel overrides the
+	// channel for legacy webhooks that allow it.
+	SlackWebhookURL string `json:"slack_webhook_url"`
+	SlackChannel    string `json:"slack_channel"`
+	// NotifyWebhooks are URLs the deploys of the repo are posted to along
+	// with Config.NotifyWebhooks.
+	NotifyWebhooks []string `json:"notify_webhooks"`
+	// Environment is the GitHub environment deploys are reported to with
+	// Config.Deployments. Defaults to production.
+	Environment string `json:"environment"`
+	// RequireCI deploys pushes only once their CI passed, when a workflow
+	// run or check suite of the pushed commit completes, instead of right
+	// away. CIWorkflows, if set, are the names of the workflows that have
+	// to pass; otherwise every check suite with check runs has to. The
+	// token needs the checks and actions read permissions.
+	RequireCI   bool     `json:"require_ci"`
+	CIWorkflows []string `json:"ci_workflows"`
+	// DeployOn is what deploys the repo: "push" (the default) deploys
+	// pushes to the branch, "tag" pushes of tags and "release" the tags of
+	// published GitHub releases, which are checked out on a detached HEAD.
+	// TagPattern limits the tags deployed to those matching it as a glob,
+	// e.g. "v*", or to stable semantic versions if it is "semver".
+	DeployOn   string `json:"deploy_on"`
+	TagPattern string `json:"tag_pattern"`
+	// Apps, if set, deploys the repo as several apps, e.g. the services of
+	// a monorepo, each keyed <key>:<app> with its own checkout. Every app
+	// is configured like this entry with its own fields on top, typically
+	// workdir, install and service, and only restarts for pushes within
+	// its workdir unless it sets restart_paths.
+	Apps map[string]json.RawMessage `json:"apps"`
+	// Service is the systemd service restarted on every deploy, if any.
+	Service *SystemdService `json:"service"`
+}
+
+// cloneURL returns the URL to clone the repo from.
+func (r Repo) cloneURL() string {
+	if r.FetchURL != "" {
+		return r.FetchURL
+	}
+	if r.SSH {
+		return r.sshURL()
+	}
+	return fmt.Sprintf("%s/%s.git", strings.TrimSuffix(r.hostURL(), "/"), r.ID)
+}
+
+// hookEvents returns the events the repo's hook has to deliver: pushes,
+// and releases for repos deployed from releases or CI runs for repos that
+// wait for CI.
+func (r Repo) hookEvents() []string {
+	switch {
+	case r.Mode == "release", r.DeployOn == "release":
+		return []string{"push", "release"}
+	case r.RequireCI:
+		return []string{"push", "workflow_run", "check_suite"}
+	}
+	return []string{"push"}
+}
+
+// provider returns the name of the repo's Provider.
+func (r Repo) provider() string {
+	if r.Provider == "" {
+		return providerGitHub
+	}
+	return r.Provider
+}
+
+// hostURL returns the base URL of the instance of its provider the repo
+// is hosted on.
+func (r Repo) hostURL() string {
+	if r.Host != "" {
+		return r.Host
+	}
+	switch r.provider() {
+	case providerGitLab:
+		return gitlabURL
+	case providerBitbucket:
+		return "https://bitbucket.org"
+	}
+	return "https://github.com"
+}
+
+// debounce returns the parsed Debounce and DebounceMax.
+func (r Repo) debounce() (window, maxWait time.Duration) {
+	if r.Debounce == "" {
+		return 0, 0
+	}
+	window, err := time.ParseDuration(r.Debounce)
+	if err != nil {
+		slog.Error("Invalid debounce", "repo", r.ID, "err", err)
+		return 0, 0
+	}
+	if r.DebounceMax != "" {
+		maxWait, err = time.ParseDuration(r.DebounceMax)
+		if err != nil {
+			slog.Error("Invalid debounce_max", "repo", r.ID, "err", err)
+		}
+	}
+	return window, maxWait
+}
+
+// workdir returns the directory Install runs in for the checkout at path.
+func (r Repo) workdir(path string) string {
+	return filepath.Join(path, r.Workdir)
+}
+
+// checkWorkdir makes sure the repo's workdir is a directory within the
+// checkout at path.
+func (r Repo) checkWorkdir(path string) error {
+	if r.Workdir == "" {
+		return nil
+	}
+	if !filepath.IsLocal(r.Workdir) {
+		return fmt.Errorf("workdir %s: %w", r.Workdir, errBadWorkdir)
+	}
+	fi, err := os.Stat(r.workdir(path))
+	if err != nil || !fi.IsDir() {
+		return fmt.Errorf("workdir %s: %w", r.Workdir, errBadWorkdir)
+	}
+	return nil
+}
+
+// enabled reports whether the repo is deployed.
+func (r Repo) enabled() bool {
+	return r.Enabled == nil || *r.Enabled
+}
+
+// serviceName returns the name of the repo's systemd service, if any.
+func (r Repo) serviceName() string {
+	if r.Service == nil {
+		return ""
+	}
+	return r.Service.Name
+}
+
+func (r Repo) remote() string {
+	if r.Remote == "" {
+		return "origin"
+	}
+	return r.Remote
+}
+
+// SystemdService is the systemd unit a repo runs as.
+type SystemdService struct {
+	// Name is the unit name, e.g. "myapp" or "myapp.service".
+	Name string `json:"name"`
+	// Env, Start, User and Dir describe the service's environment,
+	// start command, user and working directory. If Start is set, the
+	// unit file is generated from them and kept in sync with the config.
+	// Dir defaults to the workdir and is relative to the checkout.
+	Env   map[string]string `json:"env"`
+	Start string            `json:"start"`
+	User  string            `json:"user"`
+	Dir   string            `json:"dir"`
+}
@@ -0,0 +1,120 @@
+package githubsync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Rollback points the release or atomic mode repo with the given config
+// key back at the release to, or at the previous release if to is empty,
+// restarts its service and waits for it to finish. The rollback runs after
+// the deploys of the repo that are already queued.
+func (s *Server) Rollback(ctx context.Context, key, to string) error {
+	job, err := s.rollbackJob(key, to)
+	if err != nil {
+		return err
+	}
+	job.ctx = ctx
+	job.done = make(chan error, 1)
+	s.dispatcher.EnqueueNow(job)
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rollbackJob returns a job rolling key back to the release to.
+func (s *Server) rollbackJob(key, to string) (*Job, error) {
+	repo, ok := s.config()[key]
+	if !ok {
+		return nil, fmt.Errorf("repo %s not configured", key)
+	}
+	if repo.Mode != "release" && repo.Mode != "atomic" {
+		return nil, fmt.Errorf("repo %s keeps no releases to roll back to", key)
+	}
+	job := &Job{
+		Key:        key,
+		Repo:       repo,
+		Path:       s.repoPath(key, repo),
+		Rollback:   true,
+		RollbackTo: to,
+		Status:     &DeployStatus{Repo: key, Message: "rollback"},
+	}
+	s.jobs.Add(job)
+	return job, nil
+}
+
+// rollback points the path symlink of repo back at the release to, or at
+// the release that was live before the current one if to is empty, and
+// restarts the service. The release isn't installed again. It returns the
+// release rolled back to.
+func (s *Server) rollback(ctx context.Context, path string, repo Repo, to string, out io.Writer) (string, error) {
+	live, err := liveRelease(path)
+	if err != nil {
+		return "", &DeployError{"rollback", err}
+	}
+	if to == "" {
+		history, err := releaseHistory(path)
+		if err != nil {
+			return "", &DeployError{"rollback", err}
+		}
+		for i := len(history) - 1; i >= 0 && to == ""; i-- {
+			if history[i] != live {
+				to = history[i]
+			}
+		}
+		if to == "" {
+			return "", &DeployError{"rollback", fmt.Errorf("no earlier release of %s to roll back to", repo.ID)}
+		}
+	}
+	dir := filepath.Join(releasesDir(path), to)
+	if !filepath.IsLocal(to) {
+		return "", &DeployError{"rollback", fmt.Errorf("invalid release %q", to)}
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return "", &DeployError{"rollback", fmt.Errorf("release %s of %s not found", to, repo.ID)}
+	}
+	fmt.Fprintln(out, "Rolling", repo.ID, "back from", live, "to", to)
+	err = activateRelease(path, dir)
+	if err != nil {
+		return "", &DeployError{"rollback", err}
+	}
+
+	// Tell the service which commit it runs again
+	sha := to
+	if b, err := os.ReadFile(filepath.Join(dir, deployedSHAFile)); err == nil {
+		sha = strings.TrimSpace(string(b))
+	}
+	repo.Install = ""
+	return to, s.restart(ctx, path, repo, sha, nil, out)
+}
+
+// rollbackHandler queues a rollback of the repo at POST /rollback/<key> to
+// the release in the to query parameter, or to the previous release.
+func (s *Server) rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/rollback/")
+	if _, ok := s.config()[key]; !ok {
+		http.Error(w, fmt.Sprintf("repo %s not configured", key), http.StatusNotFound)
+		return
+	}
+	job, err := s.rollbackJob(key, r.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	position := s.dispatcher.EnqueueNow(job)
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "queued rollback of", key, "as job", job.ID, "at position", position)
+}
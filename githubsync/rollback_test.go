@@ -0,0 +1,86 @@
+package githubsync
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRollbackIsQueued(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), map[string]Repo{"o/app": {ID: "o/app", Mode: "atomic"}})
+	started := make(chan *Job, 3)
+	release := make(chan struct{})
+	s.dispatcher = NewDispatcher(1, func(j *Job) {
+		started <- j
+		<-release
+	})
+	running := &Job{Key: "o/app", Status: &DeployStatus{}}
+	waiting := &Job{Key: "o/app", Status: &DeployStatus{}}
+	s.dispatcher.EnqueueNow(running)
+	<-started
+	s.dispatcher.EnqueueNow(waiting)
+
+	w := httptest.NewRecorder()
+	s.rollbackHandler(w, httptest.NewRequest("POST", "/rollback/o/app", nil))
+	if w.Code != http.StatusAccepted || !strings.Contains(w.Body.String(), "at position 2") {
+		t.Fatalf("got %d %s, want the rollback queued behind both deploys", w.Code, w.Body)
+	}
+	select {
+	case j := <-started:
+		t.Fatalf("started %+v alongside the running deploy", j)
+	default:
+	}
+
+	close(release)
+	if j := <-started; j != waiting {
+		t.Fatalf("ran %+v, want the waiting deploy next", j)
+	}
+	if j := <-started; !j.Rollback {
+		t.Fatalf("ran %+v, want the rollback last", j)
+	}
+}
+
+func TestRollbackOnce(t *testing.T) {
+	dir := t.TempDir()
+	up := newUpstream(t, dir, "up")
+	config := `{"o/app": {"provider": "gitea", "host": "https://gitea.example.com", "branch": "main", "mode": "atomic", "fetch_url": "` + up + `"}}`
+	err := os.WriteFile(dir+"/repos.json", []byte(config), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Like the CLI, which never starts the dispatcher
+	s, err := New(Config{Root: dir, GiteaToken: "token", UnitDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := s.config()["o/app"]
+	path := s.repoPath("o/app", repo)
+	err = s.syncAtomic(context.Background(), path, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := liveRelease(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh(t, up, "git commit -q --allow-empty -m two")
+	err = s.deployAtomic(context.Background(), path, repo, "", io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = s.RollbackOnce(ctx, "o/app", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live, _ := liveRelease(path); live != first {
+		t.Fatalf("live release is %s, want %s", live, first)
+	}
+}
@@ -0,0 +1,833 @@
+// Package githubsync keeps checkouts of GitHub repos in sync with their
+// branches and deploys them to systemd services on every push.
+package githubsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mikerybka/util"
+)
+
+// Config configures a Server. Zero values fall back to the defaults
+// documented on each field.
+type Config struct {
+	// Token is the GitHub token hooks are registered with and git
+	// authenticates with. It needs to be able to manage webhooks.
+	Token string
+	// GitHubURL is the base URL of the GitHub instance repos without a
+	// host are on, e.g. https://github.example.com for GitHub Enterprise
+	// Server. Defaults to https://github.com.
+	GitHubURL string
+	// AppID, if set, authenticates as the GitHub App with that id instead
+	// of with Token. AppPrivateKey is the path of the app's private key
+	// and AppInstallationID the installation to mint tokens for, which
+	// defaults to the app's only installation. The app needs the webhooks
+	// read and write and the contents read permissions.
+	AppID             int64
+	AppPrivateKey     string
+	AppInstallationID int64
+	// GitLabToken is the GitLab token the hooks of GitLab repos are
+	// registered with and git authenticates to their hosts with. It needs
+	// the api scope and the Maintainer role.
+	GitLabToken string
+	// GiteaToken is the Gitea or Forgejo token used likewise for Gitea repos.
+	// It needs the write:repository scope and admin rights on the repos.
+	GiteaToken string
+	// BitbucketUsername and BitbucketAppPassword authenticate likewise for
+	// Bitbucket repos. The app password needs the webhooks and repository
+	// read permissions.
+	BitbucketUsername    string
+	BitbucketAppPassword string
+	// WebhookSecret, if set, is the secret hooks are registered with.
+	// Deliveries without a valid X-Hub-Signature-256, or the equivalent
+	// header of the other providers, are rejected. Deliveries for repos
+	// without it or a secret of their own aren't authenticated, which is
+	// warned about whenever the config is loaded.
+	WebhookSecret string
+	// ExternalURL is the public URL the Server's handler is reachable at.
+	// Hooks are registered at ExternalURL/hooks/<owner>/<name>. It must be
+	// an absolute https URL.
+	ExternalURL string
+	// ConfigFile is the repos config, in JSON, YAML or TOML depending on
+	// its extension. Defaults to ~/repos.json, or ~/repos.yaml, .yml or
+	// .toml if that exists instead.
+	ConfigFile string
+	// ConfigDir, if set, is a directory of JSON, YAML and TOML files that
+	// are merged into the config instead of reading ConfigFile. See
+	// Server.WatchConfigDir.
+	ConfigDir string
+	// ConfigRepo, if set, is the GitHub repo the config is read from
+	// instead. It is cloned into ConfigRepoDir, which defaults to
+	// ~/.github-sync-config, and pulled on start, on SIGHUP and whenever
+	// ConfigRepoBranch, which defaults to the default branch, is pushed.
+	// ConfigRepoPath is the config file within it, or a directory read
+	// like ConfigDir. Defaults to repos.json.
+	ConfigRepo       string
+	ConfigRepoBranch string
+	ConfigRepoDir    string
+	ConfigRepoPath   string
+	// DiscoverOwner, if set, is a GitHub org or user whose repos carrying
+	// DiscoverTopic, which defaults to github-sync, are deployed along
+	// with the configured ones. They are rescanned every
+	// DiscoverInterval, which defaults to 10m. DiscoverDefaults is a JSON
+	// file holding the entry discovered repos are deployed with, in which
+	// {owner} and {name} are replaced by the repo's. Repos that have an
+	// entry in the config keep it.
+	DiscoverOwner    string
+	DiscoverTopic    string
+	DiscoverInterval time.Duration
+	DiscoverDefaults string
+	// Root is the directory repos are checked out in and, unless
+	// configured otherwise, the config and state are kept in, e.g.
+	// /var/lib/github-sync. Defaults to the home directory.
+	Root string
+	// StateFile records the hooks and checkouts that were set up, so that
+	// they can be cleaned up once removed from the config. Defaults to
+	// .github-sync-state.json in Root.
+	StateFile string
+	// SSHKeyDir is where the SSH keys of repos cloned over SSH without a
+	// key of their own are generated. Defaults to .github-sync-keys in
+	// Root.
+	SSHKeyDir string
+	// SyncWorkers is the number of repos cloned or pulled at once when
+	// syncing all of them, e.g. on start. Defaults to 4.
+	SyncWorkers int
+	// MaxConcurrentDeploys caps the number of deploys running at once.
+	// Defaults to 4.
+	MaxConcurrentDeploys int
+	// MaxQueueDepth caps the number of deploys waiting or running across
+	// all repos. Deliveries beyond it are rejected with a 503 so that
+	// GitHub retries them later. Defaults to 100.
+	MaxQueueDepth int
+	// MaxBodyBytes caps the size of webhook payloads. Defaults to 25MB,
+	// which is GitHub's own cap.
+	MaxBodyBytes int64
+	// AuditLog, if set, is a file one JSON record per deploy is appended to.
+	// It is served at /history and reloaded into the history on start.
+	AuditLog string
+	// HistoryDB, if set, is a SQLite database every deploy is recorded in.
+	// It is served at /history and reloaded into the history on start
+	// instead of the audit log.
+	HistoryDB string
+	// CloneRetries is how many times a failed clone is retried.
+	CloneRetries int
+	// GitBinary is the git executable. Defaults to git. GitOptions are -c
+	// options passed to every git invocation.
+	GitBinary  string
+	GitOptions []string
+	// RecloneEmpty clones into existing checkout directories that are
+	// empty but not git repos.
+	RecloneEmpty bool
+	// PruneDirs removes the checkout of repos that are no longer configured.
+	PruneDirs bool
+	// RepoFilter, if set, limits the Server to the repos whose key or ID
+	// matches one of these globs. Every glob must match a configured repo.
+	// Removed repos aren't pruned while filtering.
+	RepoFilter []string
+	// RequireApprovedCommands only runs install, on_failure, health check
+	// and service start commands, and generates units with environments,
+	// whose checksum was approved. ApproveCommands approves the ones
+	// currently configured.
+	RequireApprovedCommands bool
+	ApproveCommands         bool
+	// IPAllowlist rejects webhooks that weren't sent from GitHub's hook
+	// ranges, so it can only be used with GitHub repos. TrustedProxyDepth
+	// is the number of reverse proxies in front of the Server whose
+	// X-Forwarded-For entries can be trusted.
+	IPAllowlist       bool
+	TrustedProxyDepth int
+	// HistorySize is the number of recent deploys of each repo served at
+	// /status/<key>. Defaults to 10 and is capped at 100. At most 1000
+	// deploys are kept across repos, dropping the oldest ones first.
+	HistorySize int
+	// LogDir, if set, is the directory the output of every deploy is
+	// written to, one file per deploy. The output of the running or last
+	// deploy of each repo is streamed at /logs/<key>/stream regardless.
+	LogDir string
+	// AdminToken, if set, enables the admin endpoints, which require it as
+	// a bearer token: POST /redeliver/<key> asks GitHub to redeliver the
+	// webhook of the repo's last deploy if it failed, and POST
+	// /rollback/<key>?to=<release> rolls a release or atomic mode repo back
+	// to the given or the previous release. POST /deploy/<key>?sha=<sha>
+	// queues a deploy of the branch's tip or the given commit, for CI
+	// pipelines and operators. /dashboard shows the repos to
+	// browsers, which log in with the token as basic auth password. The
+	// statuses, history, jobs and logs then require the token too.
+	AdminToken string
+	// SlackWebhookURL, if set, is the Slack incoming webhook the start
+	// and result of every deploy are posted to, unless the repo has a
+	// webhook of its own.
+	SlackWebhookURL string
+	// NotifyWebhooks are URLs a DeployEvent is posted to as JSON whenever
+	// a deploy is queued, starts, succeeds, fails or is rolled back, along
+	// with the repo's own.
+	NotifyWebhooks []string
+	// SMTPAddr, if set, is the host:port of the SMTP server failed deploys
+	// are emailed to EmailTo through, with the output of their commands
+	// attached. SMTPUsername and SMTPPassword, if set, authenticate with
+	// PLAIN auth, which net/smtp only allows over TLS or to localhost.
+	// SMTPFrom is the sender address, which defaults to
+	// github-sync@<hostname>. EmailAfterFailures is the number of deploys
+	// of a repo that have to fail in a row before they are emailed, at
+	// most HistorySize. Defaults to 1.
+	SMTPAddr           string
+	SMTPUsername       string
+	SMTPPassword       string
+	SMTPFrom           string
+	EmailTo            []string
+	EmailAfterFailures int
+	// CommitStatuses sets a deploy/github-sync commit status on the
+	// deployed commit of GitHub repos when their deploy starts, succeeds
+	// or fails. The token needs the repo:status scope, or the app the
+	// commit statuses write permission.
+	CommitStatuses bool
+	// Deployments creates a GitHub deployment to the repo's environment
+	// for every deploy of a GitHub repo and sets its status as it
+	// progresses, so that the repo's environments show what is live. The
+	// token needs the repo_deployment scope, or the app the deployments
+	// write permission.
+	Deployments bool
+	// LockWait is how long to wait for the lock of a checkout held by
+	// another github-sync instance before giving up. Defaults to 30s.
+	LockWait time.Duration
+	// UnitDir is where unit files are generated for services with a start
+	// command. Defaults to /etc/systemd/system.
+	UnitDir string
+	// MaintenanceInterval, if set, is how often `git gc --auto` is run on
+	// every checkout.
+	MaintenanceInterval time.Duration
+}
+
+// Server syncs the configured repos, registers their webhooks and deploys
+// the pushes delivered to its handler. It serves the webhooks at / and
+// /hooks/<owner>/<name>, the last deploy of each repo at /status, its
+// recent deploys at /status/<key>, the output of its running deploy at
+// /logs/<key>/stream, each queued deploy at /jobs/<id>, the depth of the
+// deploy queue at /queue, Prometheus metrics at /metrics and its readiness
+// at /healthz.
+type Server struct {
+	cfg Config
+	// repos is the repos config. It is only read from disk by New and
+	// Reload, which swap it atomically.
+	repos atomic.Pointer[map[string]Repo]
+	// discovered are the IDs of the repos discovered on
+	// Config.DiscoverOwner.
+	discovered atomic.Pointer[[]string]
+	// syncMu serializes SyncAll and ReloadAndSync.
+	syncMu sync.Mutex
+	// stateMu guards state once hooks are retried in the background.
+	stateMu sync.Mutex
+	state   *State
+	// tokenSource returns the token git should authenticate with. It is
+	// called for every git invocation so that short-lived tokens are
+	// never stale.
+	tokenSource func() (string, error)
+
+	statuses   *StatusStore
+	history    *History
+	logs       *LogStore
+	jobs       *JobStore
+	metrics    *Metrics
+	inflight   *DeployTracker
+	dispatcher *Dispatcher
+	audit      *AuditLog
+	historyDB  *HistoryDB
+	approvals  *CommandApprovals
+	// locks are the checkout locks held and repoMus the in-process locks
+	// of each repo, by config key.
+	locksMu sync.Mutex
+	locks   map[string]*os.File
+	repoMus map[string]*sync.Mutex
+	// watchdogs are the running watchdogs by config key, nil until
+	// StartBackground.
+	watchdogsMu sync.Mutex
+	watchdogs   map[string]*runningWatchdog
+	// ready is set once the startup sync has finished.
+	ready atomic.Bool
+	mux   *http.ServeMux
+}
+
+// New loads the repos config and the state and checks that the token can
+// manage the repos' hooks. Deploys delivered to the Server are held until
+// SyncAll has finished.
+func New(cfg Config) (*Server, error) {
+	if cfg.Root == "" {
+		cfg.Root = util.HomeDir()
+	}
+	if cfg.ConfigFile == "" {
+		cfg.ConfigFile = DefaultConfigFile(cfg.Root)
+	}
+	if cfg.StateFile == "" {
+		cfg.StateFile = filepath.Join(cfg.Root, ".github-sync-state.json")
+	}
+	if cfg.ConfigRepoDir == "" {
+		cfg.ConfigRepoDir = filepath.Join(cfg.Root, ".github-sync-config")
+	}
+	if cfg.ConfigRepoPath == "" {
+		cfg.ConfigRepoPath = "repos.json"
+	}
+	if cfg.DiscoverTopic == "" {
+		cfg.DiscoverTopic = "github-sync"
+	}
+	if cfg.DiscoverInterval <= 0 {
+		cfg.DiscoverInterval = 10 * time.Minute
+	}
+	if cfg.SSHKeyDir == "" {
+		cfg.SSHKeyDir = filepath.Join(cfg.Root, ".github-sync-keys")
+	}
+	if cfg.SyncWorkers <= 0 {
+		cfg.SyncWorkers = 4
+	}
+	if cfg.MaxConcurrentDeploys <= 0 {
+		cfg.MaxConcurrentDeploys = 4
+	}
+	if cfg.MaxQueueDepth <= 0 {
+		cfg.MaxQueueDepth = 100
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = 25 << 20
+	}
+	if cfg.LockWait <= 0 {
+		cfg.LockWait = 30 * time.Second
+	}
+	if cfg.UnitDir == "" {
+		cfg.UnitDir = "/etc/systemd/system"
+	}
+	if cfg.GitBinary == "" {
+		cfg.GitBinary = "git"
+	}
+	if sameURL(cfg.GitHubURL, "https://github.com") {
+		cfg.GitHubURL = ""
+	}
+	if u, err := url.Parse(cfg.GitHubURL); cfg.GitHubURL != "" && (err != nil || u.Scheme != "https" || u.Host == "") {
+		return nil, fmt.Errorf("GITHUB_URL %q must be an https URL", cfg.GitHubURL)
+	}
+	if cfg.ExternalURL != "" {
+		var err error
+		cfg.ExternalURL, err = checkExternalURL(cfg.ExternalURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Server{
+		cfg: cfg,
+		tokenSource: func() (string, error) {
+			return cfg.Token, nil
+		},
+		statuses:  &StatusStore{},
+		history:   &History{Size: cfg.HistorySize},
+		logs:      &LogStore{Dir: cfg.LogDir},
+		jobs:      &JobStore{},
+		metrics:   &Metrics{},
+		inflight:  NewDeployTracker(),
+		audit:     &AuditLog{Path: cfg.AuditLog},
+		approvals: &CommandApprovals{},
+	}
+	if cfg.AppID != 0 {
+		key, err := readAppKey(cfg.AppPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("GITHUB_APP_PRIVATE_KEY: %s", err)
+		}
+		app := &GitHubApp{
+			ID:             cfg.AppID,
+			Key:            key,
+			InstallationID: cfg.AppInstallationID,
+			API:            githubAPIURL(cfg.GitHubURL),
+		}
+		s.tokenSource = app.Token
+	}
+	s.dispatcher = NewDispatcher(cfg.MaxConcurrentDeploys, s.runJob)
+	s.dispatcher.MaxDepth = cfg.MaxQueueDepth
+	s.dispatcher.Superseded = s.jobs.Supersede
+	s.dispatcher.Hold()
+
+	if cfg.ConfigRepo != "" {
+		err := s.pullConfigRepo(context.Background())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.DiscoverOwner != "" {
+		_, err := s.discover()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+	s.state, err = readState(cfg.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.HistoryDB != "" {
+		s.historyDB, err = OpenHistoryDB(cfg.HistoryDB)
+		if err != nil {
+			return nil, fmt.Errorf("opening history database: %s", err)
+		}
+	}
+	recs, err := s.deployRecords("", 0)
+	if err != nil {
+		return nil, fmt.Errorf("reading deploy history: %s", err)
+	}
+	s.history.Load(recs)
+
+	// Fail early if the token can't manage hooks
+	repoIDs := map[string][]string{}
+	providers := map[string]bool{}
+	for _, repo := range s.config() {
+		providers[repo.provider()] = true
+		if repo.provider() == providerGitHub && !includes(repoIDs[repo.Host], repo.ID) {
+			repoIDs[repo.Host] = append(repoIDs[repo.Host], repo.ID)
+		}
+	}
+	if cfg.ConfigRepo != "" && !includes(repoIDs[cfg.GitHubURL], cfg.ConfigRepo) {
+		providers[providerGitHub] = true
+		repoIDs[cfg.GitHubURL] = append(repoIDs[cfg.GitHubURL], cfg.ConfigRepo)
+	}
+	if providers[providerGitLab] && cfg.GitLabToken == "" {
+		return nil, errors.New("GITLAB_TOKEN is required for GitLab repos")
+	}
+	if providers[providerGitea] && cfg.GiteaToken == "" {
+		return nil, errors.New("GITEA_TOKEN is required for Gitea repos")
+	}
+	if providers[providerBitbucket] && (cfg.BitbucketUsername == "" || cfg.BitbucketAppPassword == "") {
+		return nil, errors.New("BITBUCKET_USERNAME and BITBUCKET_APP_PASSWORD are required for Bitbucket repos")
+	}
+	_, githubCom := repoIDs[""]
+	if cfg.IPAllowlist && len(providers) > 0 && (len(providers) > 1 || len(repoIDs) > 1 || !githubCom) {
+		return nil, errors.New("GITHUB_IP_ALLOWLIST would reject the hooks of repos not on github.com")
+	}
+	if len(providers) == 0 {
+		repoIDs[cfg.GitHubURL] = nil
+	}
+	for host, ids := range repoIDs {
+		if cfg.Token == "" && cfg.AppID == 0 {
+			return nil, errors.New("GITHUB_TOKEN or GITHUB_APP_ID is required for GitHub repos")
+		}
+		if cfg.AppID != 0 {
+			token, err := s.tokenSource()
+			if err != nil {
+				return nil, err
+			}
+			err = checkHookAccess(githubAPIURL(host), token, ids)
+		} else {
+			err = checkToken(githubAPIURL(host), cfg.Token, ids)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Only run approved commands in safe mode
+	if cfg.RequireApprovedCommands {
+		s.approvals.Enable(s.state.ApprovedCommands)
+		for key, repo := range s.config() {
+			for _, c := range repo.deployCommands() {
+				if c.cmd == "" {
+					continue
+				}
+				if cfg.ApproveCommands {
+					slog.Info("Approving "+c.field+" command", "repo", key, "command", c.cmd)
+					s.approvals.Approve(c.cmd)
+				} else if err := s.approvals.Check(c.cmd); err != nil {
+					slog.Warn("Repo will not deploy", "repo", key, "field", c.field, "err", err)
+				}
+			}
+			if repo.OnFailure != "" {
+				if cfg.ApproveCommands {
+					slog.Info("Approving on_failure command", "repo", key, "command", repo.OnFailure)
+					s.approvals.Approve(repo.OnFailure)
+				} else if err := s.approvals.Check(repo.OnFailure); err != nil {
+					slog.Warn("on_failure will not run", "repo", key, "err", err)
+				}
+			}
+		}
+		s.state.ApprovedCommands = s.approvals.List()
+	}
+
+	handler := s.webhookHandler
+	if cfg.IPAllowlist {
+		ranges := &HookRanges{}
+		err = ranges.Refresh(cfg.Token)
+		if err != nil {
+			slog.Error("Fetching GitHub hook ranges failed, allowing all sources until refresh succeeds", "err", err)
+		}
+		go ranges.RefreshLoop(cfg.Token)
+		handler = ranges.Middleware(cfg.TrustedProxyDepth, handler)
+	}
+	s.routes(s.countDeliveries(handler))
+	return s, nil
+}
+
+// routes sets up s.mux, delivering webhooks to handler. Deploy output,
+// which routinely contains secrets, and the statuses and history are only
+// served to admins if Config.AdminToken is set.
+func (s *Server) routes(handler http.HandlerFunc) {
+	private := func(h http.HandlerFunc) http.HandlerFunc {
+		if s.cfg.AdminToken == "" {
+			return h
+		}
+		return s.requireAdmin(h)
+	}
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/", handler)
+	s.mux.HandleFunc("/hooks/", handler)
+	s.mux.HandleFunc("/status", private(s.statuses.ServeHTTP))
+	s.mux.HandleFunc("/status/", private(s.historyHandler))
+	s.mux.HandleFunc("/history", private(s.auditHandler))
+	s.mux.HandleFunc("/healthz", s.healthzHandler)
+	s.mux.Handle("/queue", s.dispatcher)
+	s.mux.HandleFunc("/metrics", s.metricsHandler)
+	s.mux.HandleFunc("/jobs/", private(s.jobs.ServeHTTP))
+	s.mux.HandleFunc("/logs/", private(s.logsHandler))
+	if s.cfg.AdminToken != "" {
+		s.mux.HandleFunc("/redeliver/", s.requireAdmin(s.redeliverHandler))
+		s.mux.HandleFunc("/rollback/", s.requireAdmin(s.rollbackHandler))
+		s.mux.HandleFunc("/deploy/", s.requireAdmin(s.deployHandler))
+		s.mux.HandleFunc("/dashboard", s.requireAdmin(s.dashboardHandler))
+		s.mux.HandleFunc("/dashboard/", s.requireAdmin(s.dashboardHandler))
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Reload reads the repos config from disk and swaps it in for the webhook
+// handler. Repos added to the config aren't cloned until SyncAll or
+// ReloadAndSync runs.
+func (s *Server) Reload() error {
+	repos, err := s.loadConfig()
+	if err != nil {
+		return err
+	}
+	s.warnUnsigned(repos)
+	s.repos.Store(&repos)
+	return nil
+}
+
+// config returns the repos config currently in effect. It must not be
+// modified.
+func (s *Server) config() map[string]Repo {
+	return *s.repos.Load()
+}
+
+// SyncAll clones or pulls every repo and registers its hook, then cleans
+// up the repos that were removed from the config and saves the state.
+// Deploys delivered in the meantime start once it returns.
+func (s *Server) SyncAll(ctx context.Context) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	err := s.syncRepos(ctx, s.config(), s.config())
+	if err != nil {
+		return err
+	}
+	if s.cfg.ConfigRepo != "" {
+		s.registerConfigHook()
+	}
+
+	// Start processing deploys
+	s.dispatcher.Release()
+	s.ready.Store(true)
+	return nil
+}
+
+// ReloadAndSync pulls the config repo if there is one, reloads the repos
+// config and applies it without a restart: repos that were added or whose
+// entry changed are cloned or pulled and get their hook registered, and
+// the ones that were removed are cleaned up like by SyncAll. Their
+// watchdogs are restarted or stopped. Deploys keep running meanwhile.
+func (s *Server) ReloadAndSync(ctx context.Context) error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+	old := s.config()
+	if s.cfg.ConfigRepo != "" {
+		err := s.pullConfigRepo(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	err := s.Reload()
+	if err != nil {
+		return err
+	}
+	s.reconcileWatchdogs()
+	changed := map[string]Repo{}
+	for key, repo := range s.config() {
+		if prev, ok := old[key]; !ok || !reflect.DeepEqual(prev, repo) {
+			changed[key] = repo
+		}
+	}
+	slog.Info("Reloaded config", "repos", len(s.config()), "changed", len(changed))
+	return s.syncRepos(ctx, s.config(), changed)
+}
+
+// syncRepos syncs repos, entries of config, then cleans up the repos
+// that aren't in config and saves the state.
+func (s *Server) syncRepos(ctx context.Context, config, repos map[string]Repo) error {
+	// Subscribe to the events of every entry of a repo
+	events := map[string][]string{}
+	for _, repo := range config {
+		for _, event := range repo.hookEvents() {
+			if !includes(events[repo.ID], event) {
+				events[repo.ID] = append(events[repo.ID], event)
+			}
+		}
+	}
+
+	// Sync the checkouts in parallel, then fail if any of them failed
+	results := s.syncCheckouts(ctx, repos)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	synced := []string{}
+	failed := []error{}
+	for _, key := range sortedKeys(results) {
+		err := results[key]
+		if errors.Is(err, errNotGitRepo) || errors.Is(err, errBranchNotFound) || errors.Is(err, errBadWorkdir) {
+			// Leave the directory alone but keep syncing the other repos
+			slog.Error("Syncing failed", "repo", key, "err", err)
+			continue
+		}
+		if err != nil {
+			failed = append(failed, fmt.Errorf("syncing %s: %s", key, err))
+			continue
+		}
+		synced = append(synced, key)
+	}
+	if len(failed) > 0 {
+		return errors.Join(failed...)
+	}
+
+	hookIDs := map[string]int64{}
+	unregistered := map[string]Repo{}
+	for _, key := range synced {
+		repo := repos[key]
+		path := s.repoPath(key, repo)
+		var err error
+
+		// Register one hook per repo, even if several branches are deployed
+		hookID, ok := hookIDs[repo.ID]
+		if !ok {
+			hookID, err = s.provider(repo.provider(), repo.Host).RegisterHook(repo.ID, repoHookURL(s.cfg.ExternalURL, repo.ID), s.cfg.ExternalURL, events[repo.ID], s.webhookSecret(repo.ID))
+			if err != nil {
+				// Serve the other repos and keep trying in the background
+				slog.Error("Registering hook failed, retrying in the background", "repo", repo.ID, "err", err)
+				unregistered[repo.ID] = repo
+			}
+			hookIDs[repo.ID] = hookID
+		}
+		s.statuses.SetHook(key, hookID != 0)
+		rs := &RepoState{
+			RepoID:   repo.ID,
+			Provider: repo.Provider,
+			Host:     repo.Host,
+			HookID:   hookID,
+			Path:     path,
+		}
+		if repo.Mode != "release" {
+			// Keep the hook in the state so that it is still cleaned up,
+			// and fall back to the default branch in push payloads
+			rs.Branch, err = s.trackedBranch(ctx, repo.checkout(path), repo)
+			if err != nil {
+				slog.Error("Resolving tracked branch failed", "repo", key, "err", err)
+			}
+		}
+		s.stateMu.Lock()
+		s.state.Repos[key] = rs
+		s.stateMu.Unlock()
+	}
+
+	// Clean up repos that were removed from the config, which can't be
+	// told apart from filtered out ones
+	s.stateMu.Lock()
+	if len(s.cfg.RepoFilter) == 0 {
+		s.pruneRemoved(config, s.state, s.cfg.PruneDirs)
+	}
+	err := s.state.Save(s.cfg.StateFile)
+	s.stateMu.Unlock()
+	if err != nil {
+		return err
+	}
+	for repoID, repo := range unregistered {
+		go s.retryHook(repo, events[repoID])
+	}
+	return nil
+}
+
+// syncCheckout makes sure path holds an up to date checkout of the repo
+// with the given key, along with its unit file, while no deploy of it
+// runs.
+func (s *Server) syncCheckout(ctx context.Context, key, path string, repo Repo) error {
+	mu := s.repoMutex(key)
+	mu.Lock()
+	defer mu.Unlock()
+	err := s.lock(key, path)
+	if err != nil {
+		return err
+	}
+	if repo.SSH {
+		err = s.setupSSHKey(ctx, repo)
+		if err != nil {
+			return err
+		}
+	}
+	if repo.Mode == "release" {
+		err = s.syncRelease(ctx, path, repo)
+	} else if repo.Mode == "atomic" {
+		err = s.syncAtomic(ctx, path, repo)
+	} else {
+		err = s.checkRemoteBranch(ctx, repo)
+		if err == nil {
+			err = s.syncRepo(ctx, path, repo)
+		}
+	}
+	if err == nil {
+		err = repo.checkWorkdir(path)
+	}
+	if err == nil {
+		if unitErr := s.syncUnit(ctx, path, repo); unitErr != nil {
+			slog.Error("Generating unit failed", "repo", key, "err", unitErr)
+		}
+	}
+	return err
+}
+
+// Deploy deploys the repo with the given config key and waits for the
+// deploy to finish. The key is the repo's owner/name, or owner/name@branch
+// if several branches of it are configured. The deploy runs after those of
+// the repo that are already queued, and is cancelled if ctx is.
+func (s *Server) Deploy(ctx context.Context, key string) error {
+	job, err := s.manualJob(ctx, key)
+	if err != nil {
+		return err
+	}
+	job.done = make(chan error, 1)
+	s.jobs.Add(job)
+	s.dispatcher.EnqueueNow(job)
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// manualJob returns a job deploying the branch tip, or in release mode the
+// latest release, of the repo with the given config key.
+func (s *Server) manualJob(ctx context.Context, key string) (*Job, error) {
+	repo, ok := s.config()[key]
+	if !ok {
+		return nil, fmt.Errorf("repo %s not configured", key)
+	}
+	if !repo.enabled() {
+		return nil, fmt.Errorf("repo %s is disabled", key)
+	}
+	job := &Job{
+		Key:    key,
+		Repo:   repo,
+		Path:   s.repoPath(key, repo),
+		Status: &DeployStatus{Repo: key},
+		ctx:    ctx,
+	}
+	if repo.Mode == "release" {
+		token, err := s.tokenSource()
+		if err != nil {
+			return nil, err
+		}
+		job.Release, err = latestRelease(githubAPIURL(repo.Host), token, repo.ID)
+		if err != nil {
+			return nil, err
+		}
+		job.Status.SHA = job.Release.TagName
+	}
+	if repo.deploysTags() {
+		tag, err := s.latestTag(ctx, job.Path, repo)
+		if err != nil {
+			return nil, err
+		}
+		if tag == "" {
+			return nil, fmt.Errorf("repo %s has no tag to deploy", key)
+		}
+		job.Tag = tag
+		job.Status.SHA = tag
+	}
+	return job, nil
+}
+
+// StartBackground starts the watchdogs of the repos and, if configured,
+// the periodic git maintenance and repo discovery.
+func (s *Server) StartBackground() {
+	s.watchdogsMu.Lock()
+	s.watchdogs = map[string]*runningWatchdog{}
+	s.watchdogsMu.Unlock()
+	s.reconcileWatchdogs()
+	if s.cfg.MaintenanceInterval > 0 {
+		go s.maintenanceLoop(s.cfg.MaintenanceInterval)
+	}
+	if s.cfg.DiscoverOwner != "" {
+		go s.discoveryLoop(s.cfg.DiscoverInterval)
+	}
+}
+
+// Drain waits up to grace for running deploys to finish, then cancels the
+// remaining ones and waits for them to clean up. Queued deploys are
+// dropped rather than started. The checkout locks are released once all
+// deploys are done.
+func (s *Server) Drain(grace time.Duration) {
+	s.dispatcher.Hold()
+	for _, j := range s.dispatcher.Drop() {
+		slog.Warn("Dropping queued deploy", "job", j.ID, "repo", j.Key)
+		if j.done != nil {
+			j.done <- errShuttingDown
+		}
+	}
+	s.inflight.Drain(grace)
+	s.unlockAll()
+}
+
+// repoPath returns the checkout directory of repo, the entry with the
+// given config key: repo.Path, relative to Config.Root unless absolute,
+// or else a directory in Config.Root named after the key.
+func (s *Server) repoPath(key string, repo Repo) string {
+	if repo.Path != "" {
+		if filepath.IsAbs(repo.Path) {
+			return filepath.Clean(repo.Path)
+		}
+		return filepath.Join(s.cfg.Root, repo.Path)
+	}
+	return filepath.Join(s.cfg.Root, defaultRepoDir(key))
+}
+
+// defaultRepoDir returns the directory the entry with the given config key
+// is checked out to by default. Keys of the form owner/name@branch are
+// checked out to name-branch, with the slashes of the branch replaced by
+// dashes, and the apps owner/name:app of monorepo entries to name-app.
+// GitLab keys with subgroups are checked out by the last part of the path.
+func defaultRepoDir(key string) string {
+	key, app, isApp := strings.Cut(key, ":")
+	id, branch, ok := strings.Cut(key, "@")
+	name := id[strings.LastIndex(id, "/")+1:]
+	if ok {
+		name += "-" + strings.ReplaceAll(branch, "/", "-")
+	}
+	if isApp {
+		name += "-" + app
+	}
+	return name
+}
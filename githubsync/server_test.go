@@ -0,0 +1,53 @@
+package githubsync
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrivateRoutes(t *testing.T) {
+	paths := []string{"/status", "/status/app", "/history", "/jobs/1", "/logs/app/stream"}
+	for _, token := range []string{"", "secret"} {
+		s := newTestServer(t, t.TempDir(), map[string]Repo{})
+		s.cfg.AdminToken = token
+		s.routes(s.webhookHandler)
+		for _, path := range paths {
+			rec := httptest.NewRecorder()
+			s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			if unauthorized := rec.Code == http.StatusUnauthorized; unauthorized != (token != "") {
+				t.Errorf("token %q: GET %s without a token returned %d", token, path, rec.Code)
+			}
+			if token == "" {
+				continue
+			}
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec = httptest.NewRecorder()
+			s.mux.ServeHTTP(rec, req)
+			if rec.Code == http.StatusUnauthorized {
+				t.Errorf("GET %s with the admin token returned %d", path, rec.Code)
+			}
+		}
+	}
+}
+
+func TestDefaultRepoDir(t *testing.T) {
+	tests := []struct {
+		key, want string
+	}{
+		{"o/app", "app"},
+		{"o/app@main", "app-main"},
+		{"o/app@feature/a", "app-feature-a"},
+		{"o/app@feature/b", "app-feature-b"},
+		{"o/app@user/x/y", "app-user-x-y"},
+		{"o/app:web", "app-web"},
+		{"o/app@feature/a:web", "app-feature-a-web"},
+		{"group/sub/app", "app"},
+	}
+	for _, tt := range tests {
+		if got := defaultRepoDir(tt.key); got != tt.want {
+			t.Errorf("defaultRepoDir(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package githubsync
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// checkSignature verifies the X-Hub-Signature-256 header of a delivery,
+// the hex HMAC-SHA256 of its body keyed with secret.
+func checkSignature(secret string, body []byte, header string) error {
+	sig, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return errors.New("missing X-Hub-Signature-256")
+	}
+	return checkHMAC(secret, body, sig, "X-Hub-Signature-256")
+}
+
+// checkHMAC verifies sig, the hex HMAC-SHA256 of body keyed with secret,
+// which was sent in the header named header.
+func checkHMAC(secret string, body []byte, sig, header string) error {
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("malformed %s", header)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errors.New("signature doesn't match the webhook secret")
+	}
+	return nil
+}
+
+// webhookSecret returns the secret the hook of repoID is registered with:
+// the webhook_secret of its entries, or Config.WebhookSecret. Entries
+// deploying branches of the same repo share its hook and so its secret.
+func (s *Server) webhookSecret(repoID string) string {
+	for _, repo := range s.config() {
+		if repo.ID == repoID && repo.WebhookSecret != "" {
+			return repo.WebhookSecret
+		}
+	}
+	return s.cfg.WebhookSecret
+}
+
+// warnUnsigned warns about every repo in repos whose deliveries aren't
+// authenticated because neither it nor the Server has a webhook secret,
+// so that anyone who can reach the handler can trigger its deploys.
+func (s *Server) warnUnsigned(repos map[string]Repo) {
+	if s.cfg.WebhookSecret != "" {
+		return
+	}
+	if s.cfg.ConfigRepo != "" {
+		slog.Warn("No WEBHOOK_SECRET, pushes to the config repo are not authenticated", "repo", s.cfg.ConfigRepo)
+	}
+	for _, key := range sortedKeys(repos) {
+		if repos[key].WebhookSecret == "" {
+			slog.Warn("No webhook secret, deliveries for the repo are not authenticated", "repo", key)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package githubsync
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// sign returns the hex HMAC-SHA256 of body keyed with secret.
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestCheckSignature(t *testing.T) {
+	body := []byte(`{"ref":"refs/heads/main"}`)
+	tests := []struct {
+		name, header, wantErr string
+	}{
+		{"valid", "sha256=" + sign("secret", string(body)), ""},
+		{"wrong secret", "sha256=" + sign("other", string(body)), "doesn't match"},
+		{"other body", "sha256=" + sign("secret", "{}"), "doesn't match"},
+		{"malformed", "sha256=zz", "malformed X-Hub-Signature-256"},
+		{"sha1", "sha1=" + sign("secret", string(body)), "missing X-Hub-Signature-256"},
+		{"missing", "", "missing X-Hub-Signature-256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSignature("secret", body, tt.header)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("checkSignature() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckHMAC(t *testing.T) {
+	body := []byte("payload")
+	if err := checkHMAC("secret", body, sign("secret", "payload"), "X-Sig"); err != nil {
+		t.Errorf("valid signature: %v", err)
+	}
+	if err := checkHMAC("secret", body, sign("secret", "other"), "X-Sig"); err == nil {
+		t.Error("accepted the signature of another body")
+	}
+	if err := checkHMAC("secret", body, "", "X-Sig"); err == nil {
+		t.Error("accepted an empty signature")
+	}
+	if err := checkHMAC("secret", body, "not hex", "X-Sig"); err == nil || !strings.Contains(err.Error(), "malformed X-Sig") {
+		t.Errorf("malformed signature: %v", err)
+	}
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	const body = `{"ref":"refs/heads/main"}`
+	good, bad := sign("secret", body), sign("other", body)
+	tests := []struct {
+		name     string
+		provider Provider
+		header   string
+		valid    string
+		invalid  string
+	}{
+		{"github", &githubProvider{}, "X-Hub-Signature-256", "sha256=" + good, "sha256=" + bad},
+		{"gitlab", &gitlabProvider{}, "X-Gitlab-Token", "secret", "other"},
+		{"gitea", &giteaProvider{}, "X-Gitea-Signature", good, bad},
+		{"forgejo", &giteaProvider{}, "X-Forgejo-Signature", good, bad},
+		{"bitbucket", &bitbucketProvider{}, "X-Hub-Signature", "sha256=" + good, "sha256=" + bad},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, c := range []struct {
+				name, value string
+				ok          bool
+			}{
+				{"valid", tt.valid, true},
+				{"invalid", tt.invalid, false},
+				{"missing", "", false},
+			} {
+				r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+				if c.value != "" {
+					r.Header.Set(tt.header, c.value)
+				}
+				err := tt.provider.VerifyWebhook(r, []byte(body), "secret")
+				if (err == nil) != c.ok {
+					t.Errorf("%s signature: VerifyWebhook() = %v", c.name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookRequiresSignature(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), map[string]Repo{"o/app": {ID: "o/app", Branch: "main"}})
+	s.cfg.WebhookSecret = "secret"
+	s.dispatcher = NewDispatcher(1, func(j *Job) {})
+	w := postWebhook(s, "push", pushPayload(strings.Repeat("a", 40)))
+	if w.Code != 401 || len(s.jobs.order) != 0 {
+		t.Fatalf("unsigned delivery: got %d %s with %d jobs", w.Code, w.Body, len(s.jobs.order))
+	}
+}
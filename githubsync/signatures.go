@@ -0,0 +1,83 @@
+package githubsync
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// sshKeyFingerprint matches the key fingerprint in ssh-keygen's report of
+// a good signature.
+var sshKeyFingerprint = regexp.MustCompile(`key (SHA256:[A-Za-z0-9+/=]+)`)
+
+// verifyCommit checks that sha carries a valid signature, by one of
+// repo.AllowedKeys if set.
+func (s *Server) verifyCommit(ctx context.Context, path, sha string, repo Repo) error {
+	return s.verifySignature(ctx, path, "commit", sha, repo)
+}
+
+// verifySignature checks that ref, a commit or a tag as kind says,
+// carries a valid signature, by one of repo.AllowedKeys if set. SSH
+// signatures are checked against repo.AllowedSigners, GPG signatures
+// against the keyring of the user github-sync runs as.
+func (s *Server) verifySignature(ctx context.Context, path, kind, ref string, repo Repo) error {
+	args := []string{"verify-" + kind, "--raw", "--", ref}
+	if repo.AllowedSigners != "" {
+		args = append([]string{"-c", "gpg.ssh.allowedSignersFile=" + repo.AllowedSigners}, args...)
+	}
+	cmd := s.gitCommand(ctx, args...)
+	cmd.Dir = path
+	b, err := cmd.CombinedOutput()
+	out := strings.TrimSpace(string(b))
+	slog.Info("git verify-"+kind, "ref", ref, "output", out)
+	if err != nil {
+		return fmt.Errorf("%s %s is not signed by a trusted key: %s", kind, ref, out)
+	}
+	if len(repo.AllowedKeys) == 0 {
+		return nil
+	}
+	keys := signingKeys(out)
+	for _, key := range keys {
+		if allowedKey(repo.AllowedKeys, key) {
+			return nil
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s %s is signed by an unknown key", kind, ref)
+	}
+	return fmt.Errorf("%s %s is signed by %s, which is not an allowed key", kind, ref, keys[0])
+}
+
+// signingKeys returns the fingerprints of the key a good signature was
+// made with, as reported by git verify-commit or verify-tag --raw: for
+// GPG the signing key and its primary key, for SSH the key.
+func signingKeys(out string) []string {
+	keys := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "[GNUPG:]" && fields[1] == "VALIDSIG" {
+			keys = append(keys, fields[2])
+			if len(fields) >= 12 {
+				keys = append(keys, fields[11])
+			}
+		}
+		if m := sshKeyFingerprint.FindStringSubmatch(line); m != nil {
+			keys = append(keys, m[1])
+		}
+	}
+	return keys
+}
+
+// allowedKey reports whether the fingerprint key is one of allowed. GPG
+// fingerprints may be written in any case and with spaces.
+func allowedKey(allowed []string, key string) bool {
+	for _, a := range allowed {
+		a = strings.ReplaceAll(a, " ", "")
+		if a == key || !strings.HasPrefix(key, "SHA256:") && strings.EqualFold(a, key) {
+			return true
+		}
+	}
+	return false
+}
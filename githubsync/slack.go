@@ -0,0 +1,66 @@
+package githubsync
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// SlackMessage is the payload of a Slack incoming webhook.
+type SlackMessage struct {
+	// Channel overrides the webhook's channel, which only legacy webhooks
+	// honor.
+	Channel string `json:"channel,omitempty"`
+	Text    string `json:"text"`
+}
+
+// notifySlack posts event of j's deploy from branch to the repo's Slack
+// webhook or Config.SlackWebhookURL, if any. Queued deploys aren't posted.
+func (s *Server) notifySlack(j *Job, branch, event string, err error) {
+	webhookURL := j.Repo.SlackWebhookURL
+	if webhookURL == "" {
+		webhookURL = s.cfg.SlackWebhookURL
+	}
+	if webhookURL == "" || event == EventQueued {
+		return
+	}
+	msg := &SlackMessage{
+		Channel: j.Repo.SlackChannel,
+		Text:    slackText(j, branch, event, err),
+	}
+	go func() {
+		err := postJSON(webhookURL, msg)
+		if err != nil {
+			slog.Error("Posting to Slack failed", "repo", j.Key, "err", err)
+		}
+	}()
+}
+
+// slackText returns the text of the Slack message about event of j's
+// deploy from branch.
+func slackText(j *Job, branch, event string, err error) string {
+	st := j.Status
+	what := fmt.Sprintf("*%s* (%s", j.Key, branch)
+	if st.SHA != "" {
+		what += fmt.Sprintf("@%.12s", st.SHA)
+	}
+	what += ")"
+	if st.Pusher != "" {
+		what += " pushed by " + st.Pusher
+	}
+	took := st.Duration.Round(time.Millisecond)
+	switch {
+	case event == EventStarted:
+		return ":rocket: Deploying " + what
+	case st.Fallback != "":
+		return fmt.Sprintf(":warning: Deploying %s failed, deployed fallback %s in %s: %s", what, st.Fallback, took, err)
+	case event == EventRolledBack && err != nil:
+		return fmt.Sprintf(":warning: Deploying %s failed after %s: %s", what, took, err)
+	case event == EventRolledBack:
+		return fmt.Sprintf(":leftwards_arrow_with_hook: Rolled back %s in %s", what, took)
+	case event == EventFailed:
+		return fmt.Sprintf(":x: Deploying %s failed after %s: %s", what, took, err)
+	default:
+		return fmt.Sprintf(":white_check_mark: Deployed %s in %s", what, took)
+	}
+}
@@ -0,0 +1,144 @@
+package githubsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// sshURL returns the scp-like URL cloning the repo over SSH, e.g.
+// git@github.com:owner/name.git.
+func (r Repo) sshURL() string {
+	host := "github.com"
+	if u, err := url.Parse(r.hostURL()); err == nil {
+		host = u.Hostname()
+	}
+	return fmt.Sprintf("git@%s:%s.git", host, r.ID)
+}
+
+// sshKey returns the path of the private key the repo is cloned with.
+func (s *Server) sshKey(repo Repo) string {
+	if repo.SSHKey != "" {
+		return repo.SSHKey
+	}
+	return filepath.Join(s.cfg.SSHKeyDir, strings.ReplaceAll(repo.ID, "/", "_"))
+}
+
+// sshCommand returns the core.sshCommand git connects to repo's host with,
+// or "" if the repo isn't cloned over SSH. Hosts are trusted on first use.
+func (s *Server) sshCommand(repo Repo) string {
+	if !repo.SSH {
+		return ""
+	}
+	return fmt.Sprintf("ssh -i '%s' -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new", s.sshKey(repo))
+}
+
+// setupSSHKey generates the repo's key if it has none and, if
+// repo.DeployKey is set, registers its public half as a read-only deploy
+// key, so that it can be cloned.
+func (s *Server) setupSSHKey(ctx context.Context, repo Repo) error {
+	key := s.sshKey(repo)
+	_, err := os.Stat(key)
+	if errors.Is(err, os.ErrNotExist) && repo.SSHKey == "" {
+		slog.Info("Generating SSH key", "repo", repo.ID, "path", key)
+		err = os.MkdirAll(filepath.Dir(key), 0700)
+		if err != nil {
+			return err
+		}
+		cmd := exec.CommandContext(ctx, "ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "github-sync "+repo.ID, "-f", key)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("ssh-keygen: %s: %s", err, strings.TrimSpace(string(out)))
+		}
+	} else if err != nil {
+		return fmt.Errorf("ssh_key: %s", err)
+	}
+	if !repo.DeployKey {
+		return nil
+	}
+	pub, err := os.ReadFile(key + ".pub")
+	if err != nil {
+		return fmt.Errorf("deploy_key: %s", err)
+	}
+	token, err := s.tokenSource()
+	if err != nil {
+		return err
+	}
+	return registerDeployKey(githubAPIURL(repo.Host), token, repo.ID, strings.TrimSpace(string(pub)))
+}
+
+// DeployKey is a deploy key as the GitHub API represents it.
+type DeployKey struct {
+	ID       int64  `json:"id,omitempty"`
+	Title    string `json:"title"`
+	Key      string `json:"key"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+// registerDeployKey makes sure the public key pub is a read-only deploy key
+// of repoID. api is the base URL of the GitHub API.
+func registerDeployKey(api, ghToken, repoID, pub string) error {
+	// Get list of current keys
+	apiURL := fmt.Sprintf("%s/repos/%s/keys", api, repoID)
+	res, err := githubGet(ghToken, apiURL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return githubError(res, repoID)
+	}
+	keys := []DeployKey{}
+	err = json.NewDecoder(res.Body).Decode(&keys)
+	if err != nil {
+		return err
+	}
+
+	// Return early if the key is already registered. GitHub returns keys
+	// without their comment.
+	for _, key := range keys {
+		if sameKey(key.Key, pub) {
+			return nil
+		}
+	}
+
+	// Add the key
+	body, err := json.Marshal(DeployKey{
+		Title:    "github-sync",
+		Key:      pub,
+		ReadOnly: true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	req, err := http.NewRequest("POST", apiURL, bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", ghToken))
+	res, err = githubClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return githubError(res, repoID)
+	}
+	slog.Info("Registered deploy key", "repo", repoID)
+	return nil
+}
+
+// sameKey reports whether the authorized_keys lines a and b hold the same
+// key, ignoring their comments.
+func sameKey(a, b string) bool {
+	fa, fb := strings.Fields(a), strings.Fields(b)
+	return len(fa) >= 2 && len(fb) >= 2 && fa[0] == fb[0] && fa[1] == fb[1]
+}
@@ -0,0 +1,115 @@
+package githubsync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// State records what github-sync has set up for each repo so that it can
+// be cleaned up once the repo is removed from the config.
+type State struct {
+	Repos map[string]*RepoState `json:"repos"`
+	// ApprovedCommands are the checksums of approved install commands.
+	ApprovedCommands []string `json:"approved_commands,omitempty"`
+}
+
+type RepoState struct {
+	RepoID string `json:"repo_id"`
+	HookID int64  `json:"hook_id"`
+	Path   string `json:"path"`
+	// Provider and Host are those of the repo, so that its hook can be
+	// deleted once it's gone from the config.
+	Provider string `json:"provider,omitempty"`
+	Host     string `json:"host,omitempty"`
+	// Branch is the deployed branch, which for repos without a configured
+	// branch is the default branch of the remote.
+	Branch string `json:"branch,omitempty"`
+}
+
+func readState(path string) (*State, error) {
+	state := &State{Repos: map[string]*RepoState{}}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return state, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(b, state)
+	if err != nil {
+		return nil, err
+	}
+	if state.Repos == nil {
+		state.Repos = map[string]*RepoState{}
+	}
+	return state, nil
+}
+
+func (s *State) Save(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return os.WriteFile(path, b, 0600)
+}
+
+// pruneRemoved cleans up repos that are in the state but no longer in the
+// config. The repo's hook is deleted, and its checkout is removed only if
+// pruneDirs is set.
+func (s *Server) pruneRemoved(config map[string]Repo, state *State, pruneDirs bool) {
+	inUse := map[string]bool{}
+	for _, repo := range config {
+		inUse[repo.ID] = true
+	}
+	for key, rs := range state.Repos {
+		if _, ok := config[key]; ok {
+			continue
+		}
+		// Keep the hook while another branch of the repo is still deployed
+		if rs.HookID != 0 && !inUse[rs.RepoID] {
+			err := s.provider(rs.Provider, rs.Host).DeleteHook(rs.RepoID, rs.HookID)
+			if err != nil {
+				slog.Error("Deleting hook failed", "repo", key, "err", err)
+				continue
+			}
+		}
+		if pruneDirs && rs.Path != "" {
+			slog.Info("Removing checkout", "repo", key, "path", rs.Path)
+			err := os.RemoveAll(rs.Path)
+			if err != nil {
+				slog.Error("Removing checkout failed", "repo", key, "path", rs.Path, "err", err)
+				continue
+			}
+			os.Remove(lockPath(rs.Path))
+			os.RemoveAll(releasesDir(rs.Path))
+			os.RemoveAll(rs.Path + ".repo")
+		} else {
+			slog.Info("Repo is no longer managed, leaving its checkout in place", "repo", key, "path", rs.Path)
+		}
+		s.unlock(key)
+		delete(state.Repos, key)
+	}
+}
+
+func deleteHook(api, ghToken, repoID string, hookID int64) error {
+	apiURL := fmt.Sprintf("%s/repos/%s/hooks/%d", api, repoID, hookID)
+	req, err := http.NewRequest("DELETE", apiURL, nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", ghToken))
+	res, err := githubClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// A 404 means the hook is already gone.
+	if res.StatusCode != 204 && res.StatusCode != 404 {
+		return githubError(res, repoID)
+	}
+	return nil
+}
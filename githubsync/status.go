@@ -0,0 +1,126 @@
+package githubsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeployStatus describes the outcome of a single deploy.
+type DeployStatus struct {
+	Repo       string        `json:"repo"`
+	DeliveryID string        `json:"delivery_id"`
+	SHA        string        `json:"sha"`
+	Pusher     string        `json:"pusher"`
+	Author     string        `json:"author"`
+	Message    string        `json:"message"`
+	Time       time.Time     `json:"time"`
+	Duration   time.Duration `json:"duration"`
+	Error      string        `json:"error,omitempty"`
+	// Coalesced is the number of earlier pushes folded into this deploy.
+	Coalesced int `json:"coalesced,omitempty"`
+	// Fallback is the fallback ref that was deployed instead, if any.
+	Fallback string `json:"fallback,omitempty"`
+	// Dirty is what was done with local changes found in the checkout,
+	// stashed or discarded, if any.
+	Dirty string `json:"dirty,omitempty"`
+	// HookID is the id of the hook that delivered the push, which is
+	// needed to ask GitHub to redeliver it.
+	HookID int64 `json:"hook_id,omitempty"`
+	// Log is the file the output of the deploy was written to, if any.
+	Log string `json:"log,omitempty"`
+}
+
+func (s *DeployStatus) String() string {
+	msg := s.Message
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		msg = msg[:i]
+	}
+	out := fmt.Sprintf("%s@%s (delivery %s) pushed by %s: %q", s.Repo, s.SHA, s.DeliveryID, s.Pusher, msg)
+	if s.Dirty != "" {
+		out += " (local changes " + s.Dirty + ")"
+	}
+	if s.Duration > 0 {
+		if s.Fallback != "" {
+			out += fmt.Sprintf(" deployed fallback %s in %s: %s", s.Fallback, s.Duration, s.Error)
+		} else if s.Error != "" {
+			out += fmt.Sprintf(" failed in %s: %s", s.Duration, s.Error)
+		} else {
+			out += fmt.Sprintf(" ok in %s", s.Duration)
+		}
+	}
+	return out
+}
+
+// RepoStatus is what /status reports for each repo.
+type RepoStatus struct {
+	LastDeploy *DeployStatus  `json:"last_deploy,omitempty"`
+	Watchdog   *WatchdogEvent `json:"watchdog,omitempty"`
+	// Hook is "registered" or, while registration is being retried,
+	// "unregistered".
+	Hook string `json:"hook,omitempty"`
+}
+
+// StatusStore holds the most recent status of each repo.
+type StatusStore struct {
+	mu    sync.Mutex
+	repos map[string]*RepoStatus
+}
+
+// repo returns the status of key, creating it if needed. s.mu must be held.
+func (s *StatusStore) repo(key string) *RepoStatus {
+	if s.repos == nil {
+		s.repos = map[string]*RepoStatus{}
+	}
+	rs, ok := s.repos[key]
+	if !ok {
+		rs = &RepoStatus{}
+		s.repos[key] = rs
+	}
+	return rs
+}
+
+// Set records a copy of status as the last deploy of its repo.
+func (s *StatusStore) Set(status *DeployStatus) {
+	st := *status
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.repo(status.Repo).LastDeploy = &st
+}
+
+// Last returns the status of the last deploy of key, or nil if there was
+// none yet.
+func (s *StatusStore) Last(key string) *DeployStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rs, ok := s.repos[key]; ok {
+		return rs.LastDeploy
+	}
+	return nil
+}
+
+func (s *StatusStore) SetWatchdog(key string, event *WatchdogEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.repo(key).Watchdog = event
+}
+
+// SetHook records whether the hook of key is registered.
+func (s *StatusStore) SetHook(key string, registered bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.repo(key).Hook = "unregistered"
+	if registered {
+		s.repo(key).Hook = "registered"
+	}
+}
+
+func (s *StatusStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.repos)
+}
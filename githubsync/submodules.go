@@ -0,0 +1,13 @@
+package githubsync
+
+import "context"
+
+// updateSubmodules checks out the submodule commits recorded by the commit
+// checked out at path, if repo.Submodules is set, initializing submodules
+// added since the last deploy.
+func (s *Server) updateSubmodules(ctx context.Context, path string, repo Repo) error {
+	if !repo.Submodules {
+		return nil
+	}
+	return s.git(ctx, path, "submodule", "update", "--init", "--recursive")
+}
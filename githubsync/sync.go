@@ -0,0 +1,373 @@
+package githubsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	errNotGitRepo     = errors.New("not a git repository")
+	errBranchNotFound = errors.New("branch not found on remote")
+	errBadWorkdir     = errors.New("not a directory within the checkout")
+)
+
+// checkRemoteBranch makes sure repo's branch exists on its remote, so that
+// typos in the config are caught before the first clone or pull.
+func (s *Server) checkRemoteBranch(ctx context.Context, repo Repo) error {
+	if repo.Branch == "" {
+		return nil
+	}
+	args := []string{"ls-remote", "--heads", repo.cloneURL(), "refs/heads/" + repo.Branch}
+	if cmd := s.sshCommand(repo); cmd != "" {
+		args = append([]string{"-c", "core.sshCommand=" + cmd}, args...)
+	}
+	out, err := s.gitOutput(ctx, "", args...)
+	if err != nil {
+		return fmt.Errorf("ls-remote %s: %s", repo.cloneURL(), err)
+	}
+	if out == "" {
+		return fmt.Errorf("%s: %w", repo.Branch, errBranchNotFound)
+	}
+	return nil
+}
+
+// syncRepo makes sure path holds an up to date checkout of repo, cloning
+// it if needed. If path is a directory without a .git, an error wrapping
+// errNotGitRepo is returned, unless the directory is empty and
+// Config.RecloneEmpty is set, in which case repo is cloned into it.
+func (s *Server) syncRepo(ctx context.Context, path string, repo Repo) error {
+	// Check if folder exists
+	fi, err := os.Stat(path)
+	if err != nil {
+		// Fail on anything but a missing folder, e.g. a permission error
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("checking %s: %w", path, err)
+		}
+
+		// If the folder doesn't exist, clone
+		return s.cloneTag(ctx, path, repo)
+	}
+
+	// Error if the namespace is already taken by a file
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is file", path)
+	}
+
+	// Error if path is not a git repo
+	_, err = os.Stat(filepath.Join(path, ".git"))
+	if errors.Is(err, os.ErrNotExist) {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 || !s.cfg.RecloneEmpty {
+			return fmt.Errorf("%s exists but is %w (%d entries)", path, errNotGitRepo, len(entries))
+		}
+		slog.Info("Checkout is empty, cloning into it", "path", path)
+		return s.cloneTag(ctx, path, repo)
+	}
+	// Tags are only checked out when deployed
+	if repo.deploysTags() {
+		return s.checkRemote(ctx, path, repo)
+	}
+	branch, err := s.getBranch(ctx, path)
+	if err != nil {
+		return err
+	}
+	want, err := s.trackedBranch(ctx, path, repo)
+	if err != nil {
+		return err
+	}
+
+	// Error if path is a git repo but checked out to the wrong branch.
+	// A detached HEAD is expected after a fallback deploy.
+	if branch != want && !(branch == "HEAD" && repo.FallbackRef != "") {
+		return fmt.Errorf("%s is checked out to the wrong branch", repo.ID)
+	}
+
+	// Pull
+	_, err = s.handleDirty(ctx, path, repo, io.Discard)
+	if err != nil {
+		return err
+	}
+	return s.pull(ctx, path, repo, "")
+}
+
+// clone clones repo into path, retrying with backoff on failure. Whatever
+// a failed attempt left behind is removed before retrying: the directory
+// itself if this run created it, otherwise only its contents, since
+// clone is only called on missing or empty directories.
+func (s *Server) clone(ctx context.Context, path string, repo Repo) error {
+	_, err := os.Stat(path)
+	existed := err == nil
+
+	backoff := 2 * time.Second
+	for attempt := 0; ; attempt++ {
+		err = s.cloneOnce(ctx, path, repo)
+		if err == nil {
+			return nil
+		}
+		if cleanupErr := cleanupClone(path, existed); cleanupErr != nil {
+			return fmt.Errorf("%s (cleanup failed: %s)", err, cleanupErr)
+		}
+		if attempt >= s.cfg.CloneRetries {
+			return err
+		}
+		slog.Error("Clone failed", "url", repo.cloneURL(), "retry_in", backoff.String(), "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (s *Server) cloneOnce(ctx context.Context, path string, repo Repo) error {
+	args := []string{"clone", "--origin", repo.remote()}
+	if repo.Branch != "" {
+		// --single-branch avoids unnecessary history for other branches.
+		args = append(args, "--branch", repo.Branch, "--single-branch")
+	}
+	if repo.Submodules {
+		args = append(args, "--recurse-submodules")
+	}
+	if cmd := s.sshCommand(repo); cmd != "" {
+		// Recorded in the checkout's config for later fetches
+		args = append(args, "--config", "core.sshCommand="+cmd)
+	}
+	args = append(args, repo.cloneURL(), path)
+	cmd := s.gitCommand(ctx, args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git clone failed: %v\n%s", err, out)
+	}
+
+	// Without LFS installed globally the clone only has pointer files
+	return s.pullLFS(ctx, path, repo)
+}
+
+// cleanupClone removes what a failed clone left at path.
+func cleanupClone(path string, existed bool) error {
+	if !existed {
+		return os.RemoveAll(path)
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err = os.RemoveAll(filepath.Join(path, e.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pull updates the checkout at path from repo's remote. The branch is
+// fetched, and sha, or the branch's tip if sha is empty, verified if
+// repo.RequireSigned is set and then merged, or reset to if repo.Sync is
+// "reset". Merging sha rather than the tip makes the deployed commit the
+// one that was pushed even if another push followed. If sha isn't on the
+// fetched branch, e.g. because the payload was forged or the branch was
+// force-pushed since, or doesn't descend from the checked out commit,
+// e.g. because an old push was redelivered, the tip is deployed instead.
+// If the merge fails, e.g. because upstream was force-pushed or there are
+// local changes, repo.OnDiverge decides how to reconcile: "reset" hard
+// resets to upstream, "stash" stashes local changes and merges again, and
+// "fail" (the default) returns the error. Submodules and LFS files are
+// updated after the merge.
+func (s *Server) pull(ctx context.Context, path string, repo Repo, sha string) error {
+	start := time.Now()
+	defer func() {
+		s.metrics.PullDuration.Observe(labels("repo", repo.ID), time.Since(start))
+	}()
+	err := s.checkRemote(ctx, path, repo)
+	if err != nil {
+		return err
+	}
+
+	// Leave a fallback deploy's detached HEAD
+	branch, err := s.trackedBranch(ctx, path, repo)
+	if err != nil {
+		return err
+	}
+	if repo.FallbackRef != "" {
+		current, err := s.getBranch(ctx, path)
+		if err != nil {
+			return err
+		}
+		if current == "HEAD" {
+			err = s.git(ctx, path, "checkout", branch)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Fetch
+	err = s.git(ctx, path, "fetch", "--", repo.remote(), branch)
+	if err != nil {
+		return err
+	}
+	target, err := s.gitOutput(ctx, path, "rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return err
+	}
+	if sha != "" && sha != target {
+		// Only deploy commits of the branch, whatever the payload says, and
+		// never go back to an older one, e.g. on a redelivery
+		if s.git(ctx, path, "merge-base", "--is-ancestor", sha, "FETCH_HEAD") != nil {
+			slog.Warn("Pushed commit isn't on the branch, deploying its tip", "path", path, "sha", sha, "branch", branch, "tip", target)
+		} else if s.git(ctx, path, "merge-base", "--is-ancestor", "HEAD", sha) != nil {
+			slog.Warn("Pushed commit is older than the checkout, deploying the branch's tip", "path", path, "sha", sha, "branch", branch, "tip", target)
+		} else {
+			target = sha
+		}
+	}
+
+	// Verify
+	if repo.RequireSigned {
+		err = s.verifyCommit(ctx, path, target, repo)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Merge
+	if repo.Sync == "reset" {
+		err = s.resetTo(ctx, path, repo, target)
+	} else {
+		err = s.merge(ctx, path, repo, target)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Update submodules and LFS files
+	return s.updateCheckout(ctx, path, repo)
+}
+
+// updateCheckout brings the submodules and LFS files of the checkout at
+// path up to date with the commit checked out.
+func (s *Server) updateCheckout(ctx context.Context, path string, repo Repo) error {
+	err := s.updateSubmodules(ctx, path, repo)
+	if err != nil {
+		return err
+	}
+	return s.pullLFS(ctx, path, repo)
+}
+
+// resetTo hard resets the checkout at path to target, discarding local
+// changes, and removes untracked files if repo.Clean is set.
+func (s *Server) resetTo(ctx context.Context, path string, repo Repo, target string) error {
+	err := s.git(ctx, path, "reset", "--hard", target, "--")
+	if err != nil {
+		return err
+	}
+	return s.clean(ctx, path, repo)
+}
+
+// clean removes the untracked files and directories of the checkout at
+// path, but not ignored ones, if repo.Clean is set.
+func (s *Server) clean(ctx context.Context, path string, repo Repo) error {
+	if !repo.Clean {
+		return nil
+	}
+	return s.git(ctx, path, "clean", "-fd")
+}
+
+// merge merges target into the checkout at path, reconciling a failed
+// merge according to repo.OnDiverge.
+func (s *Server) merge(ctx context.Context, path string, repo Repo, target string) error {
+	err := s.git(ctx, path, "merge", "--", target)
+	if err == nil {
+		return nil
+	}
+
+	switch repo.OnDiverge {
+	case "", "fail":
+		return err
+	case "reset":
+		slog.Warn("Merge failed, resetting to upstream", "path", path, "err", err)
+		return s.git(ctx, path, "reset", "--hard", target, "--")
+	case "stash":
+		slog.Warn("Merge failed, stashing local changes", "path", path, "err", err)
+		err = s.git(ctx, path, "stash", "push", "--include-untracked")
+		if err != nil {
+			return err
+		}
+		return s.git(ctx, path, "merge", "--", target)
+	default:
+		return fmt.Errorf("unknown on_diverge policy %q", repo.OnDiverge)
+	}
+}
+
+// trackedBranch returns the branch the checkout at path deploys: either
+// repo.Branch or, if that is empty, the default branch of the remote,
+// which clone checked out.
+func (s *Server) trackedBranch(ctx context.Context, path string, repo Repo) (string, error) {
+	if repo.Branch != "" {
+		return repo.Branch, nil
+	}
+	// clone records the remote's default branch as <remote>/HEAD
+	ref, err := s.gitOutput(ctx, path, "symbolic-ref", "--short", "refs/remotes/"+repo.remote()+"/HEAD")
+	if err == nil {
+		return strings.TrimPrefix(ref, repo.remote()+"/"), nil
+	}
+
+	// Ask the remote for checkouts that predate the clone recording it
+	out, err := s.gitOutput(ctx, path, "ls-remote", "--symref", repo.remote(), "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("resolving default branch of %s: %s", repo.ID, err)
+	}
+	for _, line := range strings.Split(out, "\n") {
+		ref, ok := strings.CutPrefix(line, "ref: refs/heads/")
+		if ok {
+			branch, _, _ := strings.Cut(ref, "\t")
+			return branch, nil
+		}
+	}
+	return "", fmt.Errorf("remote of %s has no default branch", repo.ID)
+}
+
+// checkRemote makes sure the checkout at path has repo's remote and that
+// it points at repo.FetchURL if one is configured, or at the SSH URL with
+// the repo's key if it is cloned over SSH. Credentials embedded in the
+// remote URL by older setups are removed from .git/config, since git now
+// asks for them through GIT_ASKPASS.
+func (s *Server) checkRemote(ctx context.Context, path string, repo Repo) error {
+	url, err := s.gitOutput(ctx, path, "remote", "get-url", repo.remote())
+	if err != nil {
+		return fmt.Errorf("remote %s not configured in %s", repo.remote(), path)
+	}
+	if clean, ok := stripCredentials(url); ok {
+		slog.Warn("Removing credentials from remote URL", "path", path, "remote", repo.remote())
+		err = s.git(ctx, path, "remote", "set-url", repo.remote(), clean)
+		if err != nil {
+			return err
+		}
+		url = clean
+	}
+	if (repo.FetchURL != "" || repo.SSH) && url != repo.cloneURL() {
+		slog.Info("Pointing remote at new URL", "path", path, "remote", repo.remote(), "url", repo.cloneURL())
+		err = s.git(ctx, path, "remote", "set-url", repo.remote(), repo.cloneURL())
+		if err != nil {
+			return err
+		}
+	}
+	if cmd := s.sshCommand(repo); cmd != "" {
+		current, _ := s.gitOutput(ctx, path, "config", "--get", "core.sshCommand")
+		if current != cmd {
+			return s.git(ctx, path, "config", "core.sshCommand", cmd)
+		}
+	}
+	return nil
+}
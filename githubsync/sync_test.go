@@ -0,0 +1,193 @@
+package githubsync
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSyncRepoClonesMissingCheckout(t *testing.T) {
+	dir := t.TempDir()
+	upstream := newUpstream(t, dir, "up")
+	repo := Repo{ID: "o/app", Branch: "main", FetchURL: upstream}
+	s := newTestServer(t, dir, map[string]Repo{"o/app": repo})
+	err := s.syncRepo(context.Background(), dir+"/app", repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sh(t, dir+"/app", "git rev-parse HEAD"), sh(t, upstream, "git rev-parse HEAD"); got != want {
+		t.Fatalf("checked out %s, want %s", got, want)
+	}
+}
+
+func TestSyncRepoStatError(t *testing.T) {
+	dir := t.TempDir()
+	upstream := newUpstream(t, dir, "up")
+	repo := Repo{ID: "o/app", Branch: "main", FetchURL: upstream}
+	s := newTestServer(t, dir, map[string]Repo{"o/app": repo})
+	// Stat fails with ENOTDIR rather than ErrNotExist below a file
+	err := os.WriteFile(dir+"/file", nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.syncRepo(context.Background(), dir+"/file/app", repo)
+	if err == nil || !strings.Contains(err.Error(), "checking "+dir+"/file/app") {
+		t.Fatalf("got %v, want the stat error", err)
+	}
+}
+
+// failingGit returns a git that makes the first clone fail after leaving
+// a partial checkout behind, and runs git otherwise.
+func failingGit(t *testing.T, dir string) string {
+	t.Helper()
+	fake := dir + "/flaky-git"
+	script := `#!/bin/sh
+if [ "$1" = clone ] && [ ! -e ` + dir + `/failed ]; then
+	touch ` + dir + `/failed
+	for last; do :; done
+	mkdir -p "$last/.git" && echo partial > "$last/junk"
+	exit 128
+fi
+exec git "$@"
+`
+	err := os.WriteFile(fake, []byte(script), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake
+}
+
+func TestCloneRetriesAfterFailure(t *testing.T) {
+	dir := t.TempDir()
+	upstream := newUpstream(t, dir, "up")
+	repo := Repo{ID: "o/app", Branch: "main", FetchURL: upstream}
+	s := newTestServer(t, dir, map[string]Repo{"o/app": repo})
+	s.cfg.GitBinary = failingGit(t, dir)
+	s.cfg.CloneRetries = 1
+	err := s.clone(context.Background(), dir+"/app", repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir + "/failed"); err != nil {
+		t.Fatal("the first clone didn't fail")
+	}
+	if _, err := os.Stat(dir + "/app/junk"); err == nil {
+		t.Fatal("the partial clone wasn't cleaned up")
+	}
+	if got, want := sh(t, dir+"/app", "git rev-parse HEAD"), sh(t, upstream, "git rev-parse HEAD"); got != want {
+		t.Fatalf("checked out %s, want %s", got, want)
+	}
+}
+
+func TestCloneKeepsExistingDirectory(t *testing.T) {
+	dir := t.TempDir()
+	upstream := newUpstream(t, dir, "up")
+	repo := Repo{ID: "o/app", Branch: "main", FetchURL: upstream}
+	s := newTestServer(t, dir, map[string]Repo{"o/app": repo})
+	s.cfg.GitBinary = failingGit(t, dir)
+	err := os.Mkdir(dir+"/app", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.clone(context.Background(), dir+"/app", repo)
+	if err == nil {
+		t.Fatal("clone succeeded without retries")
+	}
+	entries, err := os.ReadDir(dir + "/app")
+	if err != nil {
+		t.Fatal("removed the directory that existed before the clone:", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("left %d entries of the partial clone", len(entries))
+	}
+}
+
+func TestSyncRepoDefaultBranch(t *testing.T) {
+	dir := t.TempDir()
+	sh(t, dir, "git init -q -b trunk up && git -C up commit -q --allow-empty -m one")
+	repo := Repo{ID: "o/app", FetchURL: dir + "/up"}
+	s := newTestServer(t, dir, map[string]Repo{"o/app": repo})
+	err := s.syncRepo(context.Background(), dir+"/app", repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restarts pull the default branch instead of failing the branch check
+	sh(t, dir+"/up", "git commit -q --allow-empty -m two")
+	err = s.syncRepo(context.Background(), dir+"/app", repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sh(t, dir+"/app", "git log -1 --format=%s"); got != "two" {
+		t.Fatalf("checked out %q, want two", got)
+	}
+
+	// The branch is still found without origin/HEAD
+	sh(t, dir+"/app", "git remote set-head origin -d")
+	branch, err := s.trackedBranch(context.Background(), dir+"/app", repo)
+	if err != nil || branch != "trunk" {
+		t.Fatalf("tracked %q, %v, want trunk", branch, err)
+	}
+}
+
+func TestPullDeploysPushedCommit(t *testing.T) {
+	dir := t.TempDir()
+	upstream := newUpstream(t, dir, "up")
+	repo := Repo{ID: "o/app", Branch: "main", FetchURL: upstream}
+	s := newTestServer(t, dir, map[string]Repo{"o/app": repo})
+	err := s.syncRepo(context.Background(), dir+"/app", repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushed := sh(t, upstream, "git commit -q --allow-empty -m two && git rev-parse HEAD")
+	sh(t, upstream, "git commit -q --allow-empty -m three")
+	err = s.pull(context.Background(), dir+"/app", repo, pushed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sh(t, dir+"/app", "git rev-parse HEAD"); got != pushed {
+		t.Fatalf("checked out %s, want the pushed %s", got, pushed)
+	}
+}
+
+func TestPullRefusesCommitNotOnBranch(t *testing.T) {
+	dir := t.TempDir()
+	upstream := newUpstream(t, dir, "up")
+	repo := Repo{ID: "o/app", Branch: "main", FetchURL: upstream}
+	s := newTestServer(t, dir, map[string]Repo{"o/app": repo})
+	err := s.syncRepo(context.Background(), dir+"/app", repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := sh(t, upstream, "git checkout -q -b evil && git commit -q --allow-empty -m evil && git rev-parse HEAD && git checkout -q main")
+	tip := sh(t, upstream, "git commit -q --allow-empty -m two && git rev-parse HEAD")
+	err = s.pull(context.Background(), dir+"/app", repo, forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sh(t, dir+"/app", "git rev-parse HEAD"); got != tip {
+		t.Fatalf("checked out %s, want the tip %s of the branch", got, tip)
+	}
+}
+
+func TestPullResetIgnoresOlderCommit(t *testing.T) {
+	dir := t.TempDir()
+	upstream := newUpstream(t, dir, "up")
+	old := sh(t, upstream, "git rev-parse HEAD")
+	repo := Repo{ID: "o/app", Branch: "main", FetchURL: upstream, Sync: "reset"}
+	s := newTestServer(t, dir, map[string]Repo{"o/app": repo})
+	tip := sh(t, upstream, "git commit -q --allow-empty -m two && git rev-parse HEAD")
+	err := s.syncRepo(context.Background(), dir+"/app", repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A redelivery of the first push
+	err = s.pull(context.Background(), dir+"/app", repo, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sh(t, dir+"/app", "git rev-parse HEAD"); got != tip {
+		t.Fatalf("checked out %s, want the tip %s rather than the older %s", got, tip, old)
+	}
+}
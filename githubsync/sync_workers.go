@@ -0,0 +1,63 @@
+package githubsync
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// syncCheckouts clones or pulls the checkouts of the enabled repos of
+// repos on up to Config.SyncWorkers workers at once, and returns the
+// error each entry's sync failed with, or nil, keyed by entry. Entries of
+// the same repo are synced one after another, as they share its SSH key
+// and deploy key.
+func (s *Server) syncCheckouts(ctx context.Context, repos map[string]Repo) map[string]error {
+	groups := map[string][]string{}
+	for _, key := range sortedKeys(repos) {
+		repo := repos[key]
+		if !repo.enabled() {
+			slog.Info("Skipping disabled repo", "repo", key)
+			continue
+		}
+		groups[repo.ID] = append(groups[repo.ID], key)
+	}
+
+	start := time.Now()
+	results := map[string]error{}
+	failed := 0
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan []string)
+	for range min(max(s.cfg.SyncWorkers, 1), len(groups)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for keys := range work {
+				for _, key := range keys {
+					repo := repos[key]
+					err := ctx.Err()
+					if err == nil {
+						err = s.syncCheckout(ctx, key, s.repoPath(key, repo), repo)
+					}
+					if err == nil {
+						slog.Info("Synced", "repo", key)
+					}
+					mu.Lock()
+					results[key] = err
+					if err != nil {
+						failed++
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, id := range sortedKeys(groups) {
+		work <- groups[id]
+	}
+	close(work)
+	wg.Wait()
+	slog.Info("Synced checkouts", "repos", len(results), "failed", failed, "took", time.Since(start).String())
+	return results
+}
@@ -0,0 +1,190 @@
+package githubsync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// semverTag matches tags that are stable semantic versions, e.g. v1.2.3.
+var semverTag = regexp.MustCompile(`^v?(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(\+[0-9A-Za-z.-]+)?$`)
+
+// deploysTags reports whether the repo deploys tags instead of branch
+// pushes.
+func (r Repo) deploysTags() bool {
+	return r.DeployOn == "tag" || r.DeployOn == "release"
+}
+
+// matchesTag reports whether the repo deploys tag: any tag if
+// r.TagPattern is empty, stable semantic versions if it is "semver", or
+// else the tags matching it as a glob.
+func (r Repo) matchesTag(tag string) bool {
+	switch r.TagPattern {
+	case "":
+		return true
+	case "semver":
+		return semverTag.MatchString(tag)
+	}
+	ok, _ := path.Match(r.TagPattern, tag)
+	return ok
+}
+
+// latestTag returns the highest version tag of repo's remote the repo
+// deploys, or "" if there is none.
+func (s *Server) latestTag(ctx context.Context, path string, repo Repo) (string, error) {
+	out, err := s.gitOutput(ctx, path, "ls-remote", "--tags", "--refs", "--sort=-v:refname", repo.remote())
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		_, ref, _ := strings.Cut(line, "\t")
+		tag, ok := strings.CutPrefix(ref, "refs/tags/")
+		if ok && repo.matchesTag(tag) {
+			return tag, nil
+		}
+	}
+	return "", nil
+}
+
+// checkoutTag fetches tag from repo's remote, verifies it if
+// repo.RequireSigned is set, and checks it out at path on a detached HEAD.
+// Either the tag or the commit it points at must be signed.
+// It returns the commit the tag points at.
+func (s *Server) checkoutTag(ctx context.Context, path string, repo Repo, tag string) (string, error) {
+	err := s.checkRemote(ctx, path, repo)
+	if err != nil {
+		return "", err
+	}
+	// Tags that were moved since are fetched again
+	ref := "refs/tags/" + tag
+	err = s.git(ctx, path, "fetch", "--force", "--", repo.remote(), ref+":"+ref)
+	if err != nil {
+		return "", err
+	}
+	sha, err := s.gitOutput(ctx, path, "rev-parse", ref+"^{commit}")
+	if err != nil {
+		return "", err
+	}
+	if repo.RequireSigned {
+		err = s.verifySignature(ctx, path, "tag", ref, repo)
+		if err != nil {
+			commitErr := s.verifyCommit(ctx, path, sha, repo)
+			if commitErr != nil {
+				return "", fmt.Errorf("%s; %s", err, commitErr)
+			}
+		}
+	}
+	args := []string{"checkout", "--detach", sha, "--"}
+	if repo.OnDiverge == "reset" || repo.Sync == "reset" {
+		args = []string{"checkout", "--force", "--detach", sha, "--"}
+	}
+	err = s.git(ctx, path, args...)
+	if err == nil {
+		err = s.clean(ctx, path, repo)
+	}
+	if err == nil {
+		err = s.updateCheckout(ctx, path, repo)
+	}
+	if err != nil {
+		return "", err
+	}
+	return sha, nil
+}
+
+// cloneTag clones repo into path and, if it deploys tags, checks out the
+// latest one it deploys.
+func (s *Server) cloneTag(ctx context.Context, path string, repo Repo) error {
+	err := s.clone(ctx, path, repo)
+	if err != nil || !repo.deploysTags() {
+		return err
+	}
+	tag, err := s.latestTag(ctx, path, repo)
+	if err != nil || tag == "" {
+		return err
+	}
+	slog.Info("Checking out latest tag", "repo", repo.ID, "tag", tag)
+	_, err = s.checkoutTag(ctx, path, repo, tag)
+	return err
+}
+
+// deployTag checks out tag in the repo at path and restarts its service,
+// rolling back to the previous commit if the health check fails. It
+// returns the commit deployed.
+func (s *Server) deployTag(ctx context.Context, path string, repo Repo, tag string, out io.Writer) (string, error) {
+	err := s.checkCommands(repo)
+	if err != nil {
+		return "", &DeployError{"approve", err}
+	}
+	prev, err := s.gitOutput(ctx, path, "rev-parse", "HEAD")
+	if err != nil {
+		return "", &DeployError{"pull", err}
+	}
+	fmt.Fprintln(out, "Checking out tag", tag)
+	_, err = s.checkoutTag(ctx, path, repo, tag)
+	if err != nil {
+		return "", &DeployError{"pull", err}
+	}
+	sha, err := s.writeDeployedSHA(ctx, path, repo.VersionEnv)
+	if err != nil {
+		return "", &DeployError{"version", err}
+	}
+	err = s.restart(ctx, path, repo, sha, nil, out)
+	if isHealthError(err) && repo.FallbackRef == "" && prev != sha {
+		return sha, s.rollbackRevision(ctx, path, repo, prev, err, out)
+	}
+	return sha, err
+}
+
+// handleTag deploys a pushed tag to the entries of its repo that deploy
+// tag pushes matching it.
+func (s *Server) handleTag(w http.ResponseWriter, r *http.Request, req *WebhookRequest, provider string, repos map[string]Repo) {
+	tag := strings.TrimPrefix(req.Ref, "refs/tags/")
+	if req.Deleted {
+		fmt.Fprintln(w, "tag deleted, skipped")
+		return
+	}
+	if req.HeadCommit != nil && !isSHA(req.HeadCommit.ID) {
+		http.Error(w, fmt.Sprintf("%q is not a full commit SHA", req.HeadCommit.ID), http.StatusBadRequest)
+		return
+	}
+	jobs := []*Job{}
+	for key, repo := range repos {
+		if repo.ID != req.Repository.FullName || repo.provider() != provider || repo.DeployOn != "tag" || !repo.matchesTag(tag) {
+			continue
+		}
+		if !repo.enabled() {
+			slog.Info("Skipping tag of disabled repo", "repo", key, "tag", tag)
+			continue
+		}
+		job := &Job{
+			Key:  key,
+			Repo: repo,
+			Path: s.repoPath(key, repo),
+			Tag:  tag,
+			Status: &DeployStatus{
+				Repo:       key,
+				DeliveryID: deliveryID(r),
+				HookID:     hookID(r),
+				SHA:        tag,
+				Pusher:     req.Pusher.Name,
+			},
+		}
+		if req.HeadCommit != nil {
+			job.Status.SHA = req.HeadCommit.ID
+			job.Status.Message = req.HeadCommit.Message
+			job.Status.Author = req.HeadCommit.Author.Name
+		}
+		jobs = append(jobs, job)
+	}
+	if len(jobs) == 0 {
+		slog.Info("Ignoring push of undeployed tag", "repo", req.Repository.FullName, "tag", tag)
+		fmt.Fprintln(w, "no entry deploys tag", tag)
+		return
+	}
+	s.enqueue(w, jobs)
+}
@@ -0,0 +1,83 @@
+package githubsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// hookScopes are the classic token scopes that allow managing webhooks.
+var hookScopes = []string{"admin:repo_hook", "write:repo_hook", "repo"}
+
+// checkToken makes sure ghToken can manage the webhooks of repoIDs, on the
+// GitHub instance whose API is at api, before startup goes any further.
+// Classic tokens list their scopes in the X-OAuth-Scopes header;
+// fine-grained tokens don't, so for those each repo's hooks are listed to
+// check the webhook permission.
+func checkToken(api, ghToken string, repoIDs []string) error {
+	res, err := githubGet(ghToken, api+"/user")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return githubError(res, "GITHUB_TOKEN")
+	}
+
+	if header, ok := res.Header["X-Oauth-Scopes"]; ok {
+		scopes := []string{}
+		for _, s := range strings.Split(strings.Join(header, ","), ",") {
+			scopes = append(scopes, strings.TrimSpace(s))
+		}
+		for _, s := range hookScopes {
+			if includes(scopes, s) {
+				return nil
+			}
+		}
+		return fmt.Errorf("GITHUB_TOKEN can't manage webhooks: it has scopes %q but needs admin:repo_hook", strings.Join(scopes, ", "))
+	}
+
+	return checkHookAccess(api, ghToken, repoIDs)
+}
+
+// checkHookAccess makes sure ghToken can list the webhooks of repoIDs,
+// which fine-grained and GitHub App tokens can only if they have the
+// webhook permission.
+func checkHookAccess(api, ghToken string, repoIDs []string) error {
+	for _, id := range repoIDs {
+		res, err := githubGet(ghToken, fmt.Sprintf("%s/repos/%s/hooks", api, id))
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode == 403 || res.StatusCode == 404 {
+			return fmt.Errorf("GITHUB_TOKEN can't manage webhooks of %s: grant it the Webhooks read and write permission", id)
+		}
+	}
+	return nil
+}
+
+func githubGet(ghToken, apiURL string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", apiURL, nil)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", ghToken))
+	return githubClient.Do(req)
+}
+
+// githubPost posts v as JSON to apiURL, authenticated with ghToken.
+func githubPost(ghToken, apiURL string, v any) (*http.Response, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	req, err := http.NewRequest("POST", apiURL, bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("token %s", ghToken))
+	return githubClient.Do(req)
+}
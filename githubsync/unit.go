@@ -0,0 +1,133 @@
+package githubsync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// unitHeader starts every generated unit file, so that hand-written ones
+// are never overwritten.
+const unitHeader = "# Generated by github-sync"
+
+// unitFile returns the path of the unit file generated for repo.
+func (s *Server) unitFile(repo Repo) string {
+	name := repo.Service.Name
+	if !strings.Contains(name, ".") {
+		name += ".service"
+	}
+	return filepath.Join(s.cfg.UnitDir, name)
+}
+
+// renderUnit returns the unit file of the service of the repo deployed at
+// path.
+func renderUnit(path string, repo Repo) []byte {
+	svc := repo.Service
+	dir := repo.workdir(path)
+	if svc.Dir != "" {
+		dir = svc.Dir
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(path, dir)
+		}
+	}
+
+	b := &bytes.Buffer{}
+	fmt.Fprintln(b, unitHeader, "from the config of", repo.ID+". Do not edit.")
+	fmt.Fprintln(b, "[Unit]")
+	fmt.Fprintln(b, "Description="+repo.ID)
+	fmt.Fprintln(b, "After=network.target")
+	fmt.Fprintln(b)
+	fmt.Fprintln(b, "[Service]")
+	fmt.Fprintln(b, "ExecStart="+escapeUnit(svc.Start))
+	fmt.Fprintln(b, "WorkingDirectory="+escapeUnit(dir))
+	if svc.User != "" {
+		fmt.Fprintln(b, "User="+escapeUnit(svc.User))
+	}
+	keys := []string{}
+	for k := range svc.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(k + "=" + svc.Env[k])
+		fmt.Fprintf(b, "Environment=\"%s\"\n", escapeUnit(v))
+	}
+	if repo.VersionEnv != "" {
+		fmt.Fprintln(b, "EnvironmentFile=-"+escapeUnit(filepath.Join(path, deployedEnvFile)))
+	}
+	fmt.Fprintln(b, "Restart=on-failure")
+	fmt.Fprintln(b)
+	fmt.Fprintln(b, "[Install]")
+	fmt.Fprintln(b, "WantedBy=multi-user.target")
+	return b.Bytes()
+}
+
+// escapeUnit escapes systemd specifiers in s.
+func escapeUnit(s string) string {
+	return strings.ReplaceAll(s, "%", "%%")
+}
+
+// writeUnit writes the unit file of repo if it has a start command,
+// keeping it in sync with the config. Unit files written by hand are left
+// alone. It reports whether the file was
+// created, in which case the unit still needs to be enabled.
+func (s *Server) writeUnit(path string, repo Repo) (created bool, err error) {
+	if repo.Service == nil || repo.Service.Name == "" || repo.Service.Start == "" {
+		return false, nil
+	}
+	file := s.unitFile(repo)
+	unit := renderUnit(path, repo)
+	old, err := os.ReadFile(file)
+	if err == nil && bytes.Equal(old, unit) {
+		return false, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil && !bytes.HasPrefix(old, []byte(unitHeader)) {
+		slog.Warn("Not overwriting unit file that wasn't generated by github-sync", "file", file)
+		return false, nil
+	}
+	slog.Info("Writing unit file", "file", file)
+	err = os.WriteFile(file, unit, 0644)
+	if err != nil {
+		return false, err
+	}
+	return old == nil, nil
+}
+
+// syncUnit updates the generated unit file of repo and reloads systemd if
+// it changed, without restarting the service. Units of repos with
+// unapproved commands are left alone.
+func (s *Server) syncUnit(ctx context.Context, path string, repo Repo) error {
+	err := s.checkCommands(repo)
+	if err != nil {
+		return err
+	}
+	created, err := s.writeUnit(path, repo)
+	if err != nil {
+		return err
+	}
+	service := repo.serviceName()
+	if service != "" && needsDaemonReload(service) {
+		slog.Info("systemctl daemon-reload")
+		out, err := exec.CommandContext(ctx, "systemctl", "daemon-reload").CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("systemctl daemon-reload: %s: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	if created {
+		slog.Info("systemctl enable", "service", service)
+		out, err := exec.CommandContext(ctx, "systemctl", "enable", service).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("systemctl enable: %s: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package githubsync
+
+import (
+	"context"
+	"fmt"
+)
+
+// Validate checks that every repo's branch exists on its remote, printing
+// the result for each repo. It returns false if any check failed.
+func (s *Server) Validate(ctx context.Context) bool {
+	ok := true
+	for key, repo := range s.config() {
+		if !repo.enabled() {
+			fmt.Printf("%s: disabled\n", key)
+			continue
+		}
+		err := s.checkRemoteBranch(ctx, repo)
+		if err != nil {
+			fmt.Printf("%s: %s\n", key, err)
+			ok = false
+			continue
+		}
+		fmt.Printf("%s: ok\n", key)
+	}
+	return ok
+}
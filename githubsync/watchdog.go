@@ -0,0 +1,148 @@
+package githubsync
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Watchdog configures periodic liveness checks of a repo's service.
+type Watchdog struct {
+	// Interval between checks, e.g. "1m".
+	Interval string `json:"interval"`
+	// URL, if set, is requested instead of asking systemctl whether the
+	// service is active. Any non-2xx response counts as down.
+	URL string `json:"url"`
+	// MaxBackoff caps the wait between restart attempts of a service that
+	// keeps failing. Defaults to 30m.
+	MaxBackoff string `json:"max_backoff"`
+}
+
+// WatchdogEvent records the last time the watchdog found a service down.
+type WatchdogEvent struct {
+	Time      time.Time `json:"time"`
+	Error     string    `json:"error"`
+	Restarted bool      `json:"restarted"`
+	Failures  int       `json:"consecutive_failures"`
+}
+
+// runningWatchdog is a watchdog started for repo, stopped by cancel.
+type runningWatchdog struct {
+	repo   Repo
+	cancel context.CancelFunc
+}
+
+// watched reports whether the service of the repo has a watchdog.
+func (r Repo) watched() bool {
+	return r.enabled() && r.Watchdog != nil && r.serviceName() != ""
+}
+
+// reconcileWatchdogs stops the watchdogs of repos that were removed or
+// whose entry changed and starts the ones the config is missing, once
+// StartBackground has run.
+func (s *Server) reconcileWatchdogs() {
+	config := s.config()
+	s.watchdogsMu.Lock()
+	defer s.watchdogsMu.Unlock()
+	if s.watchdogs == nil {
+		return
+	}
+	for key, w := range s.watchdogs {
+		if repo, ok := config[key]; !ok || !repo.watched() || !reflect.DeepEqual(repo, w.repo) {
+			w.cancel()
+			delete(s.watchdogs, key)
+		}
+	}
+	for key, repo := range config {
+		if _, ok := s.watchdogs[key]; ok || !repo.watched() {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		s.watchdogs[key] = &runningWatchdog{repo, cancel}
+		go s.watchdog(ctx, key, repo)
+	}
+}
+
+// watchdog checks the service of repo until ctx is done, restarting it
+// while it is down. Consecutive failures double the wait between checks.
+// Checks are skipped while the repo is being deployed.
+func (s *Server) watchdog(ctx context.Context, key string, repo Repo) {
+	interval, err := time.ParseDuration(repo.Watchdog.Interval)
+	if err != nil || interval <= 0 {
+		slog.Error("Invalid watchdog interval", "repo", key, "interval", repo.Watchdog.Interval)
+		return
+	}
+	maxBackoff := 30 * time.Minute
+	if repo.Watchdog.MaxBackoff != "" {
+		maxBackoff, err = time.ParseDuration(repo.Watchdog.MaxBackoff)
+		if err != nil {
+			slog.Error("Invalid watchdog max_backoff", "repo", key, "err", err)
+			return
+		}
+	}
+
+	wait := interval
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		mu := s.repoMutex(key)
+		if !mu.TryLock() {
+			continue
+		}
+		err := checkService(repo)
+		if err == nil {
+			mu.Unlock()
+			failures = 0
+			wait = interval
+			continue
+		}
+
+		failures++
+		slog.Warn("Watchdog: service is down, restarting", "service", repo.Service.Name, "err", err)
+		event := &WatchdogEvent{
+			Time:     time.Now(),
+			Error:    err.Error(),
+			Failures: failures,
+		}
+		out, err := exec.Command("systemctl", "restart", repo.Service.Name).CombinedOutput()
+		if err != nil {
+			slog.Error("Watchdog: restarting service failed", "service", repo.Service.Name, "err", err, "output", strings.TrimSpace(string(out)))
+		} else {
+			event.Restarted = true
+		}
+		mu.Unlock()
+		s.statuses.SetWatchdog(key, event)
+
+		wait = min(wait*2, maxBackoff)
+	}
+}
+
+// checkService returns an error if the service of repo isn't running.
+func checkService(repo Repo) error {
+	if repo.Watchdog.URL != "" {
+		client := &http.Client{Timeout: 10 * time.Second}
+		res, err := client.Get(repo.Watchdog.URL)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("%s returned %d", repo.Watchdog.URL, res.StatusCode)
+		}
+		return nil
+	}
+	out, err := exec.Command("systemctl", "is-active", repo.Service.Name).Output()
+	if err != nil {
+		return fmt.Errorf("systemctl is-active: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
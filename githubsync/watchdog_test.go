@@ -0,0 +1,37 @@
+package githubsync
+
+import "testing"
+
+func TestReconcileWatchdogs(t *testing.T) {
+	watched := func(interval string) Repo {
+		return Repo{ID: "o/app", Service: &SystemdService{Name: "app"}, Watchdog: &Watchdog{Interval: interval}}
+	}
+	repos := map[string]Repo{"app": watched("1h"), "plain": {ID: "o/plain"}}
+	s := newTestServer(t, t.TempDir(), repos)
+	s.StartBackground()
+	t.Cleanup(func() {
+		s.repos.Store(&map[string]Repo{})
+		s.reconcileWatchdogs()
+	})
+	if len(s.watchdogs) != 1 || s.watchdogs["app"] == nil {
+		t.Fatalf("started %v, want only app", s.watchdogs)
+	}
+	first := s.watchdogs["app"]
+
+	s.reconcileWatchdogs()
+	if s.watchdogs["app"] != first {
+		t.Fatal("restarted the watchdog of an unchanged entry")
+	}
+
+	s.repos.Store(&map[string]Repo{"app": watched("2h")})
+	s.reconcileWatchdogs()
+	if s.watchdogs["app"] == first || s.watchdogs["app"] == nil {
+		t.Fatal("didn't restart the watchdog of a changed entry")
+	}
+
+	s.repos.Store(&map[string]Repo{})
+	s.reconcileWatchdogs()
+	if len(s.watchdogs) != 0 {
+		t.Fatalf("kept %v running after removal", s.watchdogs)
+	}
+}
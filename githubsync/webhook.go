@@ -0,0 +1,361 @@
+package githubsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// webhookHandler queues a deploy of every entry tracking the pushed branch.
+func (s *Server) webhookHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse webhook
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	provider := deliveryProvider(r)
+	forge := s.provider(provider, "")
+	req, err := forge.DecodeWebhook(r, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Repository == nil {
+		http.Error(w, "missing repository", http.StatusBadRequest)
+		return
+	}
+
+	// Reject deliveries not signed with the repo's secret
+	repoID := req.Repository.FullName
+	if secret := s.webhookSecret(repoID); secret != "" {
+		err = forge.VerifyWebhook(r, body, secret)
+		if err != nil {
+			slog.Warn("Rejecting delivery", "repo", repoID, "err", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// Only deploy events for the canonical repo, never forks
+	if pathID, ok := strings.CutPrefix(r.URL.Path, "/hooks/"); ok && pathID != repoID {
+		http.Error(w, fmt.Sprintf("payload for %s delivered to hook of %s", repoID, pathID), http.StatusBadRequest)
+		return
+	}
+	if req.Repository.Fork {
+		slog.Info("Ignoring event from fork", "repo", repoID)
+		fmt.Fprintln(w, "ignored fork", repoID)
+		return
+	}
+	owner := req.Repository.Owner.Login
+	if owner == "" {
+		owner = req.Repository.Owner.Name
+	}
+	if owner+"/"+req.Repository.Name != repoID {
+		slog.Info("Ignoring event with mismatched owner", "repo", repoID, "owner", owner)
+		fmt.Fprintln(w, "ignored mismatched owner")
+		return
+	}
+
+	// Pushes to the config repo apply the new config
+	if s.isConfigRepo(provider, repoID) {
+		s.handleConfigPush(w, r, req)
+		return
+	}
+
+	// Release events deploy release-mode repos
+	repos := s.config()
+	if r.Header.Get("X-GitHub-Event") == "release" {
+		s.handleRelease(w, r, req, repos)
+		return
+	}
+
+	// Finished CI runs deploy the entries that wait for CI
+	if event := r.Header.Get("X-GitHub-Event"); event == "workflow_run" || event == "check_suite" {
+		s.handleCI(w, r, req, repos)
+		return
+	}
+
+	// Tag pushes deploy the entries that deploy tags
+	if strings.HasPrefix(req.Ref, "refs/tags/") {
+		s.handleTag(w, r, req, provider, repos)
+		return
+	}
+
+	// Find the entries tracking the pushed branch
+	matched := map[string]Repo{}
+	configured := false
+	disabled := false
+	waiting := false
+	for key, repo := range repos {
+		if repo.ID != repoID || repo.provider() != provider {
+			continue
+		}
+		configured = true
+		if repo.Mode == "release" || repo.deploysTags() {
+			continue
+		}
+		if req.Ref == "refs/heads/"+s.deployedBranch(key, repo, req.Repository) {
+			if !repo.enabled() {
+				slog.Info("Skipping push to disabled repo", "repo", key)
+				disabled = true
+				continue
+			}
+			if repo.RequireCI {
+				slog.Info("Waiting for CI before deploying push", "repo", key, "ref", req.Ref)
+				waiting = true
+				continue
+			}
+			matched[key] = repo
+		}
+	}
+	if !configured {
+		slog.Info("Ignoring event for unconfigured repo", "repo", repoID)
+		fmt.Fprintf(w, "repo %s not configured\n", repoID)
+		return
+	}
+	if len(matched) == 0 && disabled {
+		fmt.Fprintln(w, "disabled, skipped")
+		return
+	}
+	if len(matched) == 0 && waiting {
+		fmt.Fprintln(w, "waiting for CI")
+		return
+	}
+	if len(matched) == 0 {
+		slog.Info("Ignoring push to untracked ref", "repo", repoID, "ref", req.Ref)
+		fmt.Fprintln(w, "no entry tracks", req.Ref)
+		return
+	}
+
+	// Don't pull deleted branches, but queue stops of the services that
+	// stop on delete so that they wait for running deploys
+	if req.Deleted || req.After != "" && strings.Trim(req.After, "0") == "" {
+		jobs := []*Job{}
+		for key, repo := range matched {
+			slog.Info("Branch was deleted", "repo", key, "ref", req.Ref)
+			if repo.StopOnDelete && repo.serviceName() != "" {
+				jobs = append(jobs, &Job{
+					Key:  key,
+					Repo: repo,
+					Path: s.repoPath(key, repo),
+					Stop: true,
+					Status: &DeployStatus{
+						Repo:       key,
+						DeliveryID: deliveryID(r),
+						HookID:     hookID(r),
+						Pusher:     req.Pusher.Name,
+					},
+				})
+			}
+		}
+		if len(jobs) == 0 {
+			fmt.Fprintln(w, "branch deleted, skipped")
+			return
+		}
+		s.enqueue(w, jobs)
+		return
+	}
+
+	// Skip pushes that change nothing the entry is deployed from
+	changed := changedFiles(req)
+	for key, repo := range matched {
+		if !repo.relevant(changed) {
+			slog.Info("No relevant files changed, skipping deploy", "repo", key, "files", len(changed))
+			delete(matched, key)
+		}
+	}
+	if len(matched) == 0 {
+		fmt.Fprintln(w, "no relevant files changed, skipped")
+		return
+	}
+
+	// Skip pushes of the commit that is already live, e.g. redeliveries
+	sha := req.After
+	if req.HeadCommit != nil {
+		sha = req.HeadCommit.ID
+	}
+	// The SHA ends up in git commands, so it mustn't look like an option
+	if !isSHA(sha) {
+		http.Error(w, fmt.Sprintf("%q is not a full commit SHA", sha), http.StatusBadRequest)
+		return
+	}
+	for key, repo := range matched {
+		if s.upToDate(r.Context(), key, repo, sha) {
+			slog.Info("Already up to date, skipping deploy", "repo", key, "sha", sha)
+			delete(matched, key)
+		}
+	}
+	if len(matched) == 0 {
+		fmt.Fprintln(w, "already up to date")
+		return
+	}
+
+	jobs := []*Job{}
+	for key, repo := range matched {
+		job := &Job{
+			Key:          key,
+			Repo:         repo,
+			Path:         s.repoPath(key, repo),
+			ChangedFiles: changed,
+			Status: &DeployStatus{
+				Repo:       key,
+				DeliveryID: deliveryID(r),
+				HookID:     hookID(r),
+				SHA:        sha,
+				Pusher:     req.Pusher.Name,
+			},
+		}
+		if req.HeadCommit != nil {
+			job.Status.Message = req.HeadCommit.Message
+			job.Status.Author = req.HeadCommit.Author.Name
+		}
+		jobs = append(jobs, job)
+	}
+	s.enqueue(w, jobs)
+}
+
+// deployedBranch returns the branch the entry key deploys: repo.Branch or,
+// for entries tracking the default branch, the branch recorded by the
+// last sync, falling back to the default branch in the payload.
+func (s *Server) deployedBranch(key string, repo Repo, payload *GithubRepository) string {
+	if repo.Branch != "" {
+		return repo.Branch
+	}
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if rs, ok := s.state.Repos[key]; ok && rs.Branch != "" {
+		return rs.Branch
+	}
+	return payload.DefaultBranch
+}
+
+// queueRetryAfter is the number of seconds GitHub is asked to wait before
+// redelivering a push that found the queue full.
+const queueRetryAfter = 60
+
+// enqueue queues the jobs of a delivery and reports their positions with a
+// 202. If the queue is full, none is queued and GitHub is asked to retry
+// later with a 503.
+func (s *Server) enqueue(w http.ResponseWriter, jobs []*Job) {
+	positions, err := s.queueJobs(jobs)
+	if errors.Is(err, ErrQueueFull) {
+		w.Header().Set("Retry-After", strconv.Itoa(queueRetryAfter))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if len(jobs) == 1 {
+		w.Header().Set("Location", "/jobs/"+jobs[0].ID)
+	}
+	w.WriteHeader(http.StatusAccepted)
+	for i, job := range jobs {
+		fmt.Fprintln(w, "queued", job.Status.DeliveryID, "for", job.Key, "as job", job.ID, "at position", positions[i])
+	}
+}
+
+// queueJobs adds jobs to the job store and queues them, returning their
+// positions. If they don't all fit in the queue, none is queued and
+// ErrQueueFull is returned.
+func (s *Server) queueJobs(jobs []*Job) ([]int, error) {
+	for _, job := range jobs {
+		s.jobs.Add(job)
+	}
+	positions, err := s.dispatcher.Enqueue(jobs...)
+	if err != nil {
+		for _, job := range jobs {
+			s.jobs.Remove(job)
+		}
+		slog.Warn("Rejecting deploys", "jobs", len(jobs), "err", err)
+		return nil, err
+	}
+	for i, job := range jobs {
+		slog.Info("Queued", "job", job.ID, "status", job.Status.String(), "position", positions[i])
+		s.notify(job, EventQueued, nil)
+	}
+	return positions, nil
+}
+
+// decodeWebhook parses the payload of r. Hooks we register deliver JSON,
+// but hooks created by hand may use the form content type, which wraps
+// the JSON in a payload form field.
+func decodeWebhook(r *http.Request) (*WebhookRequest, error) {
+	req := &WebhookRequest{}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		err := r.ParseForm()
+		if err != nil {
+			return nil, err
+		}
+		payload := r.PostForm.Get("payload")
+		if payload == "" {
+			return nil, errors.New("form payload missing payload field")
+		}
+		return req, json.Unmarshal([]byte(payload), req)
+	}
+	return req, json.NewDecoder(r.Body).Decode(req)
+}
+
+type WebhookRequest struct {
+	Action  string         `json:"action"`
+	Release *GithubRelease `json:"release"`
+	// WorkflowRun and CheckSuite are set for CI events.
+	WorkflowRun *GithubWorkflowRun `json:"workflow_run"`
+	CheckSuite  *GithubCheckSuite  `json:"check_suite"`
+	Ref         string             `json:"ref"`
+	After       string             `json:"after"`
+	Deleted     bool               `json:"deleted"`
+	Repository  *GithubRepository  `json:"repository"`
+	Pusher      GithubPusher       `json:"pusher"`
+	HeadCommit  *GithubCommit      `json:"head_commit"`
+	Commits     []GithubCommit     `json:"commits"`
+	Sender      GithubOwner        `json:"sender"`
+}
+
+type GithubRepository struct {
+	Name          string      `json:"name"`
+	FullName      string      `json:"full_name"`
+	Fork          bool        `json:"fork"`
+	Owner         GithubOwner `json:"owner"`
+	DefaultBranch string      `json:"default_branch"`
+}
+
+type GithubOwner struct {
+	Login string `json:"login"`
+	// Name is the owner's login in older push payloads.
+	Name string `json:"name"`
+}
+
+type GithubPusher struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type GithubCommit struct {
+	ID       string             `json:"id"`
+	Message  string             `json:"message"`
+	Author   GithubCommitAuthor `json:"author"`
+	Added    []string           `json:"added"`
+	Removed  []string           `json:"removed"`
+	Modified []string           `json:"modified"`
+}
+
+type GithubCommitAuthor struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+}
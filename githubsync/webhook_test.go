@@ -0,0 +1,153 @@
+package githubsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// pushPayload returns a GitHub push of sha to main of o/app.
+func pushPayload(sha string) string {
+	return `{"ref":"refs/heads/main","after":"` + sha + `","repository":{"full_name":"o/app","name":"app","owner":{"login":"o"}},"pusher":{"name":"p"}}`
+}
+
+// postWebhook delivers a GitHub event with body to s.
+func postWebhook(s *Server, event, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-GitHub-Event", event)
+	w := httptest.NewRecorder()
+	s.webhookHandler(w, r)
+	return w
+}
+
+func TestWebhookRejectsBadSHAs(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), map[string]Repo{"o/app": {ID: "o/app", Branch: "main"}})
+	for _, sha := range []string{"--upload-pack=touch /tmp/x;git-upload-pack", "HEAD", "abc123", strings.Repeat("G", 40)} {
+		w := postWebhook(s, "push", pushPayload(sha))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "not a full commit SHA") {
+			t.Errorf("push of %q: got %d %s", sha, w.Code, w.Body)
+		}
+	}
+	if len(s.jobs.order) != 0 {
+		t.Fatalf("queued %d jobs", len(s.jobs.order))
+	}
+}
+
+func TestTagPushRejectsBadSHAs(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), map[string]Repo{"o/app": {ID: "o/app", DeployOn: "tag"}})
+	body := `{"ref":"refs/tags/v1.0.0","head_commit":{"id":"--output=/tmp/x"},"repository":{"full_name":"o/app","name":"app","owner":{"login":"o"}}}`
+	w := postWebhook(s, "push", body)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "not a full commit SHA") || len(s.jobs.order) != 0 {
+		t.Fatalf("got %d %s with %d jobs", w.Code, w.Body, len(s.jobs.order))
+	}
+}
+
+func TestDeletedBranchQueuesStop(t *testing.T) {
+	repos := map[string]Repo{
+		"app":   {ID: "o/app", Branch: "main", StopOnDelete: true, Service: &SystemdService{Name: "app"}},
+		"other": {ID: "o/app", Branch: "main", Service: &SystemdService{Name: "other"}},
+	}
+	s := newTestServer(t, t.TempDir(), repos)
+	ran := make(chan *Job, 2)
+	s.dispatcher = NewDispatcher(1, func(j *Job) { ran <- j })
+	w := postWebhook(s, "push", strings.Replace(pushPayload(strings.Repeat("0", 40)), `"after"`, `"deleted":true,"after"`, 1))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	j := <-ran
+	if !j.Stop || j.Key != "app" {
+		t.Fatalf("ran %+v, want a stop of app", j)
+	}
+	select {
+	case j := <-ran:
+		t.Fatalf("also ran %+v", j)
+	default:
+	}
+}
+
+func TestWebhookRejectsOversizedBodies(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), map[string]Repo{"o/app": {ID: "o/app", Branch: "main"}})
+	s.cfg.MaxBodyBytes = 1024
+	body := pushPayload(strings.Repeat("a", 40))
+	body = body[:len(body)-1] + `,"padding":"` + strings.Repeat("x", 2048) + `"}`
+	w := postWebhook(s, "push", body)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("got %d %s, want 413", w.Code, w.Body)
+	}
+	if len(s.jobs.order) != 0 {
+		t.Fatalf("queued %d jobs", len(s.jobs.order))
+	}
+}
+
+// BenchmarkWebhookConfig measures a delivery that matches no entry with
+// the config held in memory and, for comparison, re-read from disk on
+// every delivery.
+func BenchmarkWebhookConfig(b *testing.B) {
+	dir := b.TempDir()
+	repos := map[string]Repo{}
+	for i := range 50 {
+		key := fmt.Sprintf("o/app%d", i)
+		repos[key] = Repo{ID: key, Branch: "main", Install: "make install", Service: &SystemdService{Name: key}}
+	}
+	repos["o/app"] = Repo{ID: "o/app", Branch: "main"}
+	data, err := json.Marshal(repos)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = os.WriteFile(dir+"/repos.json", data, 0o644)
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := &Server{cfg: Config{ConfigFile: dir + "/repos.json", Root: dir, MaxBodyBytes: 1 << 20}}
+	err = s.Reload()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	body := strings.Replace(pushPayload(strings.Repeat("a", 40)), "refs/heads/main", "refs/heads/other", 1)
+	deliver := func(b *testing.B) {
+		w := postWebhook(s, "push", body)
+		if w.Code != http.StatusOK {
+			b.Fatalf("got %d %s", w.Code, w.Body)
+		}
+	}
+	b.Run("memory", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			deliver(b)
+		}
+	})
+	b.Run("disk", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			err := s.Reload()
+			if err != nil {
+				b.Fatal(err)
+			}
+			deliver(b)
+		}
+	})
+}
+
+func TestWebhookIgnoresDryRun(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), map[string]Repo{"o/app": {ID: "o/app", Branch: "main", Install: "make install"}})
+	ran := make(chan *Job, 1)
+	s.dispatcher = NewDispatcher(1, func(j *Job) { ran <- j })
+	r := httptest.NewRequest("POST", "/?dry_run", strings.NewReader(pushPayload(strings.Repeat("a", 40))))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-GitHub-Event", "push")
+	w := httptest.NewRecorder()
+	s.webhookHandler(w, r)
+	if w.Code != http.StatusAccepted || strings.Contains(w.Body.String(), "make install") {
+		t.Fatalf("got %d %s, want the deploy queued without its plan", w.Code, w.Body)
+	}
+	<-ran
+}
@@ -1,337 +1,414 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
+	"context"
+	"flag"
 	"fmt"
-	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/mikerybka/github-sync/githubsync"
 	"github.com/mikerybka/util"
 )
 
 func main() {
-	token := util.RequireEnvVar("GITHUB_TOKEN")
-	webhookURL := util.RequireEnvVar("EXTERNAL_URL")
-	port := util.RequireEnvVar("PORT")
-	configFile := filepath.Join(util.HomeDir(), "repos.json")
-	config, err := readConfig(configFile)
-	if err != nil {
-		fmt.Println("Error:", err)
+	// Answer git's credential prompts when run as GIT_ASKPASS
+	if githubsync.Askpass() {
 		return
 	}
+	slog.SetDefault(newLogger(os.Getenv("LOG_FORMAT"), os.Getenv("DEBUG") != ""))
+
+	pruneDirs := flag.Bool("prune-dirs", false, "remove the checkout of repos that are no longer configured")
+	recloneEmpty := flag.Bool("reclone-empty", false, "clone into existing checkout directories that are empty but not git repos")
+	repos := flag.String("repos", "", "comma-separated repos or globs, e.g. owner/*, to limit syncing and deploys to")
+	approveCommands := flag.Bool("approve-commands", false, "approve the shell commands currently in the config")
+	dryRun := flag.Bool("dry-run", false, "print the git, install and systemctl commands syncing and deploying would run, without running them")
+	root := flag.String("root", util.EnvVar("ROOT_DIR", util.HomeDir()), "directory to check repos out in and keep the config and state in, e.g. /var/lib/github-sync")
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "repos config file, JSON, YAML or TOML (default repos.json, .yaml, .yml or .toml in the root directory)")
+	flag.Parse()
+	if *configFile == "" {
+		*configFile = githubsync.DefaultConfigFile(*root)
+	}
 
-	for id, repo := range config {
-		// Check if folder exists
-		name := strings.Split(id, "/")[1]
-		path := filepath.Join(util.HomeDir(), name)
-		fi, err := os.Stat(path)
-		if err != nil {
-			if !errors.Is(err, os.ErrNotExist) {
-				panic(err)
-			} else {
-				// If the folder doesn't exist, clone
-				gitURL := fmt.Sprintf("https://github.com/%s.git", id)
-				err = clone(path, gitURL, repo.Branch)
-				if err != nil {
-					fmt.Printf("Error cloning %s: %s\n", id, err)
-					return
-				}
+	if flag.Arg(0) == "history" {
+		var recs []*githubsync.AuditRecord
+		var err error
+		if path := os.Getenv("HISTORY_DB"); path != "" {
+			var db *githubsync.HistoryDB
+			db, err = githubsync.OpenHistoryDB(path)
+			if err == nil {
+				recs, err = db.Read(flag.Arg(1), 0)
+				db.Close()
 			}
 		} else {
-			// Error if the namespace is already taken by a file
-			if !fi.IsDir() {
-				fmt.Println("Error:", path, "is file")
-				return
-			}
+			audit := &githubsync.AuditLog{Path: util.RequireEnvVar("AUDIT_LOG")}
+			recs, err = audit.Read(flag.Arg(1), 0)
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tREPO\tCOMMIT\tPUSHER\tRESULT\tDURATION\tERROR")
+		for _, rec := range recs {
+			fmt.Fprintf(w, "%s\t%s\t%.12s\t%s\t%s\t%.1fs\t%s\n", rec.Time.Format(time.RFC3339), rec.Repo, rec.Commit, rec.Pusher, rec.Result, rec.Duration, rec.Error)
+		}
+		w.Flush()
+		return
+	}
 
-			// Error if path is not a git repo
-			branch, err := getBranch(path)
+	cfg := githubsync.Config{
+		Token:                   os.Getenv("GITHUB_TOKEN"),
+		GitHubURL:               os.Getenv("GITHUB_URL"),
+		GitLabToken:             os.Getenv("GITLAB_TOKEN"),
+		GiteaToken:              os.Getenv("GITEA_TOKEN"),
+		BitbucketUsername:       os.Getenv("BITBUCKET_USERNAME"),
+		BitbucketAppPassword:    os.Getenv("BITBUCKET_APP_PASSWORD"),
+		WebhookSecret:           os.Getenv("WEBHOOK_SECRET"),
+		Root:                    *root,
+		ConfigFile:              *configFile,
+		ConfigDir:               os.Getenv("CONFIG_DIR"),
+		ConfigRepo:              os.Getenv("CONFIG_REPO"),
+		ConfigRepoBranch:        os.Getenv("CONFIG_REPO_BRANCH"),
+		ConfigRepoDir:           os.Getenv("CONFIG_REPO_DIR"),
+		ConfigRepoPath:          os.Getenv("CONFIG_REPO_PATH"),
+		DiscoverOwner:           os.Getenv("DISCOVER_OWNER"),
+		DiscoverTopic:           os.Getenv("DISCOVER_TOPIC"),
+		DiscoverDefaults:        os.Getenv("DISCOVER_DEFAULTS"),
+		AuditLog:                os.Getenv("AUDIT_LOG"),
+		HistoryDB:               os.Getenv("HISTORY_DB"),
+		LogDir:                  os.Getenv("LOG_DIR"),
+		UnitDir:                 os.Getenv("UNIT_DIR"),
+		SSHKeyDir:               os.Getenv("SSH_KEY_DIR"),
+		GitBinary:               util.EnvVar("GIT_BINARY", "git"),
+		GitOptions:              strings.Fields(os.Getenv("GIT_CONFIG_OPTIONS")),
+		RecloneEmpty:            *recloneEmpty,
+		PruneDirs:               *pruneDirs,
+		RepoFilter:              splitList(*repos),
+		RequireApprovedCommands: os.Getenv("REQUIRE_APPROVED_COMMANDS") == "true",
+		ApproveCommands:         *approveCommands,
+		IPAllowlist:             os.Getenv("GITHUB_IP_ALLOWLIST") == "true",
+		CommitStatuses:          os.Getenv("GITHUB_COMMIT_STATUSES") == "true",
+		Deployments:             os.Getenv("GITHUB_DEPLOYMENTS") == "true",
+		AdminToken:              os.Getenv("ADMIN_TOKEN"),
+		AppPrivateKey:           os.Getenv("GITHUB_APP_PRIVATE_KEY"),
+		SlackWebhookURL:         os.Getenv("SLACK_WEBHOOK_URL"),
+		NotifyWebhooks:          splitList(os.Getenv("NOTIFY_WEBHOOKS")),
+		SMTPAddr:                os.Getenv("SMTP_ADDR"),
+		SMTPUsername:            os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:            os.Getenv("SMTP_PASSWORD"),
+		SMTPFrom:                os.Getenv("SMTP_FROM"),
+		EmailTo:                 splitList(os.Getenv("EMAIL_TO")),
+	}
+	for name, v := range map[string]*int64{
+		"GITHUB_APP_ID":              &cfg.AppID,
+		"GITHUB_APP_INSTALLATION_ID": &cfg.AppInstallationID,
+	} {
+		if env := os.Getenv(name); env != "" {
+			var err error
+			*v, err = strconv.ParseInt(env, 10, 64)
 			if err != nil {
-				fmt.Println("Error:", err)
-				return
+				fmt.Printf("Error: %s: %s\n", name, err)
+				os.Exit(1)
 			}
+		}
+	}
 
-			// Error if path is a git repo but checked out to the wrong branch
-			if branch != repo.Branch {
-				fmt.Println("Error:", repo.ID, "is checked out to the wrong branch")
-				return
-			}
+	var err error
+	cfg.SyncWorkers, err = strconv.Atoi(util.EnvVar("SYNC_WORKERS", "4"))
+	if err != nil || cfg.SyncWorkers < 1 {
+		fmt.Println("Error: SYNC_WORKERS must be a positive integer")
+		os.Exit(1)
+	}
 
-			// Pull
-			err = pull(path)
-			if err != nil {
-				fmt.Printf("Error pulling %s: %s\n", id, err)
-				return
-			}
+	switch flag.Arg(0) {
+	case "", "serve", "history", "rollback", "validate", "sync", "status", "deploy":
+	case "add", "remove":
+		if cfg.ConfigDir != "" || cfg.ConfigRepo != "" {
+			fmt.Println("Error: add and remove only edit the --config file")
+			os.Exit(1)
 		}
-
-		err = registerHook(token, repo.ID, webhookURL)
+		err := editConfig(cfg.ConfigFile, flag.Arg(0), flag.Args()[1:])
 		if err != nil {
 			fmt.Println("Error:", err)
-			return
+			os.Exit(1)
 		}
-	}
-
-	// Start webhook handler
-	http.HandleFunc("/", webhookHandler)
-
-	fmt.Println("Listening on port", port)
-	err = http.ListenAndServe(":"+port, nil)
-	if err != nil {
-		fmt.Println("Error:", err)
+		fmt.Println("Updated", cfg.ConfigFile+", reload github-sync to apply")
 		return
+	default:
+		fmt.Println("Usage: github-sync [serve|sync|status|deploy|rollback|validate|history|add|remove]")
+		os.Exit(2)
 	}
-}
 
-func clone(path, gitURL, branch string) error {
-	args := []string{"clone"}
-	if branch != "" {
-		// --single-branch avoids unnecessary history for other branches.
-		args = append(args, "--branch", branch, "--single-branch")
+	if *dryRun {
+		switch flag.Arg(0) {
+		case "", "serve", "sync":
+		case "deploy":
+			if flag.NArg() != 2 {
+				fmt.Println("Usage: github-sync -dry-run deploy <owner/name>")
+				os.Exit(2)
+			}
+			cfg.RepoFilter = []string{flag.Arg(1)}
+		default:
+			fmt.Println("Error: -dry-run only applies to serve, sync and deploy")
+			os.Exit(2)
+		}
+		s, err := githubsync.New(cfg)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		s.DryRun(context.Background(), os.Stdout)
+		return
 	}
-	args = append(args, gitURL, path)
-	cmd := exec.Command("git", args...)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("git clone failed: %v\n%s", err, out)
+	if flag.Arg(0) == "rollback" {
+		if flag.NArg() < 2 {
+			fmt.Println("Usage: github-sync rollback <owner/name> [release]")
+			os.Exit(2)
+		}
+		s, err := githubsync.New(cfg)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		err = s.RollbackOnce(context.Background(), flag.Arg(1), flag.Arg(2))
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
 	}
-
-	return nil
-}
-
-func getBranch(path string) (string, error) {
-	cmd := exec.Command("git", "-C", path, "rev-parse", "--abbrev-ref", "HEAD")
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		return "", errors.New(stderr.String())
-	}
-	branch := strings.TrimSpace(stdout.String())
-	return branch, nil
-}
-
-func pull(path string) error {
-	cmd := exec.Command("git", "pull")
-	cmd.Dir = path
-	b, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(b)))
+	if flag.Arg(0) == "deploy" {
+		if flag.NArg() != 2 {
+			fmt.Println("Usage: github-sync deploy <owner/name>")
+			os.Exit(2)
+		}
+		s, err := githubsync.New(cfg)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		err = s.DeployOnce(context.Background(), flag.Arg(1))
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
 	}
-	return nil
-}
-
-func readConfig(path string) (map[string]Repo, error) {
-	repos := map[string]Repo{}
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
+	if flag.Arg(0) == "sync" || flag.Arg(0) == "status" {
+		s, err := githubsync.New(cfg)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		if flag.Arg(0) == "sync" {
+			err = s.SyncCheckouts(context.Background())
+		} else {
+			err = s.PrintStatus(context.Background(), os.Stdout)
+		}
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
 	}
-	defer f.Close()
-	err = json.NewDecoder(f).Decode(&repos)
-	if err != nil {
-		return nil, err
+	if flag.Arg(0) == "validate" {
+		s, err := githubsync.New(cfg)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		if !s.Validate(context.Background()) {
+			os.Exit(1)
+		}
+		return
 	}
-	return repos, nil
-}
-
-type Repo struct {
-	ID      string          `json:"id"`
-	Branch  string          `json:"branch"`
-	Install string          `json:"install"`
-	Service *SystemdService `json:"service"`
-}
-
-type SystemdService struct {
-	Name  string            `json:"name"`
-	Env   map[string]string `json:"env"`
-	Start string            `json:"start"`
-	User  string            `json:"user"`
-	Dir   string            `json:"dir"`
-}
-
-func registerHook(ghToken, repoID, webhookURL string) error {
-	// Get list of current hooks
-	apiURL := fmt.Sprintf("https://api.github.com/repos/%s/hooks", repoID)
-	req, err := http.NewRequest("GET", apiURL, nil)
-	if err != nil {
-		panic(err)
+	cfg.ExternalURL = util.RequireEnvVar("EXTERNAL_URL")
+	port := util.RequireEnvVar("PORT")
+	cfg.MaxConcurrentDeploys, err = strconv.Atoi(util.EnvVar("MAX_CONCURRENT_DEPLOYS", "4"))
+	if err != nil || cfg.MaxConcurrentDeploys < 1 {
+		fmt.Println("Error: MAX_CONCURRENT_DEPLOYS must be a positive integer")
+		os.Exit(1)
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("token %s", ghToken))
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+	cfg.MaxQueueDepth, err = strconv.Atoi(util.EnvVar("MAX_QUEUE_DEPTH", "100"))
+	if err != nil || cfg.MaxQueueDepth < 1 {
+		fmt.Println("Error: MAX_QUEUE_DEPTH must be a positive integer")
+		os.Exit(1)
 	}
-	defer res.Body.Close()
-	hooks := []Hook{}
-	err = json.NewDecoder(res.Body).Decode(&hooks)
+	grace, err := time.ParseDuration(util.EnvVar("SHUTDOWN_GRACE", "30s"))
 	if err != nil {
-		panic(err)
+		fmt.Println("Error: SHUTDOWN_GRACE:", err)
+		os.Exit(1)
 	}
-
-	// Return early if URL is already registered
-	for _, hook := range hooks {
-		if hook.Config.URL == webhookURL && hook.Active && includes(hook.Events, "push") && hook.Config.ContentType == "json" {
-			return nil
+	if v := os.Getenv("MAX_WEBHOOK_BODY"); v != "" {
+		cfg.MaxBodyBytes, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			fmt.Println("Error: MAX_WEBHOOK_BODY:", err)
+			os.Exit(1)
 		}
 	}
-
-	// Create the hook
-	body, err := json.Marshal(Hook{
-		Name:   "web",
-		Active: true,
-		Events: []string{"push"},
-		Config: &HookConfig{
-			URL:         webhookURL,
-			ContentType: "json",
-		},
-	})
+	cfg.CloneRetries, err = strconv.Atoi(util.EnvVar("CLONE_RETRIES", "3"))
 	if err != nil {
-		panic(err)
+		fmt.Println("Error: CLONE_RETRIES:", err)
+		os.Exit(1)
 	}
-	req, err = http.NewRequest("POST", apiURL, bytes.NewReader(body))
+	cfg.HistorySize, err = strconv.Atoi(util.EnvVar("DEPLOY_HISTORY", "10"))
 	if err != nil {
-		panic(err)
+		fmt.Println("Error: DEPLOY_HISTORY:", err)
+		os.Exit(1)
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("token %s", ghToken))
-	res, err = http.DefaultClient.Do(req)
+	cfg.TrustedProxyDepth, err = strconv.Atoi(util.EnvVar("TRUSTED_PROXY_DEPTH", "0"))
 	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
-	if res.StatusCode != 201 {
-		b, _ := io.ReadAll(res.Body)
-		return fmt.Errorf("%d: %s", res.StatusCode, strings.TrimSpace(string(b)))
-	}
-
-	return nil
-}
-
-func includes(list []string, s string) bool {
-	for _, item := range list {
-		if item == s {
-			return true
-		}
+		fmt.Println("Error: TRUSTED_PROXY_DEPTH:", err)
+		os.Exit(1)
 	}
-	return false
-}
-
-type Hook struct {
-	Name   string      `json:"name"`
-	Active bool        `json:"active"`
-	Events []string    `json:"events"`
-	Config *HookConfig `json:"config"`
-}
-
-type HookConfig struct {
-	URL         string `json:"url"`
-	ContentType string `json:"content_type"`
-}
-
-func webhookHandler(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-
-	// Parse webhook
-	req := &WebhookRequest{}
-	err := json.NewDecoder(r.Body).Decode(req)
+	cfg.EmailAfterFailures, err = strconv.Atoi(util.EnvVar("EMAIL_AFTER_FAILURES", "1"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// Read config
-	repos, err := readConfig(filepath.Join(util.HomeDir(), "repos.json"))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	repoID := req.Repository.FullName
-	repo, ok := repos[repoID]
-	if !ok {
-		http.Error(w, fmt.Sprintf("repo %s not configured", repoID), http.StatusBadRequest)
-		return
+		fmt.Println("Error: EMAIL_AFTER_FAILURES:", err)
+		os.Exit(1)
 	}
-
-	// Pull
-	path := filepath.Join(util.HomeDir(), req.Repository.Name)
-	err = pull(path)
+	cfg.LockWait, err = time.ParseDuration(util.EnvVar("LOCK_WAIT", "30s"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		fmt.Println("Error: LOCK_WAIT:", err)
+		os.Exit(1)
 	}
-
-	// Stop service
-	if repo.Service.Name != "" {
-		fmt.Println("systemctl stop", repo.Service.Name)
-		cmd := exec.Command("systemctl", "stop", repo.Service.Name)
-		cmd.Dir = path
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
+	if v := os.Getenv("DISCOVER_INTERVAL"); v != "" {
+		cfg.DiscoverInterval, err = time.ParseDuration(v)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			fmt.Println("Error: DISCOVER_INTERVAL:", err)
+			os.Exit(1)
 		}
 	}
-
-	// Install
-	if repo.Install != "" {
-		fmt.Println(repo.Install)
-		cmd := exec.Command("bash", "-c", repo.Install)
-		cmd.Dir = path
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
+	if v := os.Getenv("GIT_MAINTENANCE_INTERVAL"); v != "" {
+		cfg.MaintenanceInterval, err = time.ParseDuration(v)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			fmt.Println("Error: GIT_MAINTENANCE_INTERVAL:", err)
+			os.Exit(1)
 		}
 	}
 
-	// Write service file
+	s, err := githubsync.New(cfg)
+	if err != nil {
+		slog.Error("Starting failed", "err", err)
+		os.Exit(1)
+	}
 
-	// Reload systemd
-	if repo.Service.Name != "" {
-		fmt.Println("systemctl daemon-reload")
-		cmd := exec.Command("systemctl", "daemon-reload")
-		cmd.Dir = path
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	// Start webhook handler. Deploys are held until the startup sync is done.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// An empty BIND_ADDR listens on all interfaces
+	addr := net.JoinHostPort(os.Getenv("BIND_ADDR"), port)
+	srv := &http.Server{Addr: addr, Handler: s}
+	go func() {
+		slog.Info("Listening", "addr", addr)
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("Serving failed", "err", err)
+			os.Exit(1)
 		}
-	}
+	}()
+
+	// Apply config changes on SIGHUP, once the startup sync is done
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			slog.Info("Reloading config")
+			err := s.ReloadAndSync(ctx)
+			if err != nil {
+				slog.Error("Reloading config failed", "err", err)
+			}
+		}
+	}()
 
-	// Start service
-	if repo.Service.Name != "" {
-		fmt.Println("systemctl start", repo.Service.Name)
-		cmd := exec.Command("systemctl", "start", repo.Service.Name)
-		cmd.Dir = path
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
+	// Apply changes to CONFIG_DIR the same way
+	go func() {
+		err := s.WatchConfigDir(ctx)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			slog.Error("Watching config dir failed", "err", err)
 		}
+	}()
+
+	// Sync repos and register hooks
+	err = s.SyncAll(ctx)
+	if err != nil {
+		slog.Error("Syncing repos failed", "err", err)
+		os.Exit(1)
 	}
+	slog.Info("Ready")
+
+	// Start watchdogs and git maintenance
+	s.StartBackground()
+
+	// Graceful shutdown
+	<-ctx.Done()
+	slog.Info("Shutting down, waiting for running deploys", "grace", grace.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	go srv.Shutdown(shutdownCtx)
+	s.Drain(grace)
+}
 
-	fmt.Fprintln(w, "ok in", time.Since(start).Milliseconds(), "ms")
+// editConfig runs the add or remove subcommand with args on the config
+// file at path.
+func editConfig(path, cmd string, args []string) error {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	branch := fs.String("branch", "", "branch to deploy")
+	install := fs.String("install", "", "command to run after every pull")
+	service := fs.String("service", "", "systemd service to restart on every deploy")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: github-sync %s [flags] <owner/name>", cmd)
+	}
+	key := fs.Arg(0)
+	if cmd == "remove" {
+		return githubsync.RemoveFromConfig(path, key)
+	}
+	entry := map[string]any{}
+	if _, keyBranch, ok := strings.Cut(key, "@"); ok && *branch == "" {
+		*branch = keyBranch
+	}
+	if *branch != "" {
+		entry["branch"] = *branch
+	}
+	if *install != "" {
+		entry["install"] = *install
+	}
+	if *service != "" {
+		entry["service"] = map[string]string{"name": *service}
+	}
+	return githubsync.AddToConfig(path, key, entry)
 }
 
-type WebhookRequest struct {
-	Repository *GithubRepository `json:"repository"`
+// newLogger returns the process logger: JSON lines if format is "json",
+// logfmt-style text otherwise.
+func newLogger(format string, debug bool) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if debug {
+		opts.Level = slog.LevelDebug
+	}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stdout, opts))
 }
 
-type GithubRepository struct {
-	Name     string `json:"name"`
-	FullName string `json:"full_name"`
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }